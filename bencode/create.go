@@ -0,0 +1,271 @@
+package bencode
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const minPieceLength = 16 * 1024
+const maxPieceLength = 16 * 1024 * 1024
+const targetPieces = 1500 // pieces an automatically chosen piece length aims for
+
+// CreateOptions describes a torrent to create. Only the path is required.
+type CreateOptions struct {
+	PieceLength  int64      // a power of two of at least 16KiB, 0 to choose one from the size
+	AnnounceList [][]string // tiers of trackers, the first tracker is also written as announce
+	Comment      string
+	CreatedBy    string
+	CreationDate time.Time // left out when zero
+	Private      bool
+	WebSeeds     []string
+	Source       string
+	Workers      int // goroutines hashing pieces, 0 for one per CPU
+}
+
+// CreateTorrent builds a torrent of the file or directory at path and returns
+// its encoding. A directory becomes a multi file torrent of every regular file
+// under it, in lexical order.
+func CreateTorrent(path string, options CreateOptions) ([]byte, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	files, err := collectFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	var length int64
+	for i := range files {
+		files[i].Offset = length
+		length += files[i].Length
+	}
+	if length == 0 {
+		return nil, errors.New("nothing to share, the files are empty")
+	}
+
+	pieceLength := options.PieceLength
+	if pieceLength == 0 {
+		pieceLength = choosePieceLength(length)
+	}
+	if pieceLength < minPieceLength || pieceLength&(pieceLength-1) != 0 {
+		return nil, fmt.Errorf("piece length %d is not a power of two of at least %d", pieceLength, minPieceLength)
+	}
+	workers := options.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	pieces, err := hashPieces(path, files, length, pieceLength, workers)
+	if err != nil {
+		return nil, err
+	}
+
+	info := bencodeInfo{
+		Pieces:      string(pieces),
+		PieceLength: pieceLength,
+		Name:        filepath.Base(path),
+		Source:      options.Source,
+	}
+	if options.Private {
+		info.Private = 1
+	}
+	info.Length = length
+	if files[0].Path != "" {
+		info.Length = 0
+		for _, file := range files {
+			info.Files = append(info.Files, bencodeFile{Length: file.Length, Path: strings.Split(file.Path, "/")})
+		}
+	}
+	infoBytes, err := Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+
+	torrent := BencodeType{
+		Comment:   options.Comment,
+		CreatedBy: options.CreatedBy,
+		Info:      infoBytes,
+	}
+	tiers := announceTiers("", options.AnnounceList)
+	if len(tiers) > 0 {
+		torrent.Announce = tiers[0][0]
+	}
+	if len(tiers) > 1 || len(tiers) == 1 && len(tiers[0]) > 1 {
+		torrent.AnnounceList = tiers
+	}
+	if !options.CreationDate.IsZero() {
+		torrent.CreationDate = options.CreationDate.Unix()
+	}
+	if len(options.WebSeeds) > 0 {
+		urlList := NewList()
+		for _, seedURL := range options.WebSeeds {
+			urlList.List = append(urlList.List, NewString(seedURL))
+		}
+		torrent.URLList = urlList
+	}
+	return Marshal(torrent)
+}
+
+// collectFiles lists the files of the torrent, with paths relative to path
+// using forward slashes. A single file has an empty path.
+func collectFiles(path string) ([]TorrentFile, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []TorrentFile{{Length: info.Size()}}, nil
+	}
+
+	var files []TorrentFile
+	err = filepath.WalkDir(path, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil // Directories, symlinks and devices
+		}
+		fileInfo, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(path, filePath)
+		if err != nil {
+			return err
+		}
+		files = append(files, TorrentFile{Path: filepath.ToSlash(relative), Length: fileInfo.Size()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files in %s", path)
+	}
+	return files, nil
+}
+
+// choosePieceLength picks the smallest power of two that keeps the number of
+// pieces near targetPieces
+func choosePieceLength(length int64) int64 {
+	pieceLength := int64(minPieceLength)
+	for length/pieceLength > targetPieces && pieceLength < maxPieceLength {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// hashPieces reads the files as one stream cut into pieces and returns the
+// concatenated SHA-1 hashes. Pieces are hashed by several workers at once,
+// each reading its own pieces.
+func hashPieces(root string, files []TorrentFile, length int64, pieceLength int64, workers int) ([]byte, error) {
+	numPieces := int((length + pieceLength - 1) / pieceLength)
+	pieces := make([]byte, numPieces*bytesPerChunk)
+	indexes := make(chan int)
+	errs := make(chan error, workers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reader := &pieceReader{root: root, files: files}
+			defer reader.Close()
+			buf := make([]byte, pieceLength)
+			for index := range indexes {
+				start := int64(index) * pieceLength
+				piece := buf[:min(pieceLength, length-start)]
+				err := reader.readPiece(start, piece)
+				if err != nil {
+					errs <- err
+					return
+				}
+				hash := sha1.Sum(piece)
+				copy(pieces[index*bytesPerChunk:], hash[:])
+			}
+		}()
+	}
+
+	var err error
+feed:
+	for index := 0; index < numPieces; index++ {
+		select {
+		case indexes <- index:
+		case err = <-errs:
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+	if err == nil && len(errs) > 0 {
+		err = <-errs
+	}
+	return pieces, err
+}
+
+// pieceReader reads the files of the torrent for one worker. The file read
+// last stays open, the pieces of a worker come in order so most of them are
+// in the same file as the one before.
+type pieceReader struct {
+	root  string
+	files []TorrentFile
+	index int      // of the open file in files
+	file  *os.File // nil while no file is open
+}
+
+// readPiece fills buf with the bytes of the torrent starting at start, which
+// may span several files
+func (reader *pieceReader) readPiece(start int64, buf []byte) error {
+	end := start + int64(len(buf))
+	for i, f := range reader.files {
+		fileEnd := f.Offset + f.Length
+		if end <= f.Offset || start >= fileEnd {
+			continue
+		}
+
+		err := reader.open(i)
+		if err != nil {
+			return err
+		}
+		segmentStart := max(start, f.Offset)
+		segmentEnd := min(end, fileEnd)
+		_, err = reader.file.ReadAt(buf[segmentStart-start:segmentEnd-start], segmentStart-f.Offset)
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("%s changed while hashing", f.Path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// open makes the file at index the open one
+func (reader *pieceReader) open(index int) error {
+	if reader.file != nil && reader.index == index {
+		return nil
+	}
+	reader.Close()
+	file, err := os.Open(filepath.Join(reader.root, filepath.FromSlash(reader.files[index].Path)))
+	if err != nil {
+		return err
+	}
+	reader.file = file
+	reader.index = index
+	return nil
+}
+
+func (reader *pieceReader) Close() {
+	if reader.file != nil {
+		reader.file.Close()
+		reader.file = nil
+	}
+}
@@ -0,0 +1,136 @@
+package bencode
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testPieceLength = 16384
+
+type testFile struct {
+	path string // relative to the directory, with forward slashes
+	data []byte
+}
+
+func randomData(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func writeFiles(t *testing.T, root string, files []testFile) {
+	t.Helper()
+	for _, file := range files {
+		path := filepath.Join(root, filepath.FromSlash(file.path))
+		err := os.MkdirAll(filepath.Dir(path), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, file.data, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// pieceHashes hashes data the way a torrent of it is expected to
+func pieceHashes(data []byte) string {
+	var pieces []byte
+	for start := 0; start < len(data); start += testPieceLength {
+		hash := sha1.Sum(data[start:min(start+testPieceLength, len(data))])
+		pieces = append(pieces, hash[:]...)
+	}
+	return string(pieces)
+}
+
+// createAndParse creates a torrent of path and parses it back, checking that
+// the infohash is the hash of want encoded
+func createAndParse(t *testing.T, path string, want Value) TorrentType {
+	t.Helper()
+	options := CreateOptions{
+		PieceLength:  testPieceLength,
+		AnnounceList: [][]string{{"udp://tracker:80"}},
+		WebSeeds:     []string{"http://seed/"},
+		Workers:      3,
+	}
+	data, err := CreateTorrent(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent, err := ParseTorrent(bytes.NewReader(data), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	infoBytes, err := Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torrent.InfoHash != sha1.Sum(infoBytes) {
+		t.Fatalf("info dictionary is %q, want %q", torrent.InfoBytes, infoBytes)
+	}
+	if torrent.Announce != "udp://tracker:80" || !reflect.DeepEqual(torrent.WebSeeds, options.WebSeeds) {
+		t.Errorf("announce %q and web seeds %v, want the ones passed", torrent.Announce, torrent.WebSeeds)
+	}
+	return torrent
+}
+
+func TestCreateSingleFile(t *testing.T) {
+	data := randomData(1, 4*testPieceLength+123)
+	root := t.TempDir()
+	writeFiles(t, root, []testFile{{path: "file.bin", data: data}})
+
+	want := NewDict(map[string]Value{
+		"length":       NewInt(int64(len(data))),
+		"name":         NewString("file.bin"),
+		"piece length": NewInt(testPieceLength),
+		"pieces":       NewString(pieceHashes(data)),
+	})
+	torrent := createAndParse(t, filepath.Join(root, "file.bin"), want)
+	if torrent.MultiFile || torrent.Length != int64(len(data)) || torrent.NumPieces != 5 {
+		t.Errorf("parsed a torrent of %d bytes in %d pieces, multi file %v", torrent.Length, torrent.NumPieces, torrent.MultiFile)
+	}
+}
+
+func TestCreateDirectory(t *testing.T) {
+	// Files come in lexical order, the nested ones between their siblings,
+	// and pieces span the ends of files
+	files := []testFile{
+		{path: "a.txt", data: randomData(2, 1000)},
+		{path: "sub/b.bin", data: randomData(3, 2*testPieceLength+10)},
+		{path: "sub/deeper/c.bin", data: randomData(4, testPieceLength)},
+		{path: "z.bin", data: randomData(5, 1)},
+	}
+	root := filepath.Join(t.TempDir(), "album")
+	writeFiles(t, root, files)
+
+	var data []byte
+	var fileList []Value
+	for _, file := range files {
+		data = append(data, file.data...)
+		var path []Value
+		for _, component := range strings.Split(file.path, "/") {
+			path = append(path, NewString(component))
+		}
+		fileList = append(fileList, NewDict(map[string]Value{
+			"length": NewInt(int64(len(file.data))),
+			"path":   NewList(path...),
+		}))
+	}
+	want := NewDict(map[string]Value{
+		"files":        NewList(fileList...),
+		"name":         NewString("album"),
+		"piece length": NewInt(testPieceLength),
+		"pieces":       NewString(pieceHashes(data)),
+	})
+	torrent := createAndParse(t, root, want)
+	if !torrent.MultiFile || len(torrent.Files) != len(files) || torrent.Length != int64(len(data)) {
+		t.Errorf("parsed %d files of %d bytes, multi file %v", len(torrent.Files), torrent.Length, torrent.MultiFile)
+	}
+}
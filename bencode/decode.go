@@ -0,0 +1,518 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+const maxDepth = 512        // nesting of lists and dictionaries, deeper input is rejected
+const maxIntegerDigits = 20 // enough for any int64 with its sign
+
+var valueType = reflect.TypeOf(Value{})
+var rawMessageType = reflect.TypeOf(RawMessage{})
+
+// SyntaxError is input that isn't canonical bencoding. Offset is where in the
+// input the offending value starts.
+type SyntaxError struct {
+	Offset int64
+	Msg    string
+}
+
+func (err *SyntaxError) Error() string {
+	return fmt.Sprintf("bencode: %s at offset %d", err.Msg, err.Offset)
+}
+
+// UnmarshalTypeError is a value that doesn't fit the Go value it is decoded
+// into, either by kind or because an integer is out of the type's range
+type UnmarshalTypeError struct {
+	Offset int64
+	Kind   Kind
+	Type   reflect.Type
+}
+
+func (err *UnmarshalTypeError) Error() string {
+	return fmt.Sprintf("bencode: can't unmarshal %v into %v at offset %d", err.Kind, err.Type, err.Offset)
+}
+
+type byteScanner interface {
+	io.Reader
+	io.ByteScanner
+}
+
+// Decoder reads bencoded values from a stream. Input is validated strictly:
+// dictionary keys must be sorted and unique, integers and lengths can't have
+// leading zeros. A reader that isn't an io.ByteScanner is buffered, so the
+// Decoder may read past the end of the last value.
+type Decoder struct {
+	reader  byteScanner
+	offset  int64
+	depth   int
+	capture *bytes.Buffer // receives the input while a RawMessage is read
+}
+
+func NewDecoder(reader io.Reader) *Decoder {
+	scanner, ok := reader.(byteScanner)
+	if !ok {
+		scanner = bufio.NewReader(reader)
+	}
+	return &Decoder{reader: scanner}
+}
+
+// InputOffset returns how many bytes of input the decoded values took up
+func (decoder *Decoder) InputOffset() int64 {
+	return decoder.offset
+}
+
+// Decode reads the next value into v, which must be a non-nil pointer. It
+// returns io.EOF when the input ends before a value starts.
+//
+// Integers decode into any integer type that can hold them, strings into
+// strings, byte slices and byte arrays of their length, lists into slices and
+// arrays, dictionaries into structs and maps with string keys. A struct field
+// takes the key in its bencode tag, or its name without one. Keys without a
+// field are skipped. Value and interface{} take anything, as a Value, and
+// RawMessage takes a copy of the encoded value.
+func (decoder *Decoder) Decode(v any) error {
+	target := reflect.ValueOf(v)
+	if target.Kind() != reflect.Pointer || target.IsNil() {
+		return errors.New("bencode: Decode needs a non-nil pointer")
+	}
+	_, err := decoder.peekByte()
+	if err != nil {
+		return err
+	}
+	return decoder.decode(target.Elem())
+}
+
+// Unmarshal decodes data, which must hold exactly one value, into v
+func Unmarshal(data []byte, v any) error {
+	decoder := NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(v)
+	if errors.Is(err, io.EOF) {
+		return decoder.syntaxError(0, "empty input")
+	}
+	if err != nil {
+		return err
+	}
+	if decoder.offset != int64(len(data)) {
+		return decoder.syntaxError(decoder.offset, "trailing data")
+	}
+	return nil
+}
+
+func (decoder *Decoder) syntaxError(offset int64, format string, args ...any) error {
+	return &SyntaxError{Offset: offset, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (decoder *Decoder) peekByte() (byte, error) {
+	b, err := decoder.reader.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	return b, decoder.reader.UnreadByte()
+}
+
+func (decoder *Decoder) readByte() (byte, error) {
+	b, err := decoder.reader.ReadByte()
+	if errors.Is(err, io.EOF) {
+		return 0, decoder.syntaxError(decoder.offset, "unexpected end of input")
+	}
+	if err != nil {
+		return 0, err
+	}
+	decoder.offset++
+	if decoder.capture != nil {
+		decoder.capture.WriteByte(b)
+	}
+	return b, nil
+}
+
+// peekValue returns the first byte of the next value without consuming it
+func (decoder *Decoder) peekValue() (byte, error) {
+	b, err := decoder.peekByte()
+	if errors.Is(err, io.EOF) {
+		return 0, decoder.syntaxError(decoder.offset, "unexpected end of input")
+	}
+	return b, err
+}
+
+// readBytes reads n bytes of a string, returning them only when keep is set
+// so skipped strings aren't held in memory
+func (decoder *Decoder) readBytes(n int64, keep bool) ([]byte, error) {
+	var buf bytes.Buffer
+	var writer io.Writer = io.Discard
+	if keep {
+		writer = &buf
+	}
+	if decoder.capture != nil {
+		writer = io.MultiWriter(writer, decoder.capture)
+	}
+	copied, err := io.CopyN(writer, decoder.reader, n)
+	decoder.offset += copied
+	if errors.Is(err, io.EOF) {
+		return nil, decoder.syntaxError(decoder.offset, "unexpected end of input")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readInteger reads a decimal number up to terminator, which is consumed
+func (decoder *Decoder) readInteger(terminator byte, allowNegative bool) (int64, error) {
+	start := decoder.offset
+	var digits []byte
+	for {
+		b, err := decoder.readByte()
+		if err != nil {
+			return 0, err
+		}
+		if b == terminator {
+			break
+		}
+		if len(digits) == maxIntegerDigits {
+			return 0, decoder.syntaxError(start, "integer too long")
+		}
+		digits = append(digits, b)
+	}
+
+	number := digits
+	if allowNegative && len(number) > 0 && number[0] == '-' {
+		number = number[1:]
+	}
+	if len(number) == 0 {
+		return 0, decoder.syntaxError(start, "missing digits")
+	}
+	for _, b := range number {
+		if b < '0' || b > '9' {
+			return 0, decoder.syntaxError(start, "invalid integer %q", digits)
+		}
+	}
+	if number[0] == '0' && len(number) > 1 {
+		return 0, decoder.syntaxError(start, "leading zero in %q", digits)
+	}
+	if number[0] == '0' && len(number) < len(digits) {
+		return 0, decoder.syntaxError(start, "negative zero")
+	}
+	i, err := strconv.ParseInt(string(digits), 10, 64)
+	if err != nil {
+		return 0, decoder.syntaxError(start, "integer %s out of range", digits)
+	}
+	return i, nil
+}
+
+func (decoder *Decoder) readString(keep bool) ([]byte, error) {
+	length, err := decoder.readInteger(':', false)
+	if err != nil {
+		return nil, err
+	}
+	return decoder.readBytes(length, keep)
+}
+
+// enter consumes the l or d that opens a list or dictionary
+func (decoder *Decoder) enter() error {
+	if decoder.depth == maxDepth {
+		return decoder.syntaxError(decoder.offset, "nested too deeply")
+	}
+	decoder.depth++
+	_, err := decoder.readByte()
+	return err
+}
+
+// next reports whether the list or dictionary has another item, consuming
+// the e that closes it if not
+func (decoder *Decoder) next() (bool, error) {
+	b, err := decoder.peekValue()
+	if err != nil {
+		return false, err
+	}
+	if b != 'e' {
+		return true, nil
+	}
+	decoder.depth--
+	_, err = decoder.readByte()
+	return false, err
+}
+
+// readKey reads a dictionary key, which must sort after the previous one
+func (decoder *Decoder) readKey(previous []byte, first bool) ([]byte, error) {
+	start := decoder.offset
+	b, err := decoder.peekValue()
+	if err != nil {
+		return nil, err
+	}
+	if b < '0' || b > '9' {
+		return nil, decoder.syntaxError(start, "dictionary key is not a string")
+	}
+	key, err := decoder.readString(true)
+	if err != nil {
+		return nil, err
+	}
+	if !first {
+		switch bytes.Compare(previous, key) {
+		case 0:
+			return nil, decoder.syntaxError(start, "duplicate key %q", key)
+		case 1:
+			return nil, decoder.syntaxError(start, "key %q is out of order", key)
+		}
+	}
+	return key, nil
+}
+
+// readValue reads the next value, building it only when keep is set
+func (decoder *Decoder) readValue(keep bool) (Value, error) {
+	start := decoder.offset
+	b, err := decoder.peekValue()
+	if err != nil {
+		return Value{}, err
+	}
+	switch {
+	case b == 'i':
+		decoder.readByte()
+		i, err := decoder.readInteger('e', true)
+		return NewInt(i), err
+	case b >= '0' && b <= '9':
+		s, err := decoder.readString(keep)
+		return NewString(string(s)), err
+	case b == 'l':
+		err = decoder.enter()
+		if err != nil {
+			return Value{}, err
+		}
+		list := NewList()
+		for {
+			more, err := decoder.next()
+			if err != nil || !more {
+				return list, err
+			}
+			item, err := decoder.readValue(keep)
+			if err != nil {
+				return Value{}, err
+			}
+			if keep {
+				list.List = append(list.List, item)
+			}
+		}
+	case b == 'd':
+		err = decoder.enter()
+		if err != nil {
+			return Value{}, err
+		}
+		dict := NewDict(make(map[string]Value))
+		var key []byte
+		for first := true; ; first = false {
+			more, err := decoder.next()
+			if err != nil || !more {
+				return dict, err
+			}
+			key, err = decoder.readKey(key, first)
+			if err != nil {
+				return Value{}, err
+			}
+			item, err := decoder.readValue(keep)
+			if err != nil {
+				return Value{}, err
+			}
+			if keep {
+				dict.Dict[string(key)] = item
+			}
+		}
+	}
+	return Value{}, decoder.syntaxError(start, "invalid character %q", b)
+}
+
+func (decoder *Decoder) decode(target reflect.Value) error {
+	start := decoder.offset
+	switch target.Type() {
+	case valueType:
+		value, err := decoder.readValue(true)
+		if err != nil {
+			return err
+		}
+		target.Set(reflect.ValueOf(value))
+		return nil
+	case rawMessageType:
+		decoder.capture = new(bytes.Buffer)
+		_, err := decoder.readValue(false)
+		raw := decoder.capture.Bytes()
+		decoder.capture = nil
+		if err != nil {
+			return err
+		}
+		target.SetBytes(raw)
+		return nil
+	}
+
+	switch target.Kind() {
+	case reflect.Pointer:
+		if target.IsNil() {
+			target.Set(reflect.New(target.Type().Elem()))
+		}
+		return decoder.decode(target.Elem())
+	case reflect.Interface:
+		if target.NumMethod() == 0 {
+			value, err := decoder.readValue(true)
+			if err != nil {
+				return err
+			}
+			target.Set(reflect.ValueOf(value))
+			return nil
+		}
+	}
+
+	b, err := decoder.peekValue()
+	if err != nil {
+		return err
+	}
+	switch {
+	case b == 'i':
+		decoder.readByte()
+		i, err := decoder.readInteger('e', true)
+		if err != nil {
+			return err
+		}
+		return decoder.setInt(target, i, start)
+	case b >= '0' && b <= '9':
+		s, err := decoder.readString(true)
+		if err != nil {
+			return err
+		}
+		return decoder.setString(target, s, start)
+	case b == 'l':
+		return decoder.decodeList(target, start)
+	case b == 'd':
+		return decoder.decodeDict(target, start)
+	}
+	return decoder.syntaxError(start, "invalid character %q", b)
+}
+
+func (decoder *Decoder) setInt(target reflect.Value, i int64, start int64) error {
+	switch target.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if target.OverflowInt(i) {
+			return &UnmarshalTypeError{Offset: start, Kind: KindInt, Type: target.Type()}
+		}
+		target.SetInt(i)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if i < 0 || target.OverflowUint(uint64(i)) {
+			return &UnmarshalTypeError{Offset: start, Kind: KindInt, Type: target.Type()}
+		}
+		target.SetUint(uint64(i))
+		return nil
+	}
+	return &UnmarshalTypeError{Offset: start, Kind: KindInt, Type: target.Type()}
+}
+
+func (decoder *Decoder) setString(target reflect.Value, s []byte, start int64) error {
+	switch {
+	case target.Kind() == reflect.String:
+		target.SetString(string(s))
+		return nil
+	case target.Kind() == reflect.Slice && target.Type().Elem().Kind() == reflect.Uint8:
+		target.SetBytes(s)
+		return nil
+	case target.Kind() == reflect.Array && target.Type().Elem().Kind() == reflect.Uint8:
+		if len(s) != target.Len() {
+			return decoder.syntaxError(start, "string of length %d doesn't fit %v", len(s), target.Type())
+		}
+		reflect.Copy(target, reflect.ValueOf(s))
+		return nil
+	}
+	return &UnmarshalTypeError{Offset: start, Kind: KindString, Type: target.Type()}
+}
+
+func (decoder *Decoder) decodeList(target reflect.Value, start int64) error {
+	// Byte slices and arrays hold strings
+	kind := target.Kind()
+	if (kind != reflect.Slice && kind != reflect.Array) || target.Type().Elem().Kind() == reflect.Uint8 {
+		return &UnmarshalTypeError{Offset: start, Kind: KindList, Type: target.Type()}
+	}
+
+	err := decoder.enter()
+	if err != nil {
+		return err
+	}
+	if target.Kind() == reflect.Slice {
+		target.Set(reflect.MakeSlice(target.Type(), 0, 0))
+	}
+	for i := 0; ; i++ {
+		more, err := decoder.next()
+		if err != nil {
+			return err
+		}
+		if !more {
+			if target.Kind() == reflect.Array && i != target.Len() {
+				return decoder.syntaxError(start, "list of length %d doesn't fit %v", i, target.Type())
+			}
+			return nil
+		}
+		if target.Kind() == reflect.Array {
+			if i >= target.Len() {
+				return decoder.syntaxError(start, "list is longer than %v", target.Type())
+			}
+			err = decoder.decode(target.Index(i))
+		} else {
+			item := reflect.New(target.Type().Elem()).Elem()
+			err = decoder.decode(item)
+			target.Set(reflect.Append(target, item))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (decoder *Decoder) decodeDict(target reflect.Value, start int64) error {
+	var fields map[string]field
+	switch {
+	case target.Kind() == reflect.Struct:
+		fields = fieldsByKey(target.Type())
+	case target.Kind() == reflect.Map && target.Type().Key().Kind() == reflect.String:
+		if target.IsNil() {
+			target.Set(reflect.MakeMap(target.Type()))
+		}
+	default:
+		return &UnmarshalTypeError{Offset: start, Kind: KindDict, Type: target.Type()}
+	}
+
+	err := decoder.enter()
+	if err != nil {
+		return err
+	}
+	var key []byte
+	for first := true; ; first = false {
+		more, err := decoder.next()
+		if err != nil || !more {
+			return err
+		}
+		key, err = decoder.readKey(key, first)
+		if err != nil {
+			return err
+		}
+
+		if target.Kind() == reflect.Map {
+			item := reflect.New(target.Type().Elem()).Elem()
+			err = decoder.decode(item)
+			if err != nil {
+				return err
+			}
+			target.SetMapIndex(reflect.ValueOf(string(key)).Convert(target.Type().Key()), item)
+			continue
+		}
+		field, ok := fields[string(key)]
+		if !ok {
+			_, err = decoder.readValue(false)
+		} else {
+			err = decoder.decode(target.Field(field.index))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
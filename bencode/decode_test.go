@@ -0,0 +1,149 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"testing/iotest"
+)
+
+func TestSyntaxErrors(t *testing.T) {
+	tests := []struct {
+		input  string
+		offset int64
+	}{
+		{"", 0},                       // empty input
+		{"x", 0},                      // invalid character
+		{"i1ei2e", 3},                 // trailing data
+		{"d1:bi1e1:ai2ee", 7},         // unsorted keys
+		{"d1:ai1e1:ai2ee", 7},         // duplicate key
+		{"d1:ad1:bi1e1:ai2eee", 11},   // unsorted keys in a nested dictionary
+		{"di1ei2ee", 1},               // key that isn't a string
+		{"i03e", 1},                   // leading zero
+		{"i-03e", 1},                  // leading zero after the sign
+		{"i-0e", 1},                   // negative zero
+		{"i00e", 1},                   // leading zero of zero
+		{"02:ab", 0},                  // leading zero in a length
+		{"-1:a", 0},                   // negative length
+		{"ie", 1},                     // missing digits
+		{"i-e", 1},                    // missing digits after the sign
+		{"i1.5e", 1},                  // not an integer
+		{"i99999999999999999999e", 1}, // out of range for int64
+		{"i1", 2},                     // unterminated integer
+		{"4:ab", 4},                   // string cut short
+		{"l", 1},                      // unterminated list
+		{"d1:a", 4},                   // key without a value
+	}
+	for _, test := range tests {
+		var value Value
+		err := Unmarshal([]byte(test.input), &value)
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("Unmarshal(%q) = %v, want a SyntaxError", test.input, err)
+			continue
+		}
+		if syntaxErr.Offset != test.offset {
+			t.Errorf("Unmarshal(%q) = %v, want offset %d", test.input, err, test.offset)
+		}
+	}
+}
+
+func TestUnmarshalTypeErrors(t *testing.T) {
+	type small struct {
+		A int8   `bencode:"a"`
+		B uint16 `bencode:"b"`
+		C string `bencode:"c"`
+		D []int  `bencode:"d"`
+	}
+	tests := []struct {
+		input  string
+		offset int64
+		kind   Kind
+		typ    reflect.Type
+	}{
+		{"d1:ai128ee", 4, KindInt, reflect.TypeOf(int8(0))},
+		{"d1:ai-129ee", 4, KindInt, reflect.TypeOf(int8(0))},
+		{"d1:bi-1ee", 4, KindInt, reflect.TypeOf(uint16(0))},
+		{"d1:bi65536ee", 4, KindInt, reflect.TypeOf(uint16(0))},
+		{"d1:ai1e1:b2:xxe", 10, KindString, reflect.TypeOf(uint16(0))},
+		{"d1:ci1ee", 4, KindInt, reflect.TypeOf("")},
+		{"d1:dl1:xee", 5, KindString, reflect.TypeOf(0)},
+		{"d1:dd1:ai1eee", 4, KindDict, reflect.TypeOf([]int(nil))},
+		{"le", 0, KindList, reflect.TypeOf(small{})},
+	}
+	for _, test := range tests {
+		var decoded small
+		err := Unmarshal([]byte(test.input), &decoded)
+		var typeErr *UnmarshalTypeError
+		if !errors.As(err, &typeErr) {
+			t.Errorf("Unmarshal(%q) = %v, want an UnmarshalTypeError", test.input, err)
+			continue
+		}
+		if typeErr.Offset != test.offset || typeErr.Kind != test.kind || typeErr.Type != test.typ {
+			t.Errorf("Unmarshal(%q) = %v, want %v into %v at offset %d", test.input, err, test.kind, test.typ, test.offset)
+		}
+	}
+}
+
+func TestRawMessageSpan(t *testing.T) {
+	type metainfo struct {
+		Announce string     `bencode:"announce"`
+		Info     RawMessage `bencode:"info"`
+		Comment  string     `bencode:"comment,omitempty"`
+		Nodes    []string   `bencode:"nodes"`
+	}
+	info := "d5:filesld6:lengthi3e4:pathl1:aeee4:name3:dir12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaae"
+	input := "d8:announce3:url7:comment2:hi4:info" + info + "5:nodesl1:xee"
+
+	readers := map[string]func() io.Reader{
+		"byte scanner": func() io.Reader { return bytes.NewReader([]byte(input)) },
+		"buffered":     func() io.Reader { return iotest.OneByteReader(bytes.NewReader([]byte(input))) },
+	}
+	for name, reader := range readers {
+		var decoded metainfo
+		decoder := NewDecoder(reader())
+		err := decoder.Decode(&decoded)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if string(decoded.Info) != info {
+			t.Errorf("%s: info is %q, want %q", name, decoded.Info, info)
+		}
+		if decoded.Announce != "url" || decoded.Comment != "hi" || !reflect.DeepEqual(decoded.Nodes, []string{"x"}) {
+			t.Errorf("%s: the keys around info decoded to %+v", name, decoded)
+		}
+		if decoder.InputOffset() != int64(len(input)) {
+			t.Errorf("%s: input offset is %d, want %d", name, decoder.InputOffset(), len(input))
+		}
+	}
+
+	// An info dictionary that isn't canonical fails instead of being captured
+	var decoded metainfo
+	err := Unmarshal([]byte("d4:infod1:bi1e1:ai1eee"), &decoded)
+	var syntaxErr *SyntaxError
+	if !errors.As(err, &syntaxErr) || syntaxErr.Offset != 14 {
+		t.Errorf("Unmarshal of an unsorted info dictionary = %v, want a SyntaxError at offset 14", err)
+	}
+}
+
+func TestDecoderStream(t *testing.T) {
+	decoder := NewDecoder(bytes.NewReader([]byte("i1e3:abcle")))
+	var values []Value
+	for {
+		var value Value
+		err := decoder.Decode(&value)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, value)
+	}
+	want := []Value{NewInt(1), NewString("abc"), NewList()}
+	if !reflect.DeepEqual(values, want) {
+		t.Fatalf("decoded %v, want %v", values, want)
+	}
+}
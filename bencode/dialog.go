@@ -0,0 +1,38 @@
+//go:build (cgo || windows) && !nogui
+
+package bencode
+
+import (
+	"os"
+	"runtime"
+
+	"github.com/sqweek/dialog"
+)
+
+// HasDisplay reports whether the native file pickers can be shown.
+func HasDisplay() bool {
+	switch runtime.GOOS {
+	case "windows", "darwin":
+		return true
+	}
+	return os.Getenv("DISPLAY") != "" || os.Getenv("WAYLAND_DISPLAY") != ""
+}
+
+func PickTorrent() (string, error) {
+	path, err := dialog.File().
+		Filter("Torrent File", "torrent").
+		Title("Select a .torrent file").
+		Load()
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func PickDownloadPath() (string, error) {
+	path, err := dialog.Directory().Title("Select download location").Browse()
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
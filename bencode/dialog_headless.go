@@ -0,0 +1,20 @@
+//go:build (!cgo && !windows) || nogui
+
+package bencode
+
+import "errors"
+
+// ErrNoDialog is returned by the pickers in builds without GUI support.
+var ErrNoDialog = errors.New("file dialogs are not available in this build")
+
+func HasDisplay() bool {
+	return false
+}
+
+func PickTorrent() (string, error) {
+	return "", ErrNoDialog
+}
+
+func PickDownloadPath() (string, error) {
+	return "", ErrNoDialog
+}
@@ -0,0 +1,259 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// UnsupportedTypeError is a Go value bencoding has no representation for
+type UnsupportedTypeError struct {
+	Type reflect.Type
+}
+
+func (err *UnsupportedTypeError) Error() string {
+	return fmt.Sprintf("bencode: can't marshal %v", err.Type)
+}
+
+type field struct {
+	index     int
+	key       string
+	omitEmpty bool
+}
+
+var fieldCache sync.Map // reflect.Type to []field, sorted by key
+
+// structFields lists the fields of a struct type that are encoded, in the
+// order their keys are written
+func structFields(structType reflect.Type) []field {
+	cached, ok := fieldCache.Load(structType)
+	if ok {
+		return cached.([]field)
+	}
+
+	var fields []field
+	for i := 0; i < structType.NumField(); i++ {
+		structField := structType.Field(i)
+		if !structField.IsExported() {
+			continue
+		}
+		tag := structField.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+		key, options, _ := strings.Cut(tag, ",")
+		if key == "" {
+			key = structField.Name
+		}
+		fields = append(fields, field{index: i, key: key, omitEmpty: options == "omitempty"})
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].key < fields[j].key
+	})
+	fieldCache.Store(structType, fields)
+	return fields
+}
+
+func fieldsByKey(structType reflect.Type) map[string]field {
+	fields := make(map[string]field)
+	for _, field := range structFields(structType) {
+		fields[field.key] = field
+	}
+	return fields
+}
+
+// Encoder writes bencoded values to a stream
+type Encoder struct {
+	writer io.Writer
+}
+
+func NewEncoder(writer io.Writer) *Encoder {
+	return &Encoder{writer: writer}
+}
+
+// Encode writes v, nothing is written if it can't be encoded
+func (encoder *Encoder) Encode(v any) error {
+	data, err := Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = encoder.writer.Write(data)
+	return err
+}
+
+// Marshal returns the canonical encoding of v. Integers, strings, byte slices
+// and arrays, slices, arrays, maps with string keys, structs, Value and
+// RawMessage are supported, the same way Decode reads them. Struct fields
+// tagged omitempty are left out when they are zero or empty, and nil
+// pointers and interfaces always are.
+func Marshal(v any) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := encode(buf, reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	buf.WriteString(strconv.Itoa(len(s)))
+	buf.WriteByte(':')
+	buf.WriteString(s)
+}
+
+func writeInt(buf *bytes.Buffer, i int64) {
+	buf.WriteByte('i')
+	buf.WriteString(strconv.FormatInt(i, 10))
+	buf.WriteByte('e')
+}
+
+func encodeValue(buf *bytes.Buffer, value Value) error {
+	switch value.Kind {
+	case KindInt:
+		writeInt(buf, value.Int)
+	case KindString:
+		writeString(buf, value.Str)
+	case KindList:
+		buf.WriteByte('l')
+		for _, item := range value.List {
+			err := encodeValue(buf, item)
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case KindDict:
+		buf.WriteByte('d')
+		for _, key := range sortedKeys(value.Dict) {
+			writeString(buf, key)
+			err := encodeValue(buf, value.Dict[key])
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return errors.New("bencode: can't marshal an invalid Value")
+	}
+	return nil
+}
+
+func encode(buf *bytes.Buffer, v reflect.Value) error {
+	if !v.IsValid() {
+		return errors.New("bencode: can't marshal nil")
+	}
+	switch v.Type() {
+	case valueType:
+		return encodeValue(buf, v.Interface().(Value))
+	case rawMessageType:
+		if v.Len() == 0 {
+			return errors.New("bencode: can't marshal an empty RawMessage")
+		}
+		buf.Write(v.Bytes())
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return errors.New("bencode: can't marshal nil")
+		}
+		return encode(buf, v.Elem())
+	case reflect.String:
+		writeString(buf, v.String())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		writeInt(buf, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if v.Uint() > 1<<63-1 {
+			return fmt.Errorf("bencode: integer %d out of range", v.Uint())
+		}
+		writeInt(buf, int64(v.Uint()))
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			writeString(buf, string(bytesOf(v)))
+			return nil
+		}
+		buf.WriteByte('l')
+		for i := 0; i < v.Len(); i++ {
+			err := encode(buf, v.Index(i))
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return &UnsupportedTypeError{Type: v.Type()}
+		}
+		keys := make([]string, 0, v.Len())
+		for _, key := range v.MapKeys() {
+			keys = append(keys, key.String())
+		}
+		sort.Strings(keys)
+		buf.WriteByte('d')
+		for _, key := range keys {
+			writeString(buf, key)
+			err := encode(buf, v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key())))
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case reflect.Struct:
+		buf.WriteByte('d')
+		for _, field := range structFields(v.Type()) {
+			fieldValue := v.Field(field.index)
+			if skipField(fieldValue, field.omitEmpty) {
+				continue
+			}
+			writeString(buf, field.key)
+			err := encode(buf, fieldValue)
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return &UnsupportedTypeError{Type: v.Type()}
+	}
+	return nil
+}
+
+// bytesOf returns the contents of a byte slice or array
+func bytesOf(v reflect.Value) []byte {
+	if v.Kind() == reflect.Slice {
+		return v.Bytes()
+	}
+	b := make([]byte, v.Len())
+	reflect.Copy(reflect.ValueOf(b), v)
+	return b
+}
+
+func skipField(v reflect.Value, omitEmpty bool) bool {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	}
+	if !omitEmpty {
+		return false
+	}
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Struct:
+		if v.Type() == valueType {
+			return v.Interface().(Value).Kind == KindInvalid
+		}
+	}
+	return false
+}
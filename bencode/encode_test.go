@@ -0,0 +1,164 @@
+package bencode
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type testFileEntry struct {
+	Length int64    `bencode:"length"`
+	Path   []string `bencode:"path"`
+	MD5    string   `bencode:"md5sum,omitempty"`
+}
+
+type testMessage struct {
+	Name     string          `bencode:"name"`
+	Size     uint32          `bencode:"size"`
+	Offset   int64           `bencode:"offset,omitempty"`
+	Hash     [4]byte         `bencode:"hash"`
+	Data     []byte          `bencode:"data"`
+	Files    []testFileEntry `bencode:"files,omitempty"`
+	Extra    map[string]int  `bencode:"extra,omitempty"`
+	Parent   *testFileEntry  `bencode:"parent"`
+	Any      Value           `bencode:"any,omitempty"`
+	Raw      RawMessage      `bencode:"raw,omitempty"`
+	Skipped  string          `bencode:"-"`
+	Untagged int
+	private  int
+}
+
+func TestMarshal(t *testing.T) {
+	tests := []struct {
+		value any
+		want  string
+	}{
+		{42, "i42e"},
+		{-7, "i-7e"},
+		{uint8(0), "i0e"},
+		{"spam", "4:spam"},
+		{"", "0:"},
+		{[]byte{0, 0xff}, "2:\x00\xff"},
+		{[]string{"a", "bc"}, "l1:a2:bce"},
+		{[]int{}, "le"},
+		{map[string]int{"b": 2, "a": 1, "": 0}, "d0:i0e1:ai1e1:bi2ee"},
+		{NewDict(map[string]Value{"z": NewList(NewInt(1)), "a": NewString("x")}), "d1:a1:x1:zli1eee"},
+		{RawMessage("d1:ai1ee"), "d1:ai1ee"},
+		// Keys are sorted by tag, not by field order, and empty optional fields,
+		// nil pointers, "-" and unexported fields are left out
+		{testMessage{Name: "n", Size: 3, Hash: [4]byte{'a', 'b', 'c', 'd'}, Skipped: "x", private: 1}, "d8:Untaggedi0e4:data0:4:hash4:abcd4:name1:n4:sizei3ee"},
+	}
+	for _, test := range tests {
+		got, err := Marshal(test.value)
+		if err != nil {
+			t.Errorf("Marshal(%#v): %v", test.value, err)
+			continue
+		}
+		if string(got) != test.want {
+			t.Errorf("Marshal(%#v) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestMarshalErrors(t *testing.T) {
+	var unsupported *UnsupportedTypeError
+	tests := []struct {
+		value       any
+		unsupported bool
+	}{
+		{nil, false},
+		{(*int)(nil), false},
+		{Value{}, false},
+		{RawMessage{}, false},
+		{uint64(1 << 63), false},
+		{1.5, true},
+		{map[int]string{1: "a"}, true},
+		{[]any{make(chan int)}, true},
+	}
+	for _, test := range tests {
+		_, err := Marshal(test.value)
+		if err == nil {
+			t.Errorf("Marshal(%#v) succeeded, want an error", test.value)
+			continue
+		}
+		if errors.As(err, &unsupported) != test.unsupported {
+			t.Errorf("Marshal(%#v) = %v, UnsupportedTypeError %v", test.value, err, test.unsupported)
+		}
+	}
+}
+
+func TestValueRoundTrip(t *testing.T) {
+	values := []Value{
+		NewInt(0),
+		NewInt(-1 << 63),
+		NewInt(1<<63 - 1),
+		NewString(""),
+		NewString("\x00binary\xff"),
+		NewList(),
+		NewList(NewInt(1), NewList(NewString("nested")), NewDict(map[string]Value{})),
+		NewDict(map[string]Value{
+			"announce": NewString("udp://tracker:80"),
+			"info": NewDict(map[string]Value{
+				"files":  NewList(NewDict(map[string]Value{"length": NewInt(3), "path": NewList(NewString("a"))})),
+				"pieces": NewString("\x01\x02\x03"),
+			}),
+			"\xffkey": NewInt(5),
+		}),
+	}
+	for _, value := range values {
+		data, err := Marshal(value)
+		if err != nil {
+			t.Errorf("Marshal(%v): %v", value, err)
+			continue
+		}
+		var decoded Value
+		err = Unmarshal(data, &decoded)
+		if err != nil {
+			t.Errorf("Unmarshal(%q): %v", data, err)
+			continue
+		}
+		if !reflect.DeepEqual(decoded, value) {
+			t.Errorf("%q decoded to %v, want %v", data, decoded, value)
+		}
+		// Re-encoding the decoded value gives the same bytes
+		again, err := Marshal(decoded)
+		if err != nil || string(again) != string(data) {
+			t.Errorf("%v re-encoded to %q, %v, want %q", decoded, again, err, data)
+		}
+	}
+}
+
+func TestStructRoundTrip(t *testing.T) {
+	messages := []testMessage{
+		{Name: "n", Hash: [4]byte{1, 2, 3, 4}, Data: []byte{}},
+		{
+			Name:     "full",
+			Size:     1<<32 - 1,
+			Offset:   -5,
+			Hash:     [4]byte{0xff, 0, 0xff, 0},
+			Data:     []byte("data"),
+			Files:    []testFileEntry{{Length: 1, Path: []string{"dir", "a"}}, {Length: 2, Path: []string{"b"}, MD5: "sum"}},
+			Extra:    map[string]int{"x": 1, "y": -2},
+			Parent:   &testFileEntry{Length: 7, Path: []string{}},
+			Any:      NewList(NewString("v"), NewInt(2)),
+			Raw:      RawMessage("d1:ai1ee"),
+			Untagged: 9,
+		},
+	}
+	for _, message := range messages {
+		data, err := Marshal(message)
+		if err != nil {
+			t.Errorf("Marshal(%+v): %v", message, err)
+			continue
+		}
+		var decoded testMessage
+		err = Unmarshal(data, &decoded)
+		if err != nil {
+			t.Errorf("Unmarshal(%q): %v", data, err)
+			continue
+		}
+		if !reflect.DeepEqual(decoded, message) {
+			t.Errorf("%q decoded to %+v, want %+v", data, decoded, message)
+		}
+	}
+}
@@ -1,14 +1,13 @@
 package bencode
 
 import (
-	"bytes"
 	"crypto/sha1"
 	"fmt"
 	"io"
 	"log"
 	"path/filepath"
-
-	"github.com/jackpal/bencode-go"
+	"strings"
+	"time"
 )
 
 type bencodeFile struct {
@@ -21,54 +20,178 @@ type bencodeInfo struct {
 	Length      int64         `bencode:"length,omitempty"`
 	Name        string        `bencode:"name"`
 	Files       []bencodeFile `bencode:"files,omitempty"`
+	Private     int64         `bencode:"private,omitempty"`
+	Source      string        `bencode:"source,omitempty"`
 }
 
+// BencodeType is a torrent file. The info dictionary is kept as it was
+// encoded, since the infohash is calculated over those exact bytes.
 type BencodeType struct {
-	Announce string      `bencode:"announce"`
-	Info     bencodeInfo `bencode:"info"`
+	Announce     string     `bencode:"announce,omitempty"`
+	AnnounceList [][]string `bencode:"announce-list,omitempty"`
+	Comment      string     `bencode:"comment,omitempty"`
+	CreatedBy    string     `bencode:"created by,omitempty"`
+	CreationDate int64      `bencode:"creation date,omitempty"` // unix time
+	URLList      Value      `bencode:"url-list,omitempty"`
+	Info         RawMessage `bencode:"info"`
 }
 
-func Bytes(b BencodeType) ([]byte, error) {
-	buf := new(bytes.Buffer)
-	err := bencode.Marshal(buf, b.Info)
+func ParseTorrent(reader io.Reader, path string) (TorrentType, error) {
+	data, err := io.ReadAll(reader)
 	if err != nil {
-		return nil, err
+		return TorrentType{}, err
 	}
-	return buf.Bytes(), nil
-}
-
-func ParseTorrent(reader io.Reader, path string) (TorrentType, error) {
 	bencodeObject := BencodeType{}
-	err := bencode.Unmarshal(reader, &bencodeObject)
+	err = Unmarshal(data, &bencodeObject)
 	if err != nil {
 		log.Printf("Error parsing torrent file: %v\n", err)
 		return TorrentType{}, err
 	}
+	if len(bencodeObject.Info) == 0 {
+		return TorrentType{}, fmt.Errorf("torrent has no info dictionary")
+	}
+
+	torrent, err := convertToTorrent(bencodeObject, path)
+	if err != nil {
+		return torrent, err
+	}
+	torrent.WebSeeds = parseURLList(bencodeObject.URLList)
+	return torrent, nil
+}
 
-	return convertToTorrent(bencodeObject, path)
+/*
+See: https://www.bittorrent.org/beps/bep_0019.html
+url-list is either a single URL or a list of them.
+*/
+func parseURLList(urlList Value) []string {
+	var webSeeds []string
+	switch urlList.Kind {
+	case KindString:
+		if urlList.Str != "" {
+			webSeeds = append(webSeeds, urlList.Str)
+		}
+	case KindList:
+		for _, url := range urlList.List {
+			if url.Kind == KindString && url.Str != "" {
+				webSeeds = append(webSeeds, url.Str)
+			}
+		}
+	}
+	return webSeeds
+}
+
+// ParseInfo builds a torrent from a raw info dictionary, such as one fetched
+// from peers for a magnet link.
+func ParseInfo(infoBytes []byte, announce string) (TorrentType, error) {
+	return convertToTorrent(BencodeType{Announce: announce, Info: infoBytes}, "")
+}
+
+// knownInfoKeys are the info dictionary keys bencodeInfo has fields for
+var knownInfoKeys = []string{"pieces", "piece length", "length", "name", "files", "private", "source"}
+
+// extraInfo decodes the keys of the info dictionary that bencodeInfo doesn't have
+func extraInfo(infoBytes []byte) (map[string]Value, error) {
+	extra := make(map[string]Value)
+	err := Unmarshal(infoBytes, &extra)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range knownInfoKeys {
+		delete(extra, key)
+	}
+	return extra, nil
+}
+
+/*
+See: https://www.bittorrent.org/beps/bep_0012.html
+When announce-list is present it replaces announce. Either way the trackers end
+up as tiers, a torrent with only announce has a single tier with one tracker.
+*/
+func announceTiers(announce string, announceList [][]string) [][]string {
+	var tiers [][]string
+	for _, tier := range announceList {
+		var trackers []string
+		for _, tracker := range tier {
+			if tracker != "" {
+				trackers = append(trackers, tracker)
+			}
+		}
+		if len(trackers) > 0 {
+			tiers = append(tiers, trackers)
+		}
+	}
+	if len(tiers) == 0 && announce != "" {
+		tiers = [][]string{{announce}}
+	}
+	return tiers
+}
+
+/*
+Names from the torrent are joined onto the output directory, so an empty name,
+"." or "..", or one with a separator in it could write outside of it.
+*/
+func safePathComponent(name string) bool {
+	if name == "" || name == "." || name == ".." {
+		return false
+	}
+	return !strings.ContainsAny(name, `/\`+"\x00")
 }
 
 func convertToTorrent(bencode BencodeType, path string) (TorrentType, error) {
+	info := bencodeInfo{}
+	err := Unmarshal(bencode.Info, &info)
+	if err != nil {
+		return TorrentType{}, err
+	}
 
 	torrent := TorrentType{}
 	torrent.Path = path
 	torrent.Announce = bencode.Announce
-	torrent.Name = bencode.Info.Name
-	torrent.PieceLength = bencode.Info.PieceLength
+	torrent.AnnounceList = announceTiers(bencode.Announce, bencode.AnnounceList)
+	torrent.Comment = bencode.Comment
+	torrent.CreatedBy = bencode.CreatedBy
+	if bencode.CreationDate != 0 {
+		torrent.CreationDate = time.Unix(bencode.CreationDate, 0)
+	}
+	if info.PieceLength <= 0 {
+		return TorrentType{}, fmt.Errorf("invalid piece length %d", info.PieceLength)
+	}
+	if !safePathComponent(info.Name) {
+		return TorrentType{}, fmt.Errorf("unsafe torrent name %q", info.Name)
+	}
+	torrent.Name = info.Name
+	torrent.PieceLength = info.PieceLength
+	torrent.Private = info.Private == 1
+	torrent.Source = info.Source
 
 	// Single-file torrent
-	if len(bencode.Info.Files) == 0 {
+	if len(info.Files) == 0 {
+		if info.Length < 0 {
+			return TorrentType{}, fmt.Errorf("invalid file length %d", info.Length)
+		}
 		torrent.Files = []TorrentFile{
 			{
-				Path:   bencode.Info.Name,   // file name
-				Length: bencode.Info.Length, // file length
+				Path:   info.Name,   // file name
+				Length: info.Length, // file length
 				Offset: 0,
 			},
 		}
-		torrent.Length = bencode.Info.Length
+		torrent.Length = info.Length
 	} else {
+		torrent.MultiFile = true
 		var offset int64
-		for _, file := range bencode.Info.Files {
+		for _, file := range info.Files {
+			if file.Length < 0 || offset+file.Length < offset {
+				return TorrentType{}, fmt.Errorf("invalid file length %d", file.Length)
+			}
+			if len(file.Path) == 0 {
+				return TorrentType{}, fmt.Errorf("file with an empty path")
+			}
+			for _, component := range file.Path {
+				if !safePathComponent(component) {
+					return TorrentType{}, fmt.Errorf("unsafe file path %q", strings.Join(file.Path, "/"))
+				}
+			}
 			fp := filepath.Join(file.Path...)
 			torrent.Files = append(torrent.Files, TorrentFile{
 				Path:   fp,
@@ -80,20 +203,29 @@ func convertToTorrent(bencode BencodeType, path string) (TorrentType, error) {
 		torrent.Length = offset
 	}
 
-	if len(bencode.Info.Pieces)%bytesPerChunk != 0 {
+	if len(info.Pieces)%bytesPerChunk != 0 {
 		return torrent, fmt.Errorf("invalid pieces length")
 	}
-	pieceCount := len(bencode.Info.Pieces) / bytesPerChunk
+	pieceCount := len(info.Pieces) / bytesPerChunk
+	expected := torrent.Length / torrent.PieceLength
+	if torrent.Length%torrent.PieceLength != 0 {
+		expected++
+	}
+	if int64(pieceCount) != expected {
+		return torrent, fmt.Errorf("torrent has %d pieces, its length needs %d", pieceCount, expected)
+	}
 	torrent.PieceHashes = make([][bytesPerChunk]byte, pieceCount)
 	for i := 0; i < pieceCount; i++ {
-		copy(torrent.PieceHashes[i][:], bencode.Info.Pieces[i*bytesPerChunk:(i+1)*bytesPerChunk])
+		copy(torrent.PieceHashes[i][:], info.Pieces[i*bytesPerChunk:(i+1)*bytesPerChunk])
 	}
 
-	infoBytes, err := Bytes(bencode)
+	extra, err := extraInfo(bencode.Info)
 	if err != nil {
-		return torrent, nil
+		return torrent, err
 	}
-	torrent.InfoHash = sha1.Sum(infoBytes)
+	torrent.InfoBytes = bencode.Info
+	torrent.InfoExtra = extra
+	torrent.InfoHash = sha1.Sum(bencode.Info)
 	torrent.NumPieces = pieceCount
 
 	return torrent, nil
@@ -2,12 +2,10 @@ package bencode
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
-
-	"github.com/sqweek/dialog"
+	"time"
 )
 
 const bytesPerChunk = 20
@@ -18,15 +16,27 @@ type TorrentFile struct {
 	Offset int64
 }
 type TorrentType struct {
-	Path        string
-	Announce    string
-	Name        string
-	Length      int64
-	PieceLength int64
-	InfoHash    [bytesPerChunk]byte
-	PieceHashes [][bytesPerChunk]byte
-	PeerID      [20]byte
-	NumPieces   int
+	Path         string
+	Announce     string
+	AnnounceList [][]string // tiers of trackers, tried in order
+	WebSeeds     []string   // HTTP servers with the torrent's files, from url-list
+	Comment      string
+	CreatedBy    string
+	CreationDate time.Time // zero if the torrent doesn't say
+	Name         string
+	Length       int64
+	PieceLength  int64
+	InfoHash     [bytesPerChunk]byte
+	InfoBytes    []byte           // the info dictionary as encoded in the torrent, which InfoHash is the hash of
+	InfoExtra    map[string]Value // info keys without a field here, e.g. md5sum or name.utf-8
+	PieceHashes  [][bytesPerChunk]byte
+	PeerID       [20]byte
+	Port         uint16
+	DHTPort      uint16 // UDP port of our DHT node, 0 if it isn't running or the torrent is private
+	NumPieces    int
+	MultiFile    bool // the files are in a directory called Name
+	Private      bool // peers may only come from the trackers, see BEP 27
+	Source       string
 
 	Files []TorrentFile
 }
@@ -59,46 +69,42 @@ func (t TorrentType) String() string {
 	return outputString.String()
 }
 
-func PickTorrent() (string, error) {
-	path, err := dialog.File().
-		Filter("Torrent File", "torrent").
-		Title("Select a .torrent file").
-		Load()
-	if err != nil {
-		return "", err
+// HasExistingData reports whether any file of the torrent is already on disk
+// with data in it, meaning pieces may need to be verified before downloading.
+func HasExistingData(t *TorrentType, savePath string) bool {
+	for _, f := range t.Files {
+		info, err := os.Stat(filepath.Join(savePath, f.Path))
+		if err == nil && info.Size() > 0 {
+			return true
+		}
 	}
-	return path, nil
+	return false
 }
 
-func PickDownloadPath() (string, error) {
-	path, err := dialog.Directory().Title("Select download location").Browse()
+// OpenFile opens the file at index of the torrent under savePath, creating it
+// and its directories if needed and sizing it to its length
+func OpenFile(t *TorrentType, savePath string, index int) (*os.File, error) {
+	f := t.Files[index]
+	fullPath := filepath.Join(savePath, f.Path)
+	err := os.MkdirAll(filepath.Dir(fullPath), 0755) // perm 0755: allow dir creation, 0644: file, 0777: all
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return path, nil
-}
 
-func OpenFiles(t *TorrentType, savePath string) ([]*os.File, error) {
-	openFiles := make([]*os.File, len(t.Files))
-	for i, f := range t.Files {
-		fullPath := filepath.Join(savePath, f.Path)
-		err := os.MkdirAll(filepath.Dir(fullPath), 0755) // perm 0755: allow dir creation, 0644: file, 0777: all
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		file, err := os.OpenFile(fullPath, os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			log.Fatal(err)
-		}
+	file, err := os.OpenFile(fullPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
 
+	// Only resize when needed, truncating updates the modification time
+	// that resume files are checked against
+	info, err := file.Stat()
+	if err == nil && info.Size() != f.Length {
 		err = file.Truncate(f.Length)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		openFiles[i] = file
 	}
-
-	return openFiles, nil
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
 }
@@ -0,0 +1,137 @@
+package bencode
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/*
+See: https://www.bittorrent.org/beps/bep_0003.html#bencoding
+Bencoding has four kinds of values:
+
+	integers     i<decimal>e     i42e, i-3e
+	strings      <length>:<data> 4:spam
+	lists        l<values>e      l4:spami42ee
+	dictionaries d<pairs>e       d3:cow3:moo4:spam4:eggse
+
+Strings are byte strings. Dictionary keys are strings, sorted as raw bytes.
+Every value has exactly one encoding: integers and lengths have no leading
+zeros and there is no -0, which is what makes hashing the encoding of the info
+dictionary meaningful.
+*/
+
+type Kind int
+
+const (
+	KindInvalid Kind = iota // the zero Value, never decoded
+	KindInt
+	KindString
+	KindList
+	KindDict
+)
+
+func (kind Kind) String() string {
+	switch kind {
+	case KindInt:
+		return "integer"
+	case KindString:
+		return "string"
+	case KindList:
+		return "list"
+	case KindDict:
+		return "dictionary"
+	}
+	return "invalid"
+}
+
+// Value is any bencoded value, for data whose shape isn't known up front.
+// Only the field for its Kind is set.
+type Value struct {
+	Kind Kind
+	Int  int64
+	Str  string
+	List []Value
+	Dict map[string]Value
+}
+
+func NewInt(i int64) Value {
+	return Value{Kind: KindInt, Int: i}
+}
+
+func NewString(s string) Value {
+	return Value{Kind: KindString, Str: s}
+}
+
+func NewList(values ...Value) Value {
+	return Value{Kind: KindList, List: values}
+}
+
+func NewDict(dict map[string]Value) Value {
+	return Value{Kind: KindDict, Dict: dict}
+}
+
+// Get returns the value of key if value is a dictionary that has it
+func (value Value) Get(key string) (Value, bool) {
+	if value.Kind != KindDict {
+		return Value{}, false
+	}
+	item, ok := value.Dict[key]
+	return item, ok
+}
+
+// GetString returns the value of key if it is a string
+func (value Value) GetString(key string) (string, bool) {
+	item, ok := value.Get(key)
+	if !ok || item.Kind != KindString {
+		return "", false
+	}
+	return item.Str, true
+}
+
+// GetInt returns the value of key if it is an integer
+func (value Value) GetInt(key string) (int64, bool) {
+	item, ok := value.Get(key)
+	if !ok || item.Kind != KindInt {
+		return 0, false
+	}
+	return item.Int, true
+}
+
+// String formats the value for logs, strings are quoted
+func (value Value) String() string {
+	switch value.Kind {
+	case KindInt:
+		return fmt.Sprint(value.Int)
+	case KindString:
+		return fmt.Sprintf("%q", value.Str)
+	case KindList:
+		items := make([]string, len(value.List))
+		for i, item := range value.List {
+			items[i] = item.String()
+		}
+		return "[" + strings.Join(items, " ") + "]"
+	case KindDict:
+		keys := sortedKeys(value.Dict)
+		items := make([]string, len(keys))
+		for i, key := range keys {
+			items[i] = fmt.Sprintf("%q:%v", key, value.Dict[key])
+		}
+		return "{" + strings.Join(items, " ") + "}"
+	}
+	return "<invalid>"
+}
+
+func sortedKeys[T any](dict map[string]T) []string {
+	keys := make([]string, 0, len(dict))
+	for key := range dict {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// RawMessage is a value kept exactly as it was encoded. Unmarshaling into it
+// captures the span of the input, e.g. the info dictionary the infohash is
+// calculated over, and marshaling writes it out unchanged.
+type RawMessage []byte
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"GoTorrent/bencode"
+	"GoTorrent/dht"
+	"GoTorrent/mse"
+	"GoTorrent/networking"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const defaultPortNum int = 7777
+const defaultPeerIDPrefix = "-GT0001-"
+
+const usageText = `Usage:
+  gotorrent download [flags] <file.torrent | magnet-uri>...
+  gotorrent create [flags] <file | directory>
+
+Commands:
+  download    download the contents of torrents
+  create      create a torrent of local files
+
+Run 'gotorrent <command> -h' for the flags of a command.
+`
+
+type downloadOptions struct {
+	TorrentPaths []string
+	OutputDir    string
+	Port         int
+	PeerIDPrefix string
+	MaxPeers     int
+	Transport    networking.Transport
+	Encryption   mse.Policy
+	Seed         bool
+	DHT          bool
+	DHTPort      int
+	DHTBootstrap []string
+	DHTState     string
+	ResumeDir    string
+	Recheck      bool
+	SkipFiles    fileList
+	LowFiles     fileList
+	HighFiles    fileList
+	Sequential   bool
+	HTTPAddress  string
+	Readahead    int64
+	RateLimits   rateLimits
+}
+
+// rateLimits are the -*-limit flags in bytes per second, 0 for unlimited
+type rateLimits struct {
+	Download        int64
+	Upload          int64
+	TorrentDownload int64
+	TorrentUpload   int64
+	PeerDownload    int64
+	PeerUpload      int64
+	ExemptLAN       bool
+}
+
+type createOptions struct {
+	Path        string
+	Output      string
+	PieceLength int64
+	Trackers    trackerTiers
+	Comment     string
+	CreatedBy   string
+	Private     bool
+	WebSeeds    []string
+	Source      string
+}
+
+// trackerTiers collects the -announce flags, each one a tier of comma
+// separated trackers
+type trackerTiers [][]string
+
+func (tiers *trackerTiers) String() string {
+	var flags []string
+	for _, tier := range *tiers {
+		flags = append(flags, strings.Join(tier, ","))
+	}
+	return strings.Join(flags, " ")
+}
+
+func (tiers *trackerTiers) Set(value string) error {
+	tier := splitList(value)
+	if len(tier) == 0 {
+		return errors.New("no trackers given")
+	}
+	*tiers = append(*tiers, tier)
+	return nil
+}
+
+// fileList collects indexes of files in a torrent, given as a comma separated
+// list of indexes and ranges like 0,3-5
+type fileList []int
+
+func (files *fileList) String() string {
+	var items []string
+	for _, index := range *files {
+		items = append(items, strconv.Itoa(index))
+	}
+	return strings.Join(items, ",")
+}
+
+func (files *fileList) Set(value string) error {
+	for _, item := range splitList(value) {
+		first, last, isRange := strings.Cut(item, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil || start < 0 {
+			return fmt.Errorf("invalid file index %q", item)
+		}
+		end := start
+		if isRange {
+			end, err = strconv.Atoi(last)
+			if err != nil || end < start {
+				return fmt.Errorf("invalid file range %q", item)
+			}
+		}
+		for index := start; index <= end; index++ {
+			*files = append(*files, index)
+		}
+	}
+	return nil
+}
+
+// splitList splits a comma separated flag, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// defaultResumeDir keeps resume files in the user's config directory
+func defaultResumeDir() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(configDir, "GoTorrent", "resume")
+}
+
+// defaultDHTState keeps the routing table in the user's config directory
+func defaultDHTState() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(configDir, "GoTorrent", "dht.dat")
+}
+
+func usage(w io.Writer) {
+	fmt.Fprint(w, usageText)
+}
+
+// parseArgs lets flags appear before or after positional arguments, so that
+// "download file.torrent -o dir" and "download -o dir file.torrent" both work.
+func parseArgs(flagSet *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		err := flagSet.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+		args = flagSet.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func parseDownloadArgs(args []string) (downloadOptions, error) {
+	opts := downloadOptions{}
+	flagSet := flag.NewFlagSet("download", flag.ContinueOnError)
+	flagSet.StringVar(&opts.OutputDir, "o", "", "directory to save the download in")
+	flagSet.StringVar(&opts.OutputDir, "output", "", "directory to save the download in")
+	flagSet.IntVar(&opts.Port, "port", defaultPortNum, "port announced to trackers and peers")
+	flagSet.StringVar(&opts.PeerIDPrefix, "peer-id-prefix", defaultPeerIDPrefix, "prefix of the generated peer ID")
+	flagSet.IntVar(&opts.MaxPeers, "max-peers", networking.DefaultMaxConnections, "maximum number of open peer connections, incoming and outgoing")
+	transport := flagSet.String("transport", "utp", "transport tried first when connecting to peers, utp or tcp, the other is the fallback")
+	encryption := flagSet.String("encryption", "prefer", "peer connection encryption, disabled, prefer or require")
+	flagSet.BoolVar(&opts.Seed, "seed", true, "keep uploading to peers after the download completes")
+	flagSet.BoolVar(&opts.DHT, "dht", true, "find peers through the mainline DHT")
+	flagSet.IntVar(&opts.DHTPort, "dht-port", 0, "UDP port of the DHT node, defaults to the listen port")
+	bootstrap := flagSet.String("dht-bootstrap", strings.Join(dht.DefaultBootstrapNodes, ","), "comma separated host:port list of DHT bootstrap nodes")
+	flagSet.StringVar(&opts.DHTState, "dht-state", defaultDHTState(), "file the DHT routing table is saved to, empty to disable")
+	flagSet.StringVar(&opts.ResumeDir, "resume-dir", defaultResumeDir(), "directory resume files are saved to, empty to disable")
+	flagSet.BoolVar(&opts.Recheck, "recheck", false, "hash the data on disk even if a resume file exists")
+	flagSet.Var(&opts.SkipFiles, "skip", "comma separated indexes or ranges like 2-5 of files not to download")
+	flagSet.Var(&opts.LowFiles, "low", "indexes of files to download after the others")
+	flagSet.Var(&opts.HighFiles, "high", "indexes of files to download first")
+	flagSet.BoolVar(&opts.Sequential, "sequential", false, "download pieces in order rather than rarest first, for playing files while they download")
+	flagSet.StringVar(&opts.HTTPAddress, "http", "", "address like 127.0.0.1:8080 to stream the files over HTTP from while they download, empty to disable")
+	flagSet.Int64Var(&opts.Readahead, "readahead", networking.DefaultReadahead, "bytes past the position of a stream that are downloaded first")
+	limits := []struct {
+		rate  *int64
+		name  string
+		usage string
+	}{
+		{&opts.RateLimits.Download, "download-limit", "download rate limit of all peers in KiB/s, 0 for unlimited"},
+		{&opts.RateLimits.Upload, "upload-limit", "upload rate limit of all peers in KiB/s, 0 for unlimited"},
+		{&opts.RateLimits.TorrentDownload, "torrent-download-limit", "download rate limit of the torrent in KiB/s, 0 for unlimited"},
+		{&opts.RateLimits.TorrentUpload, "torrent-upload-limit", "upload rate limit of the torrent in KiB/s, 0 for unlimited"},
+		{&opts.RateLimits.PeerDownload, "peer-download-limit", "download rate limit of each peer and web seed in KiB/s, 0 for unlimited"},
+		{&opts.RateLimits.PeerUpload, "peer-upload-limit", "upload rate limit of each peer in KiB/s, 0 for unlimited"},
+	}
+	for _, limit := range limits {
+		flagSet.Int64Var(limit.rate, limit.name, 0, limit.usage)
+	}
+	flagSet.BoolVar(&opts.RateLimits.ExemptLAN, "exempt-lan", true, "don't rate limit peers on the local network")
+	flagSet.Usage = func() {
+		fmt.Fprintln(flagSet.Output(), "Usage: gotorrent download [flags] <file.torrent | magnet-uri>...")
+		flagSet.PrintDefaults()
+	}
+
+	positional, err := parseArgs(flagSet, args)
+	if err != nil {
+		return opts, err
+	}
+	opts.TorrentPaths = positional
+	if len(positional) > 1 && len(opts.SkipFiles)+len(opts.LowFiles)+len(opts.HighFiles) > 0 {
+		return opts, errors.New("-skip, -low and -high need a single torrent")
+	}
+	if opts.Port <= 0 || opts.Port > 65535 {
+		return opts, fmt.Errorf("invalid port %d", opts.Port)
+	}
+	if len(opts.PeerIDPrefix) > 20 {
+		return opts, fmt.Errorf("peer id prefix is longer than 20 bytes: %q", opts.PeerIDPrefix)
+	}
+	opts.Transport, err = networking.ParseTransport(*transport)
+	if err != nil {
+		return opts, err
+	}
+	opts.Encryption, err = mse.ParsePolicy(*encryption)
+	if err != nil {
+		return opts, err
+	}
+	if opts.DHTPort == 0 {
+		opts.DHTPort = opts.Port
+	}
+	if opts.DHTPort < 0 || opts.DHTPort > 65535 {
+		return opts, fmt.Errorf("invalid DHT port %d", opts.DHTPort)
+	}
+	opts.DHTBootstrap = splitList(*bootstrap)
+	if opts.Readahead < 0 {
+		return opts, fmt.Errorf("invalid readahead %d", opts.Readahead)
+	}
+	for _, limit := range limits {
+		if *limit.rate < 0 {
+			return opts, fmt.Errorf("invalid -%s %d", limit.name, *limit.rate)
+		}
+		*limit.rate *= 1024
+	}
+	return opts, nil
+}
+
+func parseCreateArgs(args []string) (createOptions, error) {
+	opts := createOptions{}
+	flagSet := flag.NewFlagSet("create", flag.ContinueOnError)
+	flagSet.StringVar(&opts.Output, "o", "", "file to write the torrent to, defaults to the name of the path with .torrent added")
+	flagSet.StringVar(&opts.Output, "output", "", "file to write the torrent to, defaults to the name of the path with .torrent added")
+	flagSet.Int64Var(&opts.PieceLength, "piece-length", 0, "piece length in bytes, a power of two of at least 16384, 0 to choose one from the size")
+	flagSet.Var(&opts.Trackers, "announce", "comma separated trackers of one tier, repeat for more tiers")
+	flagSet.StringVar(&opts.Comment, "comment", "", "comment stored in the torrent")
+	flagSet.StringVar(&opts.CreatedBy, "created-by", "GoTorrent", "program stored as the torrent's creator")
+	flagSet.BoolVar(&opts.Private, "private", false, "only find peers through the trackers, see BEP 27")
+	webSeeds := flagSet.String("web-seed", "", "comma separated URLs of HTTP servers with the files")
+	flagSet.StringVar(&opts.Source, "source", "", "source tag, which gives the torrent a different infohash per tracker")
+	flagSet.Usage = func() {
+		fmt.Fprintln(flagSet.Output(), "Usage: gotorrent create [flags] <file | directory>")
+		flagSet.PrintDefaults()
+	}
+
+	positional, err := parseArgs(flagSet, args)
+	if err != nil {
+		return opts, err
+	}
+	if len(positional) != 1 {
+		return opts, fmt.Errorf("expected one file or directory, got %d", len(positional))
+	}
+	opts.Path = positional[0]
+	if opts.Output == "" {
+		opts.Output = filepath.Base(filepath.Clean(opts.Path)) + ".torrent"
+	}
+	opts.WebSeeds = splitList(*webSeeds)
+	return opts, nil
+}
+
+// resolvePaths fills in missing paths with the file pickers when a display is
+// available. Without one the torrent is required and the output defaults to
+// the working directory.
+func (opts *downloadOptions) resolvePaths() error {
+	var err error
+	if len(opts.TorrentPaths) == 0 {
+		if !bencode.HasDisplay() {
+			return errors.New("no torrent given and no display available to pick one")
+		}
+		torrentPath, err := bencode.PickTorrent()
+		if err != nil {
+			return err
+		}
+		opts.TorrentPaths = []string{torrentPath}
+	}
+
+	if opts.OutputDir == "" {
+		if !bencode.HasDisplay() {
+			opts.OutputDir, err = os.Getwd()
+			return err
+		}
+		opts.OutputDir, err = bencode.PickDownloadPath()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
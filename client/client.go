@@ -5,13 +5,21 @@ import (
 	"GoTorrent/handshake"
 	"GoTorrent/message"
 	"GoTorrent/peer_discovery"
+	"bufio"
 	"errors"
+	"math/bits"
 	"net"
+	"os"
+	"strconv"
+	"sync"
 	"time"
 )
 
 const connectionWaitFactor = 5
-const protocolIdentifier = "BitTorrent protocol"
+const ProtocolIdentifier = "BitTorrent protocol"
+const clientVersion = "GoTorrent 0001"
+const MaxRequestQueue = 250 // requests we queue per peer, advertised as reqq
+const writeTimeout = 60     // seconds a message may take to write before the peer is dropped
 
 type Bitfield []byte // 0 indexed... 0b110, piece 2 is missing, 0b011, piece 0 is missing, big endian
 // Size: math.ceil(numPieces / 8)
@@ -52,6 +60,14 @@ func (bitfield *Bitfield) ClearPiece(index int) {
 	(*bitfield)[byteIndex] &= ^(1 << (7 - byteOffset))
 }
 
+func (bitfield Bitfield) Count() int {
+	count := 0
+	for _, b := range bitfield {
+		count += bits.OnesCount8(b)
+	}
+	return count
+}
+
 func (bitfield Bitfield) Pieces() []int {
 	var pieces []int
 
@@ -64,81 +80,365 @@ func (bitfield Bitfield) Pieces() []int {
 	return pieces
 }
 
-func getBitfield(conn net.Conn) (Bitfield, error) {
-	conn.SetDeadline(time.Now().Add(5 * time.Second))
-	defer conn.SetDeadline(time.Time{})
+type Client struct {
+	Conn           net.Conn
+	Choked         bool // peer is choking us
+	AmInterested   bool
+	Bitfield       Bitfield
+	Peer           peer_discovery.Peer
+	Reserved       handshake.Reserved
+	Extensions     map[string]int // peer's extension names to the IDs it receives them on
+	ClientName     string
+	AmChoking      bool // we are choking the peer, set by the uploader
+	PeerInterested bool
+	Requests       []message.BlockRequest // blocks the peer asked us for, oldest first
+	Fast           bool                   // both sides support the fast extension
+	AllowedFast    Bitfield               // pieces we may request while choked
+	Suggested      []int                  // pieces the peer suggested, oldest first
+	DHTPort        uint16                 // UDP port of the peer's DHT node, 0 until it sends one
+	infoHash       [20]byte
+	peerID         [20]byte
+	numPieces      int
+	reader         *bufio.Reader
+	pending        *message.Message // read while looking for the bitfield, returned by the next Read
+	writeMutex     sync.Mutex
+}
+
+// LocalReserved returns the capability bits we advertise in handshakes for
+// the torrent, the DHT bit only while our DHT node runs for it
+func LocalReserved(torrent *bencode.TorrentType) handshake.Reserved {
+	reserved := handshake.Reserved{}
+	reserved.SetExtensions()
+	reserved.SetFast()
+	if torrent.DHTPort != 0 {
+		reserved.SetDHT()
+	}
+	return reserved
+}
+
+// DialFunc opens the connection to a peer, over TCP or uTP
+type DialFunc func(address string, timeout time.Duration) (net.Conn, error)
 
-	msg, err := message.ReadMessage(conn)
+// New dials the peer with dial and runs the handshake. have is our own
+// bitfield and is sent to the peer when we have at least one piece.
+func New(peer peer_discovery.Peer, torrent *bencode.TorrentType, have Bitfield, dial DialFunc) (*Client, error) {
+	conn, err := dial(peer.GetTCPAddress(), connectionWaitFactor*time.Second)
 	if err != nil {
 		return nil, err
 	}
-	if msg == nil {
-		return nil, errors.New("message is nil but should be bitfield")
-	}
-	if msg.ID != message.MsgBitfield {
-		return nil, errors.New("invalid message id received")
+
+	handshakeResponse, err := handshake.DoHandshake(conn, ProtocolIdentifier, LocalReserved(torrent), torrent)
+	if err != nil {
+		conn.Close()
+		return nil, errors.New("handshake failed: " + err.Error())
 	}
 
-	return msg.Payload, nil
+	return setup(conn, peer, torrent, handshakeResponse, have)
 }
 
-type Client struct {
-	Conn     net.Conn
-	Choked   bool
-	Bitfield Bitfield
-	Peer     peer_discovery.Peer
-	infoHash [20]byte
-	peerID   [20]byte
+// NewFromConn finishes setting up a connection the peer opened to us, after
+// handshake.ReceiveHandshake has answered it.
+func NewFromConn(conn net.Conn, torrent *bencode.TorrentType, peerHandshake *handshake.Handshake, have Bitfield) (*Client, error) {
+	peer := peer_discovery.Peer{ID: peerHandshake.PeerID}
+	host, port, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err == nil {
+		parsedPort, _ := strconv.Atoi(port)
+		peer.IP = host
+		peer.Port = uint16(parsedPort)
+	}
+	return setup(conn, peer, torrent, peerHandshake, have)
 }
 
-func New(peer peer_discovery.Peer, torrent *bencode.TorrentType) (*Client, error) {
-	conn, err := net.Dial("tcp", peer.GetTCPAddress())
-	if err != nil {
-		return nil, err
+func setup(conn net.Conn, peer peer_discovery.Peer, torrent *bencode.TorrentType, peerHandshake *handshake.Handshake, have Bitfield) (*Client, error) {
+	client := Client{
+		Conn:       conn,
+		Choked:     true,
+		Peer:       peer,
+		Reserved:   peerHandshake.Reserved,
+		Extensions: make(map[string]int),
+		AmChoking:  true,
+		Fast:       peerHandshake.Reserved.SupportsFast(),
+		infoHash:   torrent.InfoHash,
+		peerID:     peerHandshake.PeerID,
+		numPieces:  torrent.NumPieces,
+		reader:     bufio.NewReader(conn),
 	}
+	client.Bitfield = make(Bitfield, (client.numPieces+7)/8)
+	client.AllowedFast = make(Bitfield, (client.numPieces+7)/8)
 
-	handshakeResponse, err := handshake.DoHandshake(conn, protocolIdentifier, torrent)
+	err := client.sendHave(have)
 	if err != nil {
 		conn.Close()
-		return nil, errors.New("handshake failed: " + err.Error())
+		return nil, err
+	}
+
+	if client.Reserved.SupportsExtensions() {
+		err := client.sendExtendedHandshake(torrent)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if torrent.DHTPort != 0 && client.Reserved.SupportsDHT() {
+		err := client.send(message.CreatePort(torrent.DHTPort))
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
 	}
 
-	bitfield, err := getBitfield(conn)
+	err = client.getBitfield()
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
 
-	client := Client{
-		Conn:     conn,
-		Choked:   true,
-		Bitfield: bitfield,
-		Peer:     peer,
-		infoHash: torrent.InfoHash,
-		peerID:   handshakeResponse.PeerID,
+	return &client, nil
+}
+
+func (client *Client) PeerID() [20]byte {
+	return client.peerID
+}
+
+// sendHave tells the peer which pieces we have. Fast extension peers get Have
+// All or Have None where possible, others a bitfield unless we have nothing.
+func (client *Client) sendHave(have Bitfield) error {
+	count := have.Count()
+	switch {
+	case client.Fast && count == 0:
+		return client.send(message.CreateHaveNone())
+	case client.Fast && count == client.numPieces:
+		return client.send(message.CreateHaveAll())
+	case count > 0:
+		return client.SendBitfield(have)
 	}
+	return nil
+}
 
-	return &client, nil
+// getBitfield reads the pieces the peer has, which may follow the handshake
+// as a bitfield, or as Have All or Have None from fast extension peers. A peer
+// with no pieces may send none of these, then the first other message is kept
+// for the next Read. Peers that support the extension protocol may send their
+// extended handshake first.
+func (client *Client) getBitfield() error {
+	client.Conn.SetDeadline(time.Now().Add(connectionWaitFactor * time.Second))
+	defer client.Conn.SetDeadline(time.Time{})
+
+	for {
+		// A silent peer has nothing to tell us, peeking first means the
+		// deadline never cuts a message in half
+		err := client.WaitForMessage()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		msg, err := message.ReadMessage(client.reader)
+		if err != nil {
+			return err
+		}
+		if msg == nil {
+			return nil
+		}
+
+		switch msg.ID {
+		case message.MsgExtended:
+			err = client.HandleExtended(msg)
+			if err != nil {
+				return err
+			}
+			continue
+		case message.MsgBitfield:
+			client.Bitfield = msg.Payload
+			return nil
+		case message.MsgHaveAll, message.MsgHaveNone:
+			return client.HandleFast(msg)
+		}
+		client.pending = msg
+		return nil
+	}
+}
+
+// HandleFast applies the fast extension messages that change what we know
+// about the peer. Reject is left to the download loop.
+func (client *Client) HandleFast(msg *message.Message) error {
+	if !client.Fast {
+		return errors.New(msg.Name() + " received without the fast extension")
+	}
+
+	switch msg.ID {
+	case message.MsgHaveAll:
+		client.Bitfield = make(Bitfield, (client.numPieces+7)/8)
+		for index := 0; index < client.numPieces; index++ {
+			client.Bitfield.SetPiece(index)
+		}
+	case message.MsgHaveNone:
+		client.Bitfield = make(Bitfield, (client.numPieces+7)/8)
+	case message.MsgSuggest:
+		index, err := message.ParseIndex(msg)
+		if err != nil {
+			return err
+		}
+		if index < client.numPieces && len(client.Suggested) < MaxRequestQueue {
+			client.Suggested = append(client.Suggested, index)
+		}
+	case message.MsgAllowedFast:
+		index, err := message.ParseIndex(msg)
+		if err != nil {
+			return err
+		}
+		if index < client.numPieces {
+			client.AllowedFast.SetPiece(index)
+		}
+	}
+	return nil
+}
+
+// CanRequest reports whether we may request blocks of the piece right now
+func (client *Client) CanRequest(index int) bool {
+	return !client.Choked || (client.Fast && client.AllowedFast.HasPiece(index))
+}
+
+func (client *Client) sendExtendedHandshake(torrent *bencode.TorrentType) error {
+	extendedHandshake := message.ExtendedHandshake{
+		M:    map[string]int{}, // no ut_pex, so private torrents (BEP 27) only get peers from their trackers
+		V:    clientVersion,
+		P:    int64(torrent.Port),
+		Reqq: MaxRequestQueue,
+	}
+	host, _, err := net.SplitHostPort(client.Conn.RemoteAddr().String())
+	if err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			extendedHandshake.YourIP = message.CompactIP(ip)
+		}
+	}
+
+	msg, err := message.CreateExtendedHandshake(&extendedHandshake)
+	if err != nil {
+		return err
+	}
+	return client.send(msg)
+}
+
+// HandleExtended records the peer's extension handshake. A later handshake
+// only updates the extensions it names, and an ID of 0 disables one.
+func (client *Client) HandleExtended(msg *message.Message) error {
+	extendedID, _, err := message.ParseExtended(msg)
+	if err != nil {
+		return err
+	}
+	if extendedID != message.ExtHandshakeID {
+		return nil
+	}
+
+	extendedHandshake, err := message.ParseExtendedHandshake(msg)
+	if err != nil {
+		return err
+	}
+	for name, id := range extendedHandshake.M {
+		if id == 0 {
+			delete(client.Extensions, name)
+			continue
+		}
+		client.Extensions[name] = id
+	}
+	if extendedHandshake.V != "" {
+		client.ClientName = extendedHandshake.V
+	}
+	return nil
+}
+
+func (client *Client) SupportsExtension(name string) bool {
+	_, ok := client.Extensions[name]
+	return ok
 }
 
 func (client *Client) Read() (*message.Message, error) {
-	return message.ReadMessage(client.Conn)
+	if client.pending != nil {
+		msg := client.pending
+		client.pending = nil
+		return msg, nil
+	}
+	return message.ReadMessage(client.reader)
 }
 
-func (client *Client) SendRequest(requestIndex int, requestBegin int, requestLength int) error {
-	req := message.CreateRequest(requestIndex, requestBegin, requestLength)
-	_, err := client.Conn.Write(req.Serialize())
+// WaitForMessage blocks until the peer starts sending a message or the read
+// deadline passes. Nothing is consumed, so a deadline that interrupts the wait
+// leaves the connection usable.
+func (client *Client) WaitForMessage() error {
+	if client.pending != nil {
+		return nil
+	}
+	_, err := client.reader.Peek(1)
 	return err
 }
 
-func (client *Client) SendHave(requestIndex int) error {
-	req := message.CreateHave(requestIndex)
-	_, err := client.Conn.Write(req.Serialize())
-	return err
+// uploadLimiter is a connection whose uploads are rate limited, see ratelimit.Conn
+type uploadLimiter interface {
+	WaitUpload(n int)
 }
 
-func (client *Client) SendUnchoke() error {
-	msg := message.CreateUnchoke()
+// send serializes writes, the download loop and piece writers share the
+// connection. A peer that stops reading would block every sender, so a write
+// that doesn't finish in time closes the connection, as does any failed
+// write since it may have left half a message behind.
+func (client *Client) send(msg *message.Message) error {
+	client.writeMutex.Lock()
+	defer client.writeMutex.Unlock()
+	client.Conn.SetWriteDeadline(time.Now().Add(writeTimeout * time.Second))
 	_, err := client.Conn.Write(msg.Serialize())
+	if err != nil {
+		client.Conn.Close()
+	}
 	return err
 }
+
+func (client *Client) SendRequest(requestIndex int, requestBegin int, requestLength int) error {
+	return client.send(message.CreateRequest(requestIndex, requestBegin, requestLength))
+}
+
+func (client *Client) SendCancel(requestIndex int, requestBegin int, requestLength int) error {
+	return client.send(message.CreateCancel(requestIndex, requestBegin, requestLength))
+}
+
+func (client *Client) SendHave(requestIndex int) error {
+	return client.send(message.CreateHave(requestIndex))
+}
+
+func (client *Client) SendUnchoke() error {
+	return client.send(message.CreateUnchoke())
+}
+
+func (client *Client) SendChoke() error {
+	return client.send(message.CreateChoke())
+}
+
+func (client *Client) SendInterested() error {
+	client.AmInterested = true
+	return client.send(message.CreateInterested())
+}
+
+func (client *Client) SendNotInterested() error {
+	client.AmInterested = false
+	return client.send(message.CreateNotInterested())
+}
+
+func (client *Client) SendBitfield(bitfield Bitfield) error {
+	return client.send(message.CreateBitfield(bitfield))
+}
+
+func (client *Client) SendReject(request message.BlockRequest) error {
+	return client.send(message.CreateReject(request.Index, request.Begin, request.Length))
+}
+
+// SendPiece uploads a block. Only piece data counts against the upload limits,
+// and it waits for them before taking the connection for the write.
+func (client *Client) SendPiece(index int, begin int, data []byte) error {
+	limiter, ok := client.Conn.(uploadLimiter)
+	if ok {
+		limiter.WaitUpload(len(data))
+	}
+	return client.send(message.CreatePiece(index, begin, data))
+}
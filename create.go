@@ -0,0 +1,39 @@
+package main
+
+import (
+	"GoTorrent/bencode"
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+)
+
+// create writes a torrent of the files at opts.Path, after checking that it
+// parses back
+func create(opts createOptions) error {
+	data, err := bencode.CreateTorrent(opts.Path, bencode.CreateOptions{
+		PieceLength:  opts.PieceLength,
+		AnnounceList: opts.Trackers,
+		Comment:      opts.Comment,
+		CreatedBy:    opts.CreatedBy,
+		CreationDate: time.Now(),
+		Private:      opts.Private,
+		WebSeeds:     opts.WebSeeds,
+		Source:       opts.Source,
+	})
+	if err != nil {
+		return err
+	}
+
+	torrent, err := bencode.ParseTorrent(bytes.NewReader(data), opts.Output)
+	if err != nil {
+		return fmt.Errorf("created torrent doesn't parse: %v", err)
+	}
+	err = os.WriteFile(opts.Output, data, 0644)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Created %s\n", opts.Output)
+	fmt.Print(torrent)
+	return nil
+}
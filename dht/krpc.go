@@ -0,0 +1,94 @@
+package dht
+
+import (
+	"GoTorrent/bencode"
+	"fmt"
+)
+
+/*
+See: https://www.bittorrent.org/beps/bep_0005.html
+Every KRPC message is a bencoded dictionary with a transaction ID "t" and a
+type "y" of "q" (query), "r" (response) or "e" (error).
+*/
+
+const (
+	methodPing         = "ping"
+	methodFindNode     = "find_node"
+	methodGetPeers     = "get_peers"
+	methodAnnouncePeer = "announce_peer"
+)
+
+const (
+	errorGeneric  = 201
+	errorServer   = 202
+	errorProtocol = 203
+	errorMethod   = 204
+)
+
+type krpcArgs struct {
+	ID          string `bencode:"id"`
+	Target      string `bencode:"target,omitempty"`
+	InfoHash    string `bencode:"info_hash,omitempty"`
+	Port        int    `bencode:"port,omitempty"`
+	Token       string `bencode:"token,omitempty"`
+	ImpliedPort int    `bencode:"implied_port,omitempty"`
+}
+
+type krpcReturn struct {
+	ID     string   `bencode:"id"`
+	Nodes  string   `bencode:"nodes,omitempty"`
+	Values []string `bencode:"values,omitempty"`
+	Token  string   `bencode:"token,omitempty"`
+}
+
+type krpcQuery struct {
+	T string   `bencode:"t"`
+	Y string   `bencode:"y"`
+	Q string   `bencode:"q"`
+	A krpcArgs `bencode:"a"`
+}
+
+type krpcResponse struct {
+	T string     `bencode:"t"`
+	Y string     `bencode:"y"`
+	R krpcReturn `bencode:"r"`
+}
+
+type krpcError struct {
+	T string          `bencode:"t"`
+	Y string          `bencode:"y"`
+	E []bencode.Value `bencode:"e"` // error code and message
+}
+
+// krpcMessage is any decoded message, only the fields for its type are set
+type krpcMessage struct {
+	T string          `bencode:"t"`
+	Y string          `bencode:"y"`
+	Q string          `bencode:"q"`
+	A krpcArgs        `bencode:"a"`
+	R krpcReturn      `bencode:"r"`
+	E []bencode.Value `bencode:"e"`
+}
+
+func (msg *krpcMessage) errorString() string {
+	if len(msg.E) != 2 || msg.E[0].Kind != bencode.KindInt || msg.E[1].Kind != bencode.KindString {
+		return "malformed error"
+	}
+	return fmt.Sprintf("%d: %s", msg.E[0].Int, msg.E[1].Str)
+}
+
+func encodeKRPC(msg any) ([]byte, error) {
+	return bencode.Marshal(msg)
+}
+
+func decodeKRPC(data []byte) (*krpcMessage, error) {
+	msg := krpcMessage{}
+	err := bencode.Unmarshal(data, &msg)
+	if err != nil {
+		return nil, err
+	}
+	if msg.T == "" {
+		return nil, fmt.Errorf("message has no transaction ID")
+	}
+	return &msg, nil
+}
@@ -0,0 +1,133 @@
+package dht
+
+import (
+	"GoTorrent/peer_discovery"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net"
+	"strconv"
+	"time"
+)
+
+const idLength = 20
+const compactPeerLength = 6                            // 4 bytes IP, 2 bytes port
+const compactNodeLength = idLength + compactPeerLength // node ID followed by a compact peer
+
+type NodeID [idLength]byte
+
+func RandomNodeID() (NodeID, error) {
+	var id NodeID
+	_, err := rand.Read(id[:])
+	return id, err
+}
+
+func (id NodeID) String() string {
+	return fmt.Sprintf("%x", id[:])
+}
+
+func (id NodeID) xor(other NodeID) NodeID {
+	var distance NodeID
+	for i := range id {
+		distance[i] = id[i] ^ other[i]
+	}
+	return distance
+}
+
+// closer reports whether a is closer to target than b
+func closer(target NodeID, a NodeID, b NodeID) bool {
+	distanceA := target.xor(a)
+	distanceB := target.xor(b)
+	return bytes.Compare(distanceA[:], distanceB[:]) < 0
+}
+
+func commonPrefixLen(a NodeID, b NodeID) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return idLength * 8
+}
+
+type node struct {
+	ID       NodeID
+	Addr     *net.UDPAddr
+	LastSeen time.Time
+	failures int
+}
+
+func encodeCompactAddr(addr *net.UDPAddr) ([]byte, error) {
+	ip := addr.IP.To4()
+	if ip == nil {
+		return nil, fmt.Errorf("not an IPv4 address: %v", addr)
+	}
+	buf := make([]byte, compactPeerLength)
+	copy(buf[0:4], ip)
+	binary.BigEndian.PutUint16(buf[4:6], uint16(addr.Port))
+	return buf, nil
+}
+
+func decodeCompactAddr(data []byte) *net.UDPAddr {
+	ip := make(net.IP, net.IPv4len)
+	copy(ip, data[0:4])
+	return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(data[4:6]))}
+}
+
+func encodeCompactNodes(nodes []*node) string {
+	buf := new(bytes.Buffer)
+	for _, n := range nodes {
+		addr, err := encodeCompactAddr(n.Addr)
+		if err != nil {
+			continue
+		}
+		buf.Write(n.ID[:])
+		buf.Write(addr)
+	}
+	return buf.String()
+}
+
+func decodeCompactNodes(data string) ([]*node, error) {
+	if len(data)%compactNodeLength != 0 {
+		return nil, errors.New("malformed compact node info")
+	}
+	nodes := make([]*node, 0, len(data)/compactNodeLength)
+	for i := 0; i < len(data); i += compactNodeLength {
+		n := node{}
+		copy(n.ID[:], data[i:i+idLength])
+		n.Addr = decodeCompactAddr([]byte(data[i+idLength : i+compactNodeLength]))
+		nodes = append(nodes, &n)
+	}
+	return nodes, nil
+}
+
+func encodeCompactPeer(peer peer_discovery.Peer) (string, error) {
+	ip := net.ParseIP(peer.IP)
+	if ip == nil {
+		return "", fmt.Errorf("invalid peer IP %s", peer.IP)
+	}
+	buf, err := encodeCompactAddr(&net.UDPAddr{IP: ip, Port: int(peer.Port)})
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func decodeCompactPeers(values []string) []peer_discovery.Peer {
+	peers := make([]peer_discovery.Peer, 0, len(values))
+	for _, value := range values {
+		if len(value) != compactPeerLength {
+			continue
+		}
+		addr := decodeCompactAddr([]byte(value))
+		peers = append(peers, peer_discovery.Peer{IP: addr.IP.String(), Port: uint16(addr.Port)})
+	}
+	return peers
+}
+
+func peerKey(peer peer_discovery.Peer) string {
+	return net.JoinHostPort(peer.IP, strconv.Itoa(int(peer.Port)))
+}
@@ -0,0 +1,174 @@
+package dht
+
+import (
+	"GoTorrent/bencode"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const bucketSize = 8 // k in the Kademlia paper
+const maxFailures = 2
+
+/*
+Buckets are indexed by the length of the prefix a node's ID shares with ours,
+so bucket 0 covers the half of the ID space furthest from us and bucket 159
+the node closest to us. Each bucket holds at most bucketSize nodes, oldest first.
+*/
+type routingTable struct {
+	mutex   sync.Mutex
+	self    NodeID
+	buckets [idLength * 8][]*node
+}
+
+type tableState struct {
+	ID    string `bencode:"id"`
+	Nodes string `bencode:"nodes"`
+}
+
+func newRoutingTable(self NodeID) *routingTable {
+	return &routingTable{self: self}
+}
+
+func (table *routingTable) bucketIndex(id NodeID) int {
+	return min(commonPrefixLen(table.self, id), len(table.buckets)-1)
+}
+
+// insert adds or refreshes a node that we have heard from. A full bucket only
+// accepts the node if one of its entries has stopped responding.
+func (table *routingTable) insert(n *node) bool {
+	if n.ID == table.self || n.Addr == nil || n.Addr.IP.To4() == nil {
+		return false
+	}
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	index := table.bucketIndex(n.ID)
+	bucket := table.buckets[index]
+	for i, existing := range bucket {
+		if existing.ID == n.ID {
+			existing.Addr = n.Addr
+			existing.LastSeen = n.LastSeen
+			existing.failures = 0
+			table.buckets[index] = append(append(bucket[:i:i], bucket[i+1:]...), existing)
+			return true
+		}
+	}
+
+	if len(bucket) < bucketSize {
+		table.buckets[index] = append(bucket, n)
+		return true
+	}
+
+	for i, existing := range bucket {
+		if existing.failures >= maxFailures {
+			table.buckets[index] = append(append(bucket[:i:i], bucket[i+1:]...), n)
+			return true
+		}
+	}
+	return false
+}
+
+func (table *routingTable) failed(id NodeID) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	for _, existing := range table.buckets[table.bucketIndex(id)] {
+		if existing.ID == id {
+			existing.failures++
+			return
+		}
+	}
+}
+
+func (table *routingTable) closest(target NodeID, count int) []*node {
+	table.mutex.Lock()
+	var good []*node
+	for _, bucket := range table.buckets {
+		for _, existing := range bucket {
+			if existing.failures < maxFailures {
+				copied := *existing
+				good = append(good, &copied)
+			}
+		}
+	}
+	table.mutex.Unlock()
+
+	sort.Slice(good, func(i, j int) bool {
+		return closer(target, good[i].ID, good[j].ID)
+	})
+	if len(good) > count {
+		good = good[:count]
+	}
+	return good
+}
+
+func (table *routingTable) len() int {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	count := 0
+	for _, bucket := range table.buckets {
+		count += len(bucket)
+	}
+	return count
+}
+
+// save writes our ID and every known node to path, replacing the file atomically
+func (table *routingTable) save(path string) error {
+	table.mutex.Lock()
+	var nodes []*node
+	for _, bucket := range table.buckets {
+		nodes = append(nodes, bucket...)
+	}
+	state := tableState{ID: string(table.self[:]), Nodes: encodeCompactNodes(nodes)}
+	table.mutex.Unlock()
+
+	data, err := bencode.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func loadRoutingTable(path string) (*routingTable, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	state := tableState{}
+	err = bencode.Unmarshal(data, &state)
+	if err != nil {
+		return nil, err
+	}
+	if len(state.ID) != idLength {
+		return nil, errors.New("invalid node ID in routing table state")
+	}
+
+	var self NodeID
+	copy(self[:], state.ID)
+	table := newRoutingTable(self)
+	nodes, err := decodeCompactNodes(state.Nodes)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range nodes {
+		n.LastSeen = time.Time{}
+		table.insert(n)
+	}
+	return table, nil
+}
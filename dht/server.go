@@ -0,0 +1,613 @@
+package dht
+
+import (
+	"GoTorrent/bencode"
+	"GoTorrent/peer_discovery"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const alpha = 3 // queries in flight per lookup step
+const queryTimeout = 2 * time.Second
+const refreshInterval = 15 * time.Minute
+const tokenRotation = 5 * time.Minute
+const tokenLength = 8
+const peerExpiry = 30 * time.Minute
+const maxStoredPeers = 100       // per infohash
+const maxStoredInfoHashes = 5000 // announces for new infohashes are dropped beyond this
+const maxPacketSize = 65536
+
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+type Config struct {
+	Addr           string         // UDP address to listen on, e.g. ":6881"
+	BootstrapNodes []string       // host:port of well known nodes used to join the network
+	StateFile      string         // routing table is loaded from and saved to this file, empty to disable
+	Conn           net.PacketConn // used instead of listening on Addr, such as a socket shared with uTP
+}
+
+type transaction struct {
+	addr  *net.UDPAddr
+	reply chan *krpcMessage
+}
+
+type storedPeer struct {
+	peer  peer_discovery.Peer
+	added time.Time
+}
+
+type lookupResult struct {
+	node  *node
+	token string
+}
+
+type Server struct {
+	conn            net.PacketConn
+	config          Config
+	table           *routingTable
+	mutex           sync.Mutex
+	transactions    map[string]transaction
+	nextTransaction uint16
+	peerStore       map[[20]byte]map[string]storedPeer
+	secret          [20]byte
+	previousSecret  [20]byte
+	secretRotated   time.Time
+	closeOnce       sync.Once
+	closed          chan struct{}
+	wg              sync.WaitGroup
+}
+
+func New(config Config) (*Server, error) {
+	var table *routingTable
+	var err error
+	if config.StateFile != "" {
+		table, err = loadRoutingTable(config.StateFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("failed to load DHT state [%v]\n", err)
+		}
+	}
+	if table == nil {
+		id, err := RandomNodeID()
+		if err != nil {
+			return nil, err
+		}
+		table = newRoutingTable(id)
+	}
+
+	conn := config.Conn
+	if conn == nil {
+		conn, err = net.ListenPacket("udp4", config.Addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	server := Server{
+		conn:          conn,
+		config:        config,
+		table:         table,
+		transactions:  make(map[string]transaction),
+		peerStore:     make(map[[20]byte]map[string]storedPeer),
+		secretRotated: time.Now(),
+		closed:        make(chan struct{}),
+	}
+	_, err = rand.Read(server.secret[:])
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	server.previousSecret = server.secret
+
+	server.wg.Add(2)
+	go server.readLoop()
+	go server.refreshLoop()
+	return &server, nil
+}
+
+func (server *Server) ID() NodeID {
+	return server.table.self
+}
+
+func (server *Server) Addr() *net.UDPAddr {
+	return server.conn.LocalAddr().(*net.UDPAddr)
+}
+
+func (server *Server) NumNodes() int {
+	return server.table.len()
+}
+
+func (server *Server) Close() error {
+	err := errors.New("dht server already closed")
+	server.closeOnce.Do(func() {
+		close(server.closed)
+		err = server.conn.Close()
+		server.wg.Wait()
+		if server.config.StateFile != "" {
+			saveErr := server.table.save(server.config.StateFile)
+			if saveErr != nil {
+				log.Printf("failed to save DHT state [%v]\n", saveErr)
+			}
+		}
+	})
+	return err
+}
+
+// Bootstrap joins the network by asking the bootstrap nodes for the nodes
+// closest to our own ID, then looking ourselves up through them.
+func (server *Server) Bootstrap() error {
+	var seedGroup sync.WaitGroup
+	var seedMutex sync.Mutex
+	var seeds []*node
+	target := server.ID()
+	for _, address := range server.config.BootstrapNodes {
+		addr, err := net.ResolveUDPAddr("udp4", address)
+		if err != nil {
+			log.Printf("failed to resolve bootstrap node [%s]: %v\n", address, err)
+			continue
+		}
+		seedGroup.Add(1)
+		go func() {
+			defer seedGroup.Done()
+			reply, err := server.query(addr, methodFindNode, krpcArgs{Target: string(target[:])})
+			if err != nil {
+				return
+			}
+			nodes, err := decodeCompactNodes(reply.R.Nodes)
+			if err != nil {
+				return
+			}
+			seedMutex.Lock()
+			seeds = append(seeds, nodes...)
+			seedMutex.Unlock()
+		}()
+	}
+	seedGroup.Wait()
+
+	server.lookup(target, methodFindNode, seeds)
+	if server.table.len() == 0 {
+		return errors.New("dht bootstrap found no nodes")
+	}
+	return nil
+}
+
+func (server *Server) Ping(address string) error {
+	addr, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		return err
+	}
+	_, err = server.query(addr, methodPing, krpcArgs{})
+	return err
+}
+
+// GetPeers looks up peers for the infohash from the nodes closest to it
+func (server *Server) GetPeers(infoHash [20]byte) ([]peer_discovery.Peer, error) {
+	if server.table.len() == 0 {
+		return nil, errors.New("dht routing table is empty")
+	}
+	_, peers := server.lookup(NodeID(infoHash), methodGetPeers, nil)
+	return peers, nil
+}
+
+// Announce looks up peers for the infohash and tells the closest nodes that
+// we accept connections for it on port.
+func (server *Server) Announce(infoHash [20]byte, port uint16) ([]peer_discovery.Peer, error) {
+	if server.table.len() == 0 {
+		return nil, errors.New("dht routing table is empty")
+	}
+	results, peers := server.lookup(NodeID(infoHash), methodGetPeers, nil)
+
+	var announceGroup sync.WaitGroup
+	for _, result := range results {
+		if result.token == "" {
+			continue
+		}
+		announceGroup.Add(1)
+		go func() {
+			defer announceGroup.Done()
+			_, err := server.query(result.node.Addr, methodAnnouncePeer, krpcArgs{
+				InfoHash: string(infoHash[:]),
+				Port:     int(port),
+				Token:    result.token,
+			})
+			if err != nil {
+				server.table.failed(result.node.ID)
+			}
+		}()
+	}
+	announceGroup.Wait()
+	return peers, nil
+}
+
+/*
+Iterative Kademlia lookup: keep querying the alpha closest nodes we have not
+asked yet until the bucketSize closest nodes have all answered or failed.
+*/
+func (server *Server) lookup(target NodeID, method string, seeds []*node) ([]lookupResult, []peer_discovery.Peer) {
+	type candidate struct {
+		node      *node
+		queried   bool
+		responded bool
+		token     string
+	}
+	type queryResult struct {
+		candidate *candidate
+		reply     *krpcMessage
+		err       error
+	}
+
+	seen := make(map[NodeID]bool)
+	var candidates []*candidate
+	addCandidate := func(n *node) {
+		if seen[n.ID] || n.ID == server.ID() {
+			return
+		}
+		seen[n.ID] = true
+		candidates = append(candidates, &candidate{node: n})
+	}
+	for _, n := range server.table.closest(target, bucketSize) {
+		addCandidate(n)
+	}
+	for _, n := range seeds {
+		addCandidate(n)
+	}
+
+	args := krpcArgs{}
+	if method == methodGetPeers {
+		args.InfoHash = string(target[:])
+	} else {
+		args.Target = string(target[:])
+	}
+
+	peers := make(map[string]peer_discovery.Peer)
+	for {
+		sort.Slice(candidates, func(i, j int) bool {
+			return closer(target, candidates[i].node.ID, candidates[j].node.ID)
+		})
+
+		var batch []*candidate
+		considered := 0
+		for _, c := range candidates {
+			if considered == bucketSize || len(batch) == alpha {
+				break
+			}
+			if c.queried && !c.responded {
+				continue
+			}
+			considered++
+			if !c.queried {
+				batch = append(batch, c)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		replies := make(chan queryResult, len(batch))
+		for _, c := range batch {
+			c.queried = true
+			go func() {
+				reply, err := server.query(c.node.Addr, method, args)
+				replies <- queryResult{candidate: c, reply: reply, err: err}
+			}()
+		}
+		for range batch {
+			result := <-replies
+			if result.err != nil {
+				server.table.failed(result.candidate.node.ID)
+				continue
+			}
+			result.candidate.responded = true
+			result.candidate.token = result.reply.R.Token
+			nodes, err := decodeCompactNodes(result.reply.R.Nodes)
+			if err == nil {
+				for _, n := range nodes {
+					addCandidate(n)
+				}
+			}
+			for _, peer := range decodeCompactPeers(result.reply.R.Values) {
+				peers[peerKey(peer)] = peer
+			}
+		}
+	}
+
+	var results []lookupResult
+	for _, c := range candidates {
+		if len(results) == bucketSize {
+			break
+		}
+		if c.responded {
+			results = append(results, lookupResult{node: c.node, token: c.token})
+		}
+	}
+	peerList := make([]peer_discovery.Peer, 0, len(peers))
+	for _, peer := range peers {
+		peerList = append(peerList, peer)
+	}
+	return results, peerList
+}
+
+func (server *Server) query(addr *net.UDPAddr, method string, args krpcArgs) (*krpcMessage, error) {
+	self := server.ID()
+	args.ID = string(self[:])
+
+	server.mutex.Lock()
+	server.nextTransaction++
+	transactionID := make([]byte, 2)
+	binary.BigEndian.PutUint16(transactionID, server.nextTransaction)
+	key := string(transactionID)
+	reply := make(chan *krpcMessage, 1)
+	server.transactions[key] = transaction{addr: addr, reply: reply}
+	server.mutex.Unlock()
+
+	defer func() {
+		server.mutex.Lock()
+		delete(server.transactions, key)
+		server.mutex.Unlock()
+	}()
+
+	err := server.send(krpcQuery{T: key, Y: "q", Q: method, A: args}, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case msg := <-reply:
+		if msg.Y == "e" {
+			return nil, fmt.Errorf("%s error from %v: %s", method, addr, msg.errorString())
+		}
+		if len(msg.R.ID) != idLength {
+			return nil, fmt.Errorf("%s reply from %v has invalid node ID", method, addr)
+		}
+		responder := node{Addr: addr, LastSeen: time.Now()}
+		copy(responder.ID[:], msg.R.ID)
+		server.table.insert(&responder)
+		return msg, nil
+	case <-time.After(queryTimeout):
+		return nil, fmt.Errorf("%s to %v timed out", method, addr)
+	case <-server.closed:
+		return nil, errors.New("dht server closed")
+	}
+}
+
+func (server *Server) send(msg any, addr *net.UDPAddr) error {
+	data, err := encodeKRPC(msg)
+	if err != nil {
+		return err
+	}
+	_, err = server.conn.WriteTo(data, addr)
+	return err
+}
+
+func (server *Server) readLoop() {
+	defer server.wg.Done()
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, from, err := server.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-server.closed:
+				return
+			default:
+				continue
+			}
+		}
+		addr, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		msg, err := decodeKRPC(buf[:n])
+		if err != nil {
+			continue
+		}
+		switch msg.Y {
+		case "q":
+			server.handleQuery(msg, addr)
+		case "r", "e":
+			server.handleReply(msg, addr)
+		}
+	}
+}
+
+func (server *Server) refreshLoop() {
+	defer server.wg.Done()
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			server.expirePeers()
+			server.lookup(server.ID(), methodFindNode, nil)
+			if server.config.StateFile != "" {
+				err := server.table.save(server.config.StateFile)
+				if err != nil {
+					log.Printf("failed to save DHT state [%v]\n", err)
+				}
+			}
+		case <-server.closed:
+			return
+		}
+	}
+}
+
+func (server *Server) handleReply(msg *krpcMessage, addr *net.UDPAddr) {
+	server.mutex.Lock()
+	pending, ok := server.transactions[msg.T]
+	server.mutex.Unlock()
+	if !ok || !pending.addr.IP.Equal(addr.IP) || pending.addr.Port != addr.Port {
+		return
+	}
+	select {
+	case pending.reply <- msg:
+	default:
+	}
+}
+
+func (server *Server) handleQuery(msg *krpcMessage, addr *net.UDPAddr) {
+	if len(msg.A.ID) != idLength {
+		server.sendError(msg.T, addr, errorProtocol, "invalid node ID")
+		return
+	}
+	querier := node{Addr: addr, LastSeen: time.Now()}
+	copy(querier.ID[:], msg.A.ID)
+	server.table.insert(&querier)
+
+	self := server.ID()
+	reply := krpcReturn{ID: string(self[:])}
+	switch msg.Q {
+	case methodPing:
+	case methodFindNode:
+		if len(msg.A.Target) != idLength {
+			server.sendError(msg.T, addr, errorProtocol, "invalid target")
+			return
+		}
+		var target NodeID
+		copy(target[:], msg.A.Target)
+		reply.Nodes = encodeCompactNodes(server.table.closest(target, bucketSize))
+	case methodGetPeers:
+		if len(msg.A.InfoHash) != idLength {
+			server.sendError(msg.T, addr, errorProtocol, "invalid info_hash")
+			return
+		}
+		var infoHash [20]byte
+		copy(infoHash[:], msg.A.InfoHash)
+		reply.Token = server.token(addr.IP)
+		values := server.storedPeers(infoHash)
+		if len(values) > 0 {
+			reply.Values = values
+		} else {
+			reply.Nodes = encodeCompactNodes(server.table.closest(NodeID(infoHash), bucketSize))
+		}
+	case methodAnnouncePeer:
+		if len(msg.A.InfoHash) != idLength {
+			server.sendError(msg.T, addr, errorProtocol, "invalid info_hash")
+			return
+		}
+		if !server.validToken(msg.A.Token, addr.IP) {
+			server.sendError(msg.T, addr, errorProtocol, "bad token")
+			return
+		}
+		port := msg.A.Port
+		if msg.A.ImpliedPort != 0 {
+			port = addr.Port
+		}
+		if port <= 0 || port > 65535 {
+			server.sendError(msg.T, addr, errorProtocol, "invalid port")
+			return
+		}
+		var infoHash [20]byte
+		copy(infoHash[:], msg.A.InfoHash)
+		server.storePeer(infoHash, peer_discovery.Peer{IP: addr.IP.String(), Port: uint16(port)})
+	default:
+		server.sendError(msg.T, addr, errorMethod, "Method Unknown")
+		return
+	}
+
+	err := server.send(krpcResponse{T: msg.T, Y: "r", R: reply}, addr)
+	if err != nil {
+		log.Printf("failed to reply to %s from %v [%v]\n", msg.Q, addr, err)
+	}
+}
+
+func (server *Server) sendError(transactionID string, addr *net.UDPAddr, code int, description string) {
+	server.send(krpcError{T: transactionID, Y: "e", E: []bencode.Value{bencode.NewInt(int64(code)), bencode.NewString(description)}}, addr)
+}
+
+/*
+Tokens are a hash of the querier's IP and a secret that rotates every five
+minutes. Tokens made with the previous secret are still accepted, so a token
+stays valid for up to ten minutes.
+*/
+func (server *Server) token(ip net.IP) string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if time.Since(server.secretRotated) > tokenRotation {
+		server.previousSecret = server.secret
+		rand.Read(server.secret[:])
+		server.secretRotated = time.Now()
+	}
+	return makeToken(server.secret, ip)
+}
+
+func (server *Server) validToken(token string, ip net.IP) bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return token == makeToken(server.secret, ip) || token == makeToken(server.previousSecret, ip)
+}
+
+func makeToken(secret [20]byte, ip net.IP) string {
+	hash := sha1.Sum(append(secret[:], ip.To16()...))
+	return string(hash[:tokenLength])
+}
+
+func (server *Server) storePeer(infoHash [20]byte, peer peer_discovery.Peer) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	peers, ok := server.peerStore[infoHash]
+	if !ok {
+		if len(server.peerStore) >= maxStoredInfoHashes {
+			return
+		}
+		peers = make(map[string]storedPeer)
+		server.peerStore[infoHash] = peers
+	}
+	key := peerKey(peer)
+	if _, exists := peers[key]; !exists && len(peers) >= maxStoredPeers {
+		return
+	}
+	peers[key] = storedPeer{peer: peer, added: time.Now()}
+}
+
+func (server *Server) storedPeers(infoHash [20]byte) []string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	var values []string
+	for key, stored := range server.peerStore[infoHash] {
+		if time.Since(stored.added) > peerExpiry {
+			delete(server.peerStore[infoHash], key)
+			continue
+		}
+		value, err := encodeCompactPeer(stored.peer)
+		if err != nil {
+			continue
+		}
+		values = append(values, value)
+	}
+	if len(server.peerStore[infoHash]) == 0 {
+		delete(server.peerStore, infoHash)
+	}
+	return values
+}
+
+// expirePeers drops the stored peers that haven't announced within
+// peerExpiry, and the infohashes left without any
+func (server *Server) expirePeers() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for infoHash, peers := range server.peerStore {
+		for key, stored := range peers {
+			if time.Since(stored.added) > peerExpiry {
+				delete(peers, key)
+			}
+		}
+		if len(peers) == 0 {
+			delete(server.peerStore, infoHash)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package dht
+
+import (
+	"GoTorrent/peer_discovery"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const swarmSize = 5
+
+// startSwarm starts nodes on loopback that all bootstrap off the first one
+func startSwarm(t *testing.T) []*Server {
+	t.Helper()
+	first, err := New(Config{Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { first.Close() })
+	servers := []*Server{first}
+	for i := 1; i < swarmSize; i++ {
+		server, err := New(Config{Addr: "127.0.0.1:0", BootstrapNodes: []string{first.Addr().String()}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { server.Close() })
+		err = server.Bootstrap()
+		if err != nil {
+			t.Fatalf("node %d failed to bootstrap: %v", i, err)
+		}
+		servers = append(servers, server)
+	}
+	first.config.BootstrapNodes = []string{servers[1].Addr().String()}
+	err = first.Bootstrap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return servers
+}
+
+func TestBootstrap(t *testing.T) {
+	servers := startSwarm(t)
+	for i, server := range servers {
+		if server.NumNodes() == 0 {
+			t.Errorf("node %d has an empty routing table", i)
+		}
+	}
+	err := servers[1].Ping(servers[2].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAnnounceAndGetPeers(t *testing.T) {
+	servers := startSwarm(t)
+	infoHash := [20]byte{1, 2, 3, 4, 5}
+
+	peers, err := servers[1].Announce(infoHash, 6881)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 0 {
+		t.Fatalf("got %d peers before anyone announced", len(peers))
+	}
+
+	for _, server := range []*Server{servers[0], servers[swarmSize-1]} {
+		peers, err = server.GetPeers(infoHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(peers) != 1 || peers[0].IP != "127.0.0.1" || peers[0].Port != 6881 {
+			t.Fatalf("got peers %v, want 127.0.0.1:6881", peers)
+		}
+	}
+
+	peers, err = servers[2].GetPeers([20]byte{9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 0 {
+		t.Fatalf("got peers %v for an infohash nobody announced", peers)
+	}
+}
+
+func TestStateFile(t *testing.T) {
+	servers := startSwarm(t)
+	stateFile := filepath.Join(t.TempDir(), "dht.dat")
+	server, err := New(Config{Addr: "127.0.0.1:0", BootstrapNodes: []string{servers[0].Addr().String()}, StateFile: stateFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.Bootstrap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := server.ID()
+	numNodes := server.NumNodes()
+	server.Close()
+
+	reloaded, err := New(Config{Addr: "127.0.0.1:0", StateFile: stateFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+	if reloaded.ID() != id {
+		t.Fatalf("reloaded ID %v, want %v", reloaded.ID(), id)
+	}
+	if reloaded.NumNodes() != numNodes {
+		t.Fatalf("reloaded %d nodes, want %d", reloaded.NumNodes(), numNodes)
+	}
+	// The saved nodes are enough to join again without bootstrap nodes
+	err = reloaded.Bootstrap()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTokenRotation(t *testing.T) {
+	server, err := New(Config{Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ip := net.ParseIP("10.0.0.1")
+	other := net.ParseIP("10.0.0.2")
+
+	token := server.token(ip)
+	if !server.validToken(token, ip) {
+		t.Fatal("fresh token rejected")
+	}
+	if server.validToken(token, other) {
+		t.Fatal("token accepted from another IP")
+	}
+
+	rotate := func() {
+		server.mutex.Lock()
+		server.secretRotated = time.Now().Add(-2 * tokenRotation)
+		server.mutex.Unlock()
+		server.token(other)
+	}
+	rotate()
+	if !server.validToken(token, ip) {
+		t.Fatal("token rejected after one rotation")
+	}
+	if server.token(ip) == token {
+		t.Fatal("token unchanged after the secret rotated")
+	}
+	rotate()
+	if server.validToken(token, ip) {
+		t.Fatal("token accepted after two rotations")
+	}
+}
+
+func TestPeerStoreLimits(t *testing.T) {
+	server, err := New(Config{Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	peer := peer_discovery.Peer{IP: "10.0.0.1", Port: 6881}
+	infoHash := func(i int) [20]byte {
+		return [20]byte{byte(i >> 16), byte(i >> 8), byte(i)}
+	}
+
+	for i := 0; i < maxStoredInfoHashes; i++ {
+		server.storePeer(infoHash(i), peer)
+	}
+	full := infoHash(maxStoredInfoHashes)
+	server.storePeer(full, peer)
+	if len(server.storedPeers(full)) != 0 {
+		t.Fatal("a peer was stored beyond the infohash limit")
+	}
+
+	// Peers that didn't announce again expire without their infohash being
+	// asked for, which makes room for new ones
+	server.mutex.Lock()
+	for i := 0; i < maxStoredInfoHashes/2; i++ {
+		for key, stored := range server.peerStore[infoHash(i)] {
+			stored.added = time.Now().Add(-2 * peerExpiry)
+			server.peerStore[infoHash(i)][key] = stored
+		}
+	}
+	server.mutex.Unlock()
+	server.expirePeers()
+	server.mutex.Lock()
+	stored := len(server.peerStore)
+	server.mutex.Unlock()
+	if stored != maxStoredInfoHashes-maxStoredInfoHashes/2 {
+		t.Fatalf("%d infohashes stored after expiry, want %d", stored, maxStoredInfoHashes-maxStoredInfoHashes/2)
+	}
+	server.storePeer(full, peer)
+	if len(server.storedPeers(full)) != 1 {
+		t.Fatal("no room for a new infohash after expiry")
+	}
+}
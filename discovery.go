@@ -0,0 +1,176 @@
+package main
+
+import (
+	"GoTorrent/bencode"
+	"GoTorrent/dht"
+	"GoTorrent/magnet"
+	"GoTorrent/networking"
+	"GoTorrent/peer_discovery"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+const dhtAnnounceInterval = 30 * time.Minute
+
+// startDHT runs the DHT node. When it uses the listen port it shares the uTP
+// socket, which passes it every packet that isn't uTP.
+func startDHT(opts downloadOptions, listener *networking.Listener) (*dht.Server, error) {
+	config := dht.Config{
+		Addr:           fmt.Sprintf(":%d", opts.DHTPort),
+		BootstrapNodes: opts.DHTBootstrap,
+		StateFile:      opts.DHTState,
+	}
+	if listener != nil && listener.UTP() != nil && opts.DHTPort == opts.Port {
+		config.Conn = listener.UTP().PacketConn()
+	}
+	dhtServer, err := dht.New(config)
+	if err != nil {
+		return nil, err
+	}
+
+	err = dhtServer.Bootstrap()
+	if err != nil {
+		log.Printf("DHT bootstrap failed: %v\n", err)
+	}
+	log.Printf("DHT node %v listening on %v with %d nodes\n", dhtServer.ID(), dhtServer.Addr(), dhtServer.NumNodes())
+	return dhtServer, nil
+}
+
+// findPeers collects peers for the torrent from its trackers and the DHT, kept
+// apart so they can be told apart once the torrent is known to be private. The
+// trackers are tried in order and the first one that answers is returned.
+func findPeers(torrent *bencode.TorrentType, trackers []string, dhtServer *dht.Server) ([]peer_discovery.Peer, []peer_discovery.Peer, string, error) {
+	var trackerPeers []peer_discovery.Peer
+	var announce string
+	for _, tracker := range trackers {
+		if tracker == "" {
+			continue
+		}
+		stub := *torrent
+		stub.Announce = tracker
+		peerList, err := peer_discovery.GetPeers(&stub, torrent.PeerID, torrent.Port)
+		if err != nil {
+			log.Printf("tracker [%s] failed: %v\n", tracker, err)
+			continue
+		}
+		trackerPeers = *peerList
+		announce = tracker
+		break
+	}
+
+	var dhtPeers []peer_discovery.Peer
+	if dhtServer != nil {
+		var err error
+		dhtPeers, err = dhtServer.Announce(torrent.InfoHash, torrent.Port)
+		if err != nil {
+			log.Printf("DHT lookup failed: %v\n", err)
+		}
+		log.Printf("DHT returned %d peers\n", len(dhtPeers))
+	}
+
+	if len(trackerPeers) == 0 && len(dhtPeers) == 0 {
+		return nil, nil, announce, errors.New("no peers found from trackers or DHT")
+	}
+	return trackerPeers, dhtPeers, announce, nil
+}
+
+// announceDHT announces the torrent on the DHT periodically and hands the
+// peers it finds to the connection manager, starting right away if immediate.
+func announceDHT(dhtServer *dht.Server, torrent *bencode.TorrentType, manager *networking.ConnectionManager, immediate bool, stop chan struct{}) {
+	ticker := time.NewTicker(dhtAnnounceInterval)
+	defer ticker.Stop()
+	for {
+		if immediate {
+			peers, err := dhtServer.Announce(torrent.InfoHash, torrent.Port)
+			if err != nil {
+				log.Printf("DHT lookup failed: %v\n", err)
+			}
+			log.Printf("DHT returned %d peers\n", len(peers))
+			manager.AddPeers(peers)
+		}
+		immediate = true
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func logTrackerStatus(announcer *peer_discovery.Announcer) {
+	for _, status := range announcer.Status() {
+		switch {
+		case status.LastAnnounce.IsZero():
+			log.Printf("tracker [%s] tier %d: not contacted\n", status.URL, status.Tier)
+		case status.LastError != nil:
+			log.Printf("tracker [%s] tier %d: failed at %v: %v\n", status.URL, status.Tier, status.LastAnnounce.Format(time.TimeOnly), status.LastError)
+		default:
+			log.Printf("tracker [%s] tier %d: announced at %v, %d peers\n", status.URL, status.Tier, status.LastAnnounce.Format(time.TimeOnly), status.Peers)
+		}
+	}
+}
+
+func loadTorrentFile(torrentPath string, peerID [20]byte, port uint16) (bencode.TorrentType, error) {
+	fileReader, err := os.Open(torrentPath)
+	if err != nil {
+		return bencode.TorrentType{}, err
+	}
+	defer fileReader.Close()
+
+	torrent, err := bencode.ParseTorrent(fileReader, torrentPath)
+	if err != nil {
+		return torrent, err
+	}
+
+	torrent.PeerID = peerID
+	torrent.Port = port
+	return torrent, nil
+}
+
+// loadMagnet finds peers for the link's infohash and fetches the info
+// dictionary from them before building the full torrent. Peers are dialed
+// with dialer like the ones of a download.
+func loadMagnet(uri string, peerID [20]byte, port uint16, dhtServer *dht.Server, dialer *networking.Dialer) (bencode.TorrentType, []peer_discovery.Peer, error) {
+	link, err := magnet.Parse(uri)
+	if err != nil {
+		return bencode.TorrentType{}, nil, err
+	}
+	if len(link.Trackers) == 0 && dhtServer == nil {
+		return bencode.TorrentType{}, nil, errors.New("magnet link has no trackers and DHT is disabled")
+	}
+
+	stub := bencode.TorrentType{InfoHash: link.InfoHash, PeerID: peerID, Port: port}
+	trackerPeers, dhtPeers, announce, err := findPeers(&stub, link.Trackers, dhtServer)
+	if err != nil {
+		return bencode.TorrentType{}, nil, err
+	}
+	peerList := peer_discovery.MergePeers(trackerPeers, dhtPeers)
+
+	log.Printf("Fetching metadata for %s from %d peers\n", link.DisplayName, len(peerList))
+	infoBytes, err := magnet.FetchMetadata(link, peerList, peerID, dialer.ForTorrent(link.InfoHash))
+	if err != nil {
+		return bencode.TorrentType{}, nil, err
+	}
+
+	torrent, err := bencode.ParseInfo(infoBytes, announce)
+	if err != nil {
+		return torrent, nil, err
+	}
+	torrent.Path = uri
+	if len(link.Trackers) > 0 {
+		torrent.AnnounceList = [][]string{link.Trackers}
+	}
+	torrent.PeerID = peerID
+	torrent.Port = port
+	if torrent.Private {
+		// Whether the torrent is private is only known once we have the info
+		// dictionary, from here on only its trackers may hand out peers
+		log.Printf("%s is private, dropping %d peers found on the DHT\n", torrent.Name, len(dhtPeers))
+		peerList = trackerPeers
+	}
+	return torrent, peerList, nil
+}
@@ -2,8 +2,6 @@ module GoTorrent
 
 go 1.25.5
 
-require (
-	github.com/TheTitanrain/w32 v0.0.0-20180517000239-4f5cfb03fabf // indirect
-	github.com/jackpal/bencode-go v1.0.2 // indirect
-	github.com/sqweek/dialog v0.0.0-20240226140203-065105509627 // indirect
-)
+require github.com/sqweek/dialog v0.0.0-20240226140203-065105509627
+
+require github.com/TheTitanrain/w32 v0.0.0-20180517000239-4f5cfb03fabf // indirect
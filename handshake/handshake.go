@@ -11,18 +11,53 @@ import (
 
 const handshakeWaitFactor = 5
 
+// Capability bits in the reserved bytes, counted from the left
+const extensionByte = 5
+const extensionBit = 0x10 // BEP 10 extension protocol
+const fastByte = 7
+const fastBit = 0x04 // BEP 6 fast extension
+const dhtByte = 7
+const dhtBit = 0x01 // BEP 5 DHT port message
+
+type Reserved [8]byte
+
 type Handshake struct {
 	Pstr     string
+	Reserved Reserved
 	InfoHash [20]byte
 	PeerID   [20]byte
 }
 
+func (reserved *Reserved) SupportsExtensions() bool {
+	return reserved[extensionByte]&extensionBit != 0
+}
+
+func (reserved *Reserved) SupportsFast() bool {
+	return reserved[fastByte]&fastBit != 0
+}
+
+func (reserved *Reserved) SupportsDHT() bool {
+	return reserved[dhtByte]&dhtBit != 0
+}
+
+func (reserved *Reserved) SetExtensions() {
+	reserved[extensionByte] |= extensionBit
+}
+
+func (reserved *Reserved) SetFast() {
+	reserved[fastByte] |= fastBit
+}
+
+func (reserved *Reserved) SetDHT() {
+	reserved[dhtByte] |= dhtBit
+}
+
 func (h *Handshake) serialize() []byte {
 	buf := make([]byte, len(h.Pstr)+49)
 	buf[0] = byte(len(h.Pstr))
 	curr := 1
 	curr += copy(buf[curr:], h.Pstr)
-	curr += copy(buf[curr:], make([]byte, 8)) // Reserved, flip to indicate ext supported
+	curr += copy(buf[curr:], h.Reserved[:])
 	curr += copy(buf[curr:], h.InfoHash[:])
 	curr += copy(buf[curr:], h.PeerID[:])
 	return buf
@@ -52,17 +87,19 @@ func deserializeHandshake(conn net.Conn) (*Handshake, error) {
 
 	h := Handshake{}
 	h.Pstr = string(handshakeBuf[0:pStrLen])
+	copy(h.Reserved[:], handshakeBuf[pStrLen:pStrLen+8])
 	copy(h.InfoHash[:], handshakeBuf[pStrLen+8:pStrLen+20+8])
 	copy(h.PeerID[:], handshakeBuf[pStrLen+8+20:])
 	return &h, nil
 }
 
-func DoHandshake(conn net.Conn, protocolID string, torrent *bencode.TorrentType) (*Handshake, error) {
+func DoHandshake(conn net.Conn, protocolID string, reserved Reserved, torrent *bencode.TorrentType) (*Handshake, error) {
 
 	handshake := Handshake{
-		protocolID,
-		torrent.InfoHash,
-		torrent.PeerID,
+		Pstr:     protocolID,
+		Reserved: reserved,
+		InfoHash: torrent.InfoHash,
+		PeerID:   torrent.PeerID,
 	}
 
 	conn.SetWriteDeadline(time.Now().Add(handshakeWaitFactor * time.Second))
@@ -87,3 +124,38 @@ func DoHandshake(conn net.Conn, protocolID string, torrent *bencode.TorrentType)
 
 	return handshakeResponse, nil
 }
+
+// ReceiveHandshake runs the handshake as the receiving side: the peer speaks
+// first and we only answer when lookup knows the infohash it asked for, with
+// the reserved bits for that torrent.
+func ReceiveHandshake(conn net.Conn, protocolID string, reserved func(torrent *bencode.TorrentType) Reserved, lookup func(infoHash [20]byte) (*bencode.TorrentType, bool)) (*Handshake, *bencode.TorrentType, error) {
+	request, err := deserializeHandshake(conn)
+	if err != nil {
+		return nil, nil, errors.New("handshake deserialize failed: " + err.Error())
+	}
+
+	if request.Pstr != protocolID {
+		return nil, nil, errors.New("invalid protocol identifier")
+	}
+
+	torrent, ok := lookup(request.InfoHash)
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown infohash %x", request.InfoHash)
+	}
+
+	handshake := Handshake{
+		Pstr:     protocolID,
+		Reserved: reserved(torrent),
+		InfoHash: torrent.InfoHash,
+		PeerID:   torrent.PeerID,
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(handshakeWaitFactor * time.Second))
+	defer conn.SetWriteDeadline(time.Time{})
+	_, err = conn.Write(handshake.serialize())
+	if err != nil {
+		return nil, nil, errors.New("handshake write failed: " + err.Error())
+	}
+
+	return request, torrent, nil
+}
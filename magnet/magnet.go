@@ -0,0 +1,79 @@
+package magnet
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const btihPrefix = "urn:btih:"
+
+type Link struct {
+	InfoHash    [20]byte
+	Trackers    []string
+	DisplayName string
+}
+
+func IsMagnet(uri string) bool {
+	return strings.HasPrefix(strings.ToLower(uri), "magnet:")
+}
+
+// Parse reads a magnet URI of the form magnet:?xt=urn:btih:<hash>&tr=<url>&dn=<name>.
+// The infohash may be given as 40 hex characters or 32 base32 characters.
+func Parse(uri string) (Link, error) {
+	link := Link{}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return link, err
+	}
+	if u.Scheme != "magnet" {
+		return link, fmt.Errorf("unsupported scheme %s", u.Scheme)
+	}
+
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return link, err
+	}
+
+	found := false
+	for _, xt := range query["xt"] {
+		if !strings.HasPrefix(strings.ToLower(xt), btihPrefix) {
+			continue
+		}
+		link.InfoHash, err = decodeInfoHash(xt[len(btihPrefix):])
+		if err != nil {
+			return link, err
+		}
+		found = true
+		break
+	}
+	if !found {
+		return link, errors.New("magnet link has no urn:btih exact topic")
+	}
+
+	link.Trackers = query["tr"]
+	link.DisplayName = query.Get("dn")
+	return link, nil
+}
+
+func decodeInfoHash(encoded string) ([20]byte, error) {
+	var infoHash [20]byte
+	var decoded []byte
+	var err error
+	switch len(encoded) {
+	case 40:
+		decoded, err = hex.DecodeString(encoded)
+	case 32:
+		decoded, err = base32.StdEncoding.DecodeString(strings.ToUpper(encoded))
+	default:
+		return infoHash, fmt.Errorf("invalid infohash length %d", len(encoded))
+	}
+	if err != nil {
+		return infoHash, err
+	}
+	copy(infoHash[:], decoded)
+	return infoHash, nil
+}
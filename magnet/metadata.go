@@ -0,0 +1,240 @@
+package magnet
+
+import (
+	"GoTorrent/bencode"
+	clientImport "GoTorrent/client"
+	"GoTorrent/handshake"
+	"GoTorrent/message"
+	"GoTorrent/peer_discovery"
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+/*
+See: https://www.bittorrent.org/beps/bep_0009.html
+The info dictionary is split into 16KiB pieces that are requested over the
+ut_metadata extension once the peer has told us its size.
+*/
+
+const metadataPieceSize = 16384
+const maxMetadataSize = 16 * 1024 * 1024
+const connectionWaitFactor = 5
+const metadataWaitFactor = 30
+const maxConcurrentFetches = 8
+
+// ID peers must use when sending ut_metadata messages to us
+const utMetadataID uint8 = 1
+
+const (
+	metadataRequest int64 = 0
+	metadataData    int64 = 1
+	metadataReject  int64 = 2
+)
+
+type metadataMessage struct {
+	MsgType   int64 `bencode:"msg_type"`
+	Piece     int64 `bencode:"piece"`
+	TotalSize int64 `bencode:"total_size,omitempty"`
+}
+
+type fetchResult struct {
+	info []byte
+	err  error
+}
+
+// FetchMetadata downloads the info dictionary for the link from the given
+// peers and returns its raw bytes once they match the link's infohash. Peers
+// are connected to with dial, the same way as for downloading, so the
+// transport and encryption settings apply.
+func FetchMetadata(link Link, peers []peer_discovery.Peer, peerID [20]byte, dial clientImport.DialFunc) ([]byte, error) {
+	if len(peers) == 0 {
+		return nil, errors.New("no peers to fetch metadata from")
+	}
+
+	peerQueue := make(chan peer_discovery.Peer, len(peers))
+	for _, peer := range peers {
+		peerQueue <- peer
+	}
+	close(peerQueue)
+
+	results := make(chan fetchResult, len(peers))
+	done := make(chan struct{})
+	defer close(done)
+
+	workers := min(maxConcurrentFetches, len(peers))
+	for i := 0; i < workers; i++ {
+		go func() {
+			for peer := range peerQueue {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				info, err := fetchFromPeer(peer, link.InfoHash, peerID, dial)
+				if err != nil {
+					err = fmt.Errorf("peer [%v]: %v", peer.GetTCPAddress(), err)
+				}
+				results <- fetchResult{info: info, err: err}
+			}
+		}()
+	}
+
+	var lastErr error
+	for range peers {
+		result := <-results
+		if result.err == nil {
+			return result.info, nil
+		}
+		log.Printf("metadata fetch failed: %v\n", result.err)
+		lastErr = result.err
+	}
+	return nil, fmt.Errorf("no peer provided metadata, last error: %v", lastErr)
+}
+
+func fetchFromPeer(peer peer_discovery.Peer, infoHash [20]byte, peerID [20]byte, dial clientImport.DialFunc) ([]byte, error) {
+	conn, err := dial(peer.GetTCPAddress(), connectionWaitFactor*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	torrent := bencode.TorrentType{InfoHash: infoHash, PeerID: peerID}
+	handshakeResponse, err := handshake.DoHandshake(conn, clientImport.ProtocolIdentifier, clientImport.LocalReserved(&torrent), &torrent)
+	if err != nil {
+		return nil, err
+	}
+	if !handshakeResponse.Reserved.SupportsExtensions() {
+		return nil, errors.New("peer does not support the extension protocol")
+	}
+
+	conn.SetDeadline(time.Now().Add(metadataWaitFactor * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	ourHandshake, err := message.CreateExtendedHandshake(&message.ExtendedHandshake{
+		M: map[string]int{"ut_metadata": int(utMetadataID)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(ourHandshake.Serialize())
+	if err != nil {
+		return nil, err
+	}
+
+	peerMetadataID, metadataSize, err := readMetadataSupport(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	numPieces := (metadataSize + metadataPieceSize - 1) / metadataPieceSize
+	for piece := 0; piece < numPieces; piece++ {
+		err = sendMetadataMessage(conn, peerMetadataID, metadataMessage{MsgType: metadataRequest, Piece: int64(piece)})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	info := make([]byte, metadataSize)
+	received := make([]bool, numPieces)
+	remaining := numPieces
+	for remaining > 0 {
+		msg, err := message.ReadMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil || msg.ID != message.MsgExtended {
+			continue
+		}
+		extendedID, payload, err := message.ParseExtended(msg)
+		if err != nil {
+			return nil, err
+		}
+		if extendedID != utMetadataID {
+			continue
+		}
+
+		metadataMsg, data, err := parseMetadataMessage(payload)
+		if err != nil {
+			return nil, err
+		}
+		switch metadataMsg.MsgType {
+		case metadataReject:
+			return nil, fmt.Errorf("peer rejected metadata piece %d", metadataMsg.Piece)
+		case metadataData:
+			piece := int(metadataMsg.Piece)
+			if piece < 0 || piece >= numPieces {
+				return nil, fmt.Errorf("metadata piece %d out of range", piece)
+			}
+			begin := piece * metadataPieceSize
+			expected := min(metadataPieceSize, metadataSize-begin)
+			if len(data) != expected {
+				return nil, fmt.Errorf("metadata piece %d has length %d, expected %d", piece, len(data), expected)
+			}
+			if !received[piece] {
+				copy(info[begin:], data)
+				received[piece] = true
+				remaining--
+			}
+		}
+	}
+
+	hash := sha1.Sum(info)
+	if hash != infoHash {
+		return nil, errors.New("metadata hash mismatch")
+	}
+	return info, nil
+}
+
+// readMetadataSupport waits for the peer's extension handshake and returns
+// its ut_metadata ID and the size of the info dictionary.
+func readMetadataSupport(conn net.Conn) (uint8, int, error) {
+	for {
+		msg, err := message.ReadMessage(conn)
+		if err != nil {
+			return 0, 0, err
+		}
+		if msg == nil || msg.ID != message.MsgExtended {
+			continue
+		}
+		extendedHandshake, err := message.ParseExtendedHandshake(msg)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		peerMetadataID, ok := extendedHandshake.M["ut_metadata"]
+		if !ok || peerMetadataID <= 0 || peerMetadataID > 255 {
+			return 0, 0, errors.New("peer does not support ut_metadata")
+		}
+		size := extendedHandshake.MetadataSize
+		if size <= 0 || size > maxMetadataSize {
+			return 0, 0, fmt.Errorf("invalid metadata size %d", size)
+		}
+		return uint8(peerMetadataID), int(size), nil
+	}
+}
+
+func sendMetadataMessage(conn net.Conn, peerMetadataID uint8, metadataMsg metadataMessage) error {
+	payload, err := bencode.Marshal(metadataMsg)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(message.CreateExtended(peerMetadataID, payload).Serialize())
+	return err
+}
+
+// parseMetadataMessage splits a ut_metadata payload into its bencoded header
+// and the raw piece data that follows it.
+func parseMetadataMessage(payload []byte) (metadataMessage, []byte, error) {
+	metadataMsg := metadataMessage{}
+	decoder := bencode.NewDecoder(bytes.NewReader(payload))
+	err := decoder.Decode(&metadataMsg)
+	if err != nil {
+		return metadataMsg, nil, err
+	}
+	return metadataMsg, payload[decoder.InputOffset():], nil
+}
@@ -3,25 +3,29 @@ package main
 import (
 	"GoTorrent/bencode"
 	"GoTorrent/networking"
-	"GoTorrent/peer_discovery"
 	"crypto/rand"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
-	"path/filepath"
-	"sync"
-	"sync/atomic"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
 )
 
-const portNum int = 7777
 const numWriters int = 3
+const completionPollInterval = 500 * time.Millisecond
+const resumeSaveInterval = 30 * time.Second
 
-func GeneratePeerID() ([20]byte, error) {
+func GeneratePeerID(prefix string) ([20]byte, error) {
 	var peerID [20]byte
 
-	copy(peerID[0:8], []byte("-GT0001-"))
+	prefixLen := copy(peerID[:], prefix)
 
-	_, err := rand.Read(peerID[8:])
+	_, err := rand.Read(peerID[prefixLen:])
 	if err != nil {
 		return peerID, err
 	}
@@ -30,79 +34,160 @@ func GeneratePeerID() ([20]byte, error) {
 }
 
 func main() {
-	peerID, err := GeneratePeerID()
-	if err != nil {
-		log.Fatal(err)
+	args := os.Args[1:]
+	command := "download"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command = args[0]
+		args = args[1:]
 	}
 
-	torrentPath, err := bencode.PickTorrent()
-	if err != nil {
-		log.Fatal(err)
+	switch command {
+	case "download":
+		opts, err := parseDownloadArgs(args)
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		download(opts)
+	case "create":
+		opts, err := parseCreateArgs(args)
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		err = create(opts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "help":
+		usage(os.Stdout)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", command)
+		usage(os.Stderr)
+		os.Exit(2)
 	}
+}
 
-	fileReader, err := os.Open(torrentPath)
-	if err != nil {
-		log.Fatal(err)
+// checkExistingData marks the pieces already on disk as complete, trusting the
+// resume file when it matches the data and hashing every piece otherwise.
+func checkExistingData(storage *networking.Storage, resumePath string, recheck bool) {
+	if resumePath != "" && !recheck {
+		err := storage.LoadResume(resumePath)
+		if err == nil {
+			log.Printf("loaded resume file %s\n", resumePath)
+			return
+		}
+		log.Printf("can't use resume file [%v]\n", err)
 	}
 
-	torrent, err := bencode.ParseTorrent(fileReader, torrentPath)
-	if err != nil {
-		log.Fatal(err)
+	log.Println("verifying existing data")
+	verified := storage.Verify(runtime.NumCPU())
+	log.Printf("verified %d of %d pieces\n", verified, storage.Torrent().NumPieces)
+}
+
+// filePriorities builds the priority of every file from the -skip, -low and
+// -high flags, nil if none were given so that every file is downloaded. The
+// files of a multi file torrent are listed with their indexes for the flags.
+func filePriorities(torrent *bencode.TorrentType, opts downloadOptions) ([]networking.Priority, error) {
+	priorities := make([]networking.Priority, len(torrent.Files))
+	for i := range priorities {
+		priorities[i] = networking.PriorityNormal
+	}
+	lists := []struct {
+		files    fileList
+		priority networking.Priority
+	}{
+		{opts.SkipFiles, networking.PrioritySkip},
+		{opts.LowFiles, networking.PriorityLow},
+		{opts.HighFiles, networking.PriorityHigh},
+	}
+	for _, list := range lists {
+		for _, index := range list.files {
+			if index >= len(priorities) {
+				return nil, fmt.Errorf("file index %d out of range, the torrent has %d files", index, len(priorities))
+			}
+			priorities[index] = list.priority
+		}
 	}
 
-	fileReader.Close()
+	if torrent.MultiFile {
+		for i, f := range torrent.Files {
+			log.Printf("file [%d] %s (%d bytes): %v\n", i, f.Path, f.Length, priorities[i])
+		}
+	}
+	if len(opts.SkipFiles)+len(opts.LowFiles)+len(opts.HighFiles) == 0 {
+		return nil, nil
+	}
+	return priorities, nil
+}
 
-	folder, err := bencode.PickDownloadPath()
-	if err != nil {
-		log.Fatal(err)
+func saveResumePeriodically(storage *networking.Storage, resumePath string, stop chan struct{}) {
+	ticker := time.NewTicker(resumeSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := storage.SaveResume(resumePath)
+			if err != nil {
+				log.Printf("failed to save resume file [%v]\n", err)
+			}
+		case <-stop:
+			return
+		}
 	}
-	savePath := filepath.Join(folder, torrent.Name)
+}
 
-	torrent.PeerID = peerID
-	peerList, err := peer_discovery.GetPeers(&torrent, peerID, uint16(portNum))
+func download(opts downloadOptions) {
+	err := opts.resolvePaths()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	workQueue, results := networking.ConstructWorkQueue(&torrent)
-	openFiles, err := bencode.OpenFiles(&torrent, savePath)
-
+	session, err := NewSession(opts)
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	var writeGroup sync.WaitGroup
-	var writtenPieces int64 = 0
-	var totalPieces = int64(torrent.NumPieces)
-	for i := 0; i < numWriters; i++ {
-		writeGroup.Add(1)
-		go networking.WritePieces(results, &torrent, openFiles, &writeGroup, &writtenPieces, &totalPieces)
+	defer session.Close()
+
+	var torrents []*SessionTorrent
+	for _, source := range opts.TorrentPaths {
+		sessionTorrent, err := session.Add(source)
+		if err != nil {
+			log.Printf("failed to add [%s]: %v\n", source, err)
+			continue
+		}
+		torrents = append(torrents, sessionTorrent)
+	}
+	if len(torrents) == 0 {
+		log.Println("no torrent to download")
+		return
 	}
 
-	var downloadedPieces int64 = 0
-	log.Printf("Total Pieces: %d\n", totalPieces)
+	allComplete := make(chan struct{})
 	go func() {
-		for {
-			if atomic.LoadInt64(&writtenPieces) == totalPieces {
-				close(workQueue)
-				return
-			}
+		for _, sessionTorrent := range torrents {
+			<-sessionTorrent.Completed()
 		}
+		close(allComplete)
 	}()
 
-	var torrentGroup sync.WaitGroup
-	for i, peer := range *peerList {
-		fmt.Printf("Peer [%v]: IP: %v, Port: %v\n", i, peer.IP, peer.Port)
-		torrentGroup.Add(1)
-		go networking.ConnectToPeer(peer, &torrent, &torrentGroup, workQueue, results, &downloadedPieces, &totalPieces)
-	}
-	torrentGroup.Wait()
-	log.Println("TORRENT GROUP DONE")
-	writeGroup.Wait()
-	log.Println("WRITE GROUP DONE")
-	close(results)
-
-	for _, file := range openFiles {
-		file.Close()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+
+	select {
+	case <-allComplete:
+		log.Println("DOWNLOAD COMPLETE")
+		if opts.Seed {
+			log.Println("Seeding, press Ctrl+C to stop")
+			<-interrupt
+		}
+	case <-interrupt:
 	}
 }
@@ -0,0 +1,53 @@
+package message
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+/*
+See: https://www.bittorrent.org/beps/bep_0006.html
+The fast extension is enabled when both peers set it in the handshake's
+reserved bits. Have All and Have None may replace the bitfield, every request
+is answered with either the piece or a Reject, choking no longer drops pending
+requests silently, and Allowed Fast names pieces that may be requested while
+choked. Suggest is a hint about which piece to download next.
+*/
+
+func CreateHaveAll() *Message {
+	return &Message{ID: MsgHaveAll, Payload: nil}
+}
+
+func CreateHaveNone() *Message {
+	return &Message{ID: MsgHaveNone, Payload: nil}
+}
+
+func CreateReject(requestIndex int, requestBegin int, requestLength int) *Message {
+	msg := CreateRequest(requestIndex, requestBegin, requestLength)
+	msg.ID = MsgReject
+	return msg
+}
+
+func CreateSuggest(index int) *Message {
+	msg := CreateHave(index)
+	msg.ID = MsgSuggest
+	return msg
+}
+
+func CreateAllowedFast(index int) *Message {
+	msg := CreateHave(index)
+	msg.ID = MsgAllowedFast
+	return msg
+}
+
+// ParseIndex reads the piece index of a have, suggest or allowed fast message
+func ParseIndex(m *Message) (int, error) {
+	if m.ID != MsgHave && m.ID != MsgSuggest && m.ID != MsgAllowedFast {
+		return 0, errors.New(fmt.Sprintf("expected message ID: %d, %d or %d, got: %d", MsgHave, MsgSuggest, MsgAllowedFast, m.ID))
+	}
+	if len(m.Payload) != 4 {
+		return 0, errors.New(fmt.Sprintf("expected payload length: %d, got: %d", 4, len(m.Payload)))
+	}
+	return int(binary.BigEndian.Uint32(m.Payload)), nil
+}
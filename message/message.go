@@ -1,6 +1,7 @@
 package message
 
 import (
+	"GoTorrent/bencode"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -22,8 +23,18 @@ const (
 	MsgRequest       messageID = 6
 	MsgPiece         messageID = 7
 	MsgCancel        messageID = 8
+	MsgPort          messageID = 9  // DHT port (BEP 5)
+	MsgSuggest       messageID = 13 // Fast extension (BEP 6)
+	MsgHaveAll       messageID = 14
+	MsgHaveNone      messageID = 15
+	MsgReject        messageID = 16
+	MsgAllowedFast   messageID = 17
+	MsgExtended      messageID = 20
 )
 
+// Extended message ID 0 is reserved for the extension handshake (BEP 10)
+const ExtHandshakeID uint8 = 0
+
 type Message struct {
 	ID      messageID
 	Payload []byte
@@ -111,10 +122,41 @@ func (m *Message) Name() string {
 		return "Piece"
 	case MsgCancel:
 		return "Cancel"
+	case MsgPort:
+		return "Port"
+	case MsgSuggest:
+		return "Suggest"
+	case MsgHaveAll:
+		return "HaveAll"
+	case MsgHaveNone:
+		return "HaveNone"
+	case MsgReject:
+		return "Reject"
+	case MsgAllowedFast:
+		return "AllowedFast"
+	case MsgExtended:
+		return "Extended"
 	}
 	return fmt.Sprintf("Unknown Message ID: %d", m.ID)
 }
 
+// CreatePort tells the peer the UDP port our DHT node listens on
+func CreatePort(port uint16) *Message {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, port)
+	return &Message{ID: MsgPort, Payload: payload}
+}
+
+func ParsePort(m *Message) (uint16, error) {
+	if m.ID != MsgPort {
+		return 0, errors.New(fmt.Sprintf("expected message ID: %d, got: %d", MsgPort, m.ID))
+	}
+	if len(m.Payload) != 2 {
+		return 0, errors.New(fmt.Sprintf("expected payload length: %d, got: %d", 2, len(m.Payload)))
+	}
+	return binary.BigEndian.Uint16(m.Payload), nil
+}
+
 func ParseHave(m *Message) (int, error) {
 	if m.ID != MsgHave {
 		return 0, errors.New(fmt.Sprintf("expected message ID: %d, got: %d", MsgHave, m.ID))
@@ -149,6 +191,19 @@ func ParsePiece(index int, buf []byte, m *Message) (int, error) {
 	return len(data), nil
 }
 
+// ParseBlock returns the piece index, offset and data of a piece message
+func ParseBlock(m *Message) (int, int, []byte, error) {
+	if m.ID != MsgPiece {
+		return 0, 0, nil, errors.New(fmt.Sprintf("expected message ID: %d, got: %d", MsgPiece, m.ID))
+	}
+	if len(m.Payload) < 8 {
+		return 0, 0, nil, errors.New(fmt.Sprintf("too short payload length: %d", len(m.Payload)))
+	}
+	index := int(binary.BigEndian.Uint32(m.Payload[0:4]))
+	begin := int(binary.BigEndian.Uint32(m.Payload[4:8]))
+	return index, begin, m.Payload[8:], nil
+}
+
 func ParseBitfield(m *Message) ([]byte, error) {
 	if m.ID != MsgBitfield {
 		return nil, errors.New(fmt.Sprintf("expected message ID: %d, got: %d", MsgBitfield, m.ID))
@@ -184,3 +239,134 @@ func CreateUnchoke() *Message {
 	msg := Message{ID: MsgUnchoke, Payload: nil}
 	return &msg
 }
+
+func CreateChoke() *Message {
+	msg := Message{ID: MsgChoke, Payload: nil}
+	return &msg
+}
+
+func CreateInterested() *Message {
+	msg := Message{ID: MsgInterested, Payload: nil}
+	return &msg
+}
+
+func CreateNotInterested() *Message {
+	msg := Message{ID: MsgNotInterested, Payload: nil}
+	return &msg
+}
+
+func CreateBitfield(bitfield []byte) *Message {
+	payload := make([]byte, len(bitfield))
+	copy(payload, bitfield)
+	return &Message{
+		ID:      MsgBitfield,
+		Payload: payload,
+	}
+}
+
+type BlockRequest struct {
+	Index  int
+	Begin  int
+	Length int
+}
+
+// ParseRequest reads the payload of a request, cancel or reject, they all use the same layout
+func ParseRequest(m *Message) (BlockRequest, error) {
+	if m.ID != MsgRequest && m.ID != MsgCancel && m.ID != MsgReject {
+		return BlockRequest{}, errors.New(fmt.Sprintf("expected message ID: %d, %d or %d, got: %d", MsgRequest, MsgCancel, MsgReject, m.ID))
+	}
+	if len(m.Payload) != 12 {
+		return BlockRequest{}, errors.New(fmt.Sprintf("expected payload length: %d, got: %d", 12, len(m.Payload)))
+	}
+	return BlockRequest{
+		Index:  int(binary.BigEndian.Uint32(m.Payload[0:4])),
+		Begin:  int(binary.BigEndian.Uint32(m.Payload[4:8])),
+		Length: int(binary.BigEndian.Uint32(m.Payload[8:12])),
+	}, nil
+}
+
+func CreateCancel(requestIndex int, requestBegin int, requestLength int) *Message {
+	msg := CreateRequest(requestIndex, requestBegin, requestLength)
+	msg.ID = MsgCancel
+	return msg
+}
+
+func CreatePiece(index int, begin int, data []byte) *Message {
+	payload := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], data)
+	return &Message{
+		ID:      MsgPiece,
+		Payload: payload,
+	}
+}
+
+// ExtendedHandshake is the bencoded payload of extended message 0. M maps
+// extension names to the message IDs the sender wants to receive them on.
+type ExtendedHandshake struct {
+	M            map[string]int `bencode:"m"`
+	V            string         `bencode:"v,omitempty"`      // client name and version
+	P            int64          `bencode:"p,omitempty"`      // sender's listen port
+	Reqq         int64          `bencode:"reqq,omitempty"`   // outstanding requests the sender accepts
+	YourIP       string         `bencode:"yourip,omitempty"` // receiver's IP as seen by the sender, compact form
+	MetadataSize int64          `bencode:"metadata_size,omitempty"`
+}
+
+func CompactIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return string(ip4)
+	}
+	return string(ip.To16())
+}
+
+func (handshake *ExtendedHandshake) ReportedIP() net.IP {
+	if len(handshake.YourIP) != net.IPv4len && len(handshake.YourIP) != net.IPv6len {
+		return nil
+	}
+	return net.IP(handshake.YourIP)
+}
+
+func CreateExtended(extendedID uint8, payload []byte) *Message {
+	buf := make([]byte, len(payload)+1)
+	buf[0] = extendedID
+	copy(buf[1:], payload)
+	return &Message{
+		ID:      MsgExtended,
+		Payload: buf,
+	}
+}
+
+func ParseExtended(m *Message) (uint8, []byte, error) {
+	if m.ID != MsgExtended {
+		return 0, nil, errors.New(fmt.Sprintf("expected message ID: %d, got: %d", MsgExtended, m.ID))
+	}
+	if len(m.Payload) < 1 {
+		return 0, nil, errors.New("extended message is missing its extended ID")
+	}
+	return m.Payload[0], m.Payload[1:], nil
+}
+
+func CreateExtendedHandshake(handshake *ExtendedHandshake) (*Message, error) {
+	payload, err := bencode.Marshal(*handshake)
+	if err != nil {
+		return nil, err
+	}
+	return CreateExtended(ExtHandshakeID, payload), nil
+}
+
+func ParseExtendedHandshake(m *Message) (*ExtendedHandshake, error) {
+	extendedID, payload, err := ParseExtended(m)
+	if err != nil {
+		return nil, err
+	}
+	if extendedID != ExtHandshakeID {
+		return nil, errors.New(fmt.Sprintf("expected extended ID: %d, got: %d", ExtHandshakeID, extendedID))
+	}
+	handshake := ExtendedHandshake{}
+	err = bencode.Unmarshal(payload, &handshake)
+	if err != nil {
+		return nil, err
+	}
+	return &handshake, nil
+}
@@ -0,0 +1,52 @@
+package mse
+
+import (
+	"bufio"
+	"crypto/rc4"
+	"net"
+	"sync"
+)
+
+// Conn is a peer connection after the encryption handshake. Reads return the
+// initial payload first, then decrypt the stream; writes are encrypted. When
+// plaintext was negotiated the ciphers are nil and only the handshake bytes
+// still buffered are replayed. Deadlines apply to the underlying connection.
+type Conn struct {
+	net.Conn
+	reader     *bufio.Reader
+	decrypt    *rc4.Cipher
+	encrypt    *rc4.Cipher
+	initial    []byte // initial payload sent with the handshake, already decrypted
+	writeMutex sync.Mutex
+}
+
+// Encrypted reports whether the stream is RC4 encrypted, as opposed to only
+// its handshake
+func (conn *Conn) Encrypted() bool {
+	return conn.encrypt != nil
+}
+
+func (conn *Conn) Read(b []byte) (int, error) {
+	if len(conn.initial) > 0 {
+		n := copy(b, conn.initial)
+		conn.initial = conn.initial[n:]
+		return n, nil
+	}
+	n, err := conn.reader.Read(b)
+	if conn.decrypt != nil {
+		conn.decrypt.XORKeyStream(b[:n], b[:n])
+	}
+	return n, err
+}
+
+// Write encrypts a copy of b, the caller's buffer is left untouched
+func (conn *Conn) Write(b []byte) (int, error) {
+	if conn.encrypt == nil {
+		return conn.Conn.Write(b)
+	}
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+	buf := make([]byte, len(b))
+	conn.encrypt.XORKeyStream(buf, b)
+	return conn.Conn.Write(buf)
+}
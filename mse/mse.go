@@ -0,0 +1,367 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"time"
+)
+
+/*
+See: https://wiki.vuze.com/w/Message_Stream_Encryption
+Message stream encryption hides the BitTorrent handshake from traffic shaping.
+A is the side that connects, B the side that accepts:
+
+	1 A->B: Diffie Hellman Ya, PadA
+	2 B->A: Diffie Hellman Yb, PadB
+	3 A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S),
+	        ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	4 B->A: ENCRYPT(VC, crypto_select, len(PadD), PadD), ENCRYPT2(Payload Stream)
+	5 A->B: ENCRYPT2(Payload Stream)
+
+S is the shared secret and SKEY the infohash, which B recovers from the req2
+hash by trying every torrent it serves. ENCRYPT is RC4 keyed with
+HASH('keyA', S, SKEY) for A's stream and HASH('keyB', S, SKEY) for B's, with
+the first 1024 bytes of keystream discarded. ENCRYPT2 is the same RC4 stream
+when RC4 was selected, or plaintext when only the handshake is obfuscated.
+VC is 8 zero bytes, which lets A find where PadB ends.
+*/
+
+const primeHex = "FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563"
+const generator = 2
+const keySize = 96        // bytes of a public key or the shared secret
+const privateKeySize = 20 // 160 bit private keys, as the spec recommends
+const maxPadSize = 512
+const rc4Discard = 1024
+const handshakeTimeout = 10
+
+const (
+	CryptoPlaintext uint32 = 0x01
+	CryptoRC4       uint32 = 0x02
+)
+
+var prime, _ = new(big.Int).SetString(primeHex, 16)
+var verificationConstant = make([]byte, 8)
+var plaintextPrefix = append([]byte{19}, "BitTorrent protocol"...)
+
+// Policy decides whether peer connections are encrypted
+type Policy int
+
+const (
+	PolicyDisabled Policy = iota // plaintext only, encrypted peers are refused
+	PolicyPrefer                 // encrypt when the peer can, plaintext otherwise
+	PolicyRequire                // RC4 encrypted streams only
+)
+
+func ParsePolicy(name string) (Policy, error) {
+	switch name {
+	case "disabled":
+		return PolicyDisabled, nil
+	case "prefer":
+		return PolicyPrefer, nil
+	case "require":
+		return PolicyRequire, nil
+	}
+	return PolicyDisabled, fmt.Errorf("unknown encryption policy %q, expected disabled, prefer or require", name)
+}
+
+func (policy Policy) String() string {
+	switch policy {
+	case PolicyPrefer:
+		return "prefer"
+	case PolicyRequire:
+		return "require"
+	}
+	return "disabled"
+}
+
+// crypto returns the methods the policy accepts for the payload stream
+func (policy Policy) crypto() uint32 {
+	if policy == PolicyRequire {
+		return CryptoRC4
+	}
+	return CryptoRC4 | CryptoPlaintext
+}
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+func newCipher(name string, secret []byte, infoHash [20]byte) *rc4.Cipher {
+	cipher, _ := rc4.NewCipher(hash([]byte(name), secret, infoHash[:]))
+	discard := make([]byte, rc4Discard)
+	cipher.XORKeyStream(discard, discard)
+	return cipher
+}
+
+func leftPad(b []byte, size int) []byte {
+	padded := make([]byte, size)
+	copy(padded[size-len(b):], b)
+	return padded
+}
+
+// keyPair generates a private key and the public key sent to the peer
+func keyPair() (*big.Int, []byte, error) {
+	privateBytes := make([]byte, privateKeySize)
+	_, err := rand.Read(privateBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	private := new(big.Int).SetBytes(privateBytes)
+	public := new(big.Int).Exp(big.NewInt(generator), private, prime)
+	return private, leftPad(public.Bytes(), keySize), nil
+}
+
+func sharedSecret(private *big.Int, peerPublic []byte) ([]byte, error) {
+	y := new(big.Int).SetBytes(peerPublic)
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(prime) >= 0 {
+		return nil, errors.New("invalid public key")
+	}
+	return leftPad(new(big.Int).Exp(y, private, prime).Bytes(), keySize), nil
+}
+
+func randomPad() ([]byte, error) {
+	var length [2]byte
+	_, err := rand.Read(length[:])
+	if err != nil {
+		return nil, err
+	}
+	pad := make([]byte, int(binary.BigEndian.Uint16(length[:]))%(maxPadSize+1))
+	_, err = rand.Read(pad)
+	return pad, err
+}
+
+// syncTo reads until the stream has produced marker, which must end within
+// limit bytes
+func syncTo(reader *bufio.Reader, marker []byte, limit int) error {
+	window := make([]byte, 0, limit)
+	for len(window) < limit {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, b)
+		if bytes.HasSuffix(window, marker) {
+			return nil
+		}
+	}
+	return errors.New("encryption handshake out of sync")
+}
+
+// readDecrypted reads n bytes of the handshake and decrypts them
+func readDecrypted(reader *bufio.Reader, cipher *rc4.Cipher, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	_, err := io.ReadFull(reader, buf)
+	if err != nil {
+		return nil, err
+	}
+	cipher.XORKeyStream(buf, buf)
+	return buf, nil
+}
+
+// Initiate runs the encryption handshake on a connection we opened, offering
+// the methods the policy allows. The BitTorrent handshake is sent afterwards
+// through the returned connection.
+func Initiate(conn net.Conn, infoHash [20]byte, policy Policy) (*Conn, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	private, public, err := keyPair()
+	if err != nil {
+		return nil, err
+	}
+	padA, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(append(public, padA...))
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	peerPublic := make([]byte, keySize)
+	_, err = io.ReadFull(reader, peerPublic)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := sharedSecret(private, peerPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypt := newCipher("keyA", secret, infoHash)
+	decrypt := newCipher("keyB", secret, infoHash)
+	skeyHash := hash([]byte("req2"), infoHash[:])
+	for i, b := range hash([]byte("req3"), secret) {
+		skeyHash[i] ^= b
+	}
+	// VC, crypto_provide, len(PadC) = 0, len(IA) = 0
+	header := make([]byte, 16)
+	binary.BigEndian.PutUint32(header[8:12], policy.crypto())
+	encrypt.XORKeyStream(header, header)
+
+	msg := hash([]byte("req1"), secret)
+	msg = append(msg, skeyHash...)
+	msg = append(msg, header...)
+	_, err = conn.Write(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	// B's VC is the first thing after PadB, find it by what it encrypts to
+	encryptedVC := make([]byte, len(verificationConstant))
+	decrypt.XORKeyStream(encryptedVC, verificationConstant)
+	err = syncTo(reader, encryptedVC, maxPadSize+len(encryptedVC))
+	if err != nil {
+		return nil, err
+	}
+	reply, err := readDecrypted(reader, decrypt, 6)
+	if err != nil {
+		return nil, err
+	}
+	selected := binary.BigEndian.Uint32(reply[:4])
+	_, err = readDecrypted(reader, decrypt, int(binary.BigEndian.Uint16(reply[4:6])))
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case selected == CryptoRC4 && policy.crypto()&CryptoRC4 != 0:
+		return &Conn{Conn: conn, reader: reader, encrypt: encrypt, decrypt: decrypt}, nil
+	case selected == CryptoPlaintext && policy.crypto()&CryptoPlaintext != 0:
+		return &Conn{Conn: conn, reader: reader}, nil
+	}
+	return nil, fmt.Errorf("peer selected unsupported crypto method %#x", selected)
+}
+
+// Accept sets up a connection a peer opened to us. A plaintext BitTorrent
+// handshake is let through unless the policy requires encryption. Anything
+// else is taken as an encryption handshake for one of the infohashes, which
+// the policy must allow. The returned connection reads the BitTorrent
+// handshake from the start either way.
+func Accept(conn net.Conn, policy Policy, infoHashes func() [][20]byte) (*Conn, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	prefix, err := reader.Peek(len(plaintextPrefix))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(prefix, plaintextPrefix) {
+		if policy == PolicyRequire {
+			return nil, errors.New("plaintext connection refused, encryption is required")
+		}
+		return &Conn{Conn: conn, reader: reader}, nil
+	}
+	if policy == PolicyDisabled {
+		return nil, errors.New("encrypted connection refused, encryption is disabled")
+	}
+
+	peerPublic := make([]byte, keySize)
+	_, err = io.ReadFull(reader, peerPublic)
+	if err != nil {
+		return nil, err
+	}
+	private, public, err := keyPair()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := sharedSecret(private, peerPublic)
+	if err != nil {
+		return nil, err
+	}
+	padB, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(append(public, padB...))
+	if err != nil {
+		return nil, err
+	}
+
+	err = syncTo(reader, hash([]byte("req1"), secret), maxPadSize+sha1.Size)
+	if err != nil {
+		return nil, err
+	}
+	skeyHash := make([]byte, sha1.Size)
+	_, err = io.ReadFull(reader, skeyHash)
+	if err != nil {
+		return nil, err
+	}
+	for i, b := range hash([]byte("req3"), secret) {
+		skeyHash[i] ^= b
+	}
+	infoHash, ok := findInfoHash(skeyHash, infoHashes())
+	if !ok {
+		return nil, errors.New("encrypted connection for an unknown torrent")
+	}
+
+	decrypt := newCipher("keyA", secret, infoHash)
+	encrypt := newCipher("keyB", secret, infoHash)
+	header, err := readDecrypted(reader, decrypt, 14)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:8], verificationConstant) {
+		return nil, errors.New("invalid verification constant")
+	}
+	provided := binary.BigEndian.Uint32(header[8:12])
+	_, err = readDecrypted(reader, decrypt, int(binary.BigEndian.Uint16(header[12:14])))
+	if err != nil {
+		return nil, err
+	}
+	iaLength, err := readDecrypted(reader, decrypt, 2)
+	if err != nil {
+		return nil, err
+	}
+	initial, err := readDecrypted(reader, decrypt, int(binary.BigEndian.Uint16(iaLength)))
+	if err != nil {
+		return nil, err
+	}
+
+	var selected uint32
+	switch accepted := provided & policy.crypto(); {
+	case accepted&CryptoRC4 != 0:
+		selected = CryptoRC4
+	case accepted&CryptoPlaintext != 0:
+		selected = CryptoPlaintext
+	default:
+		return nil, fmt.Errorf("no acceptable crypto method in %#x", provided)
+	}
+	// VC, crypto_select, len(PadD) = 0
+	reply := make([]byte, 14)
+	binary.BigEndian.PutUint32(reply[8:12], selected)
+	encrypt.XORKeyStream(reply, reply)
+	_, err = conn.Write(reply)
+	if err != nil {
+		return nil, err
+	}
+
+	if selected == CryptoPlaintext {
+		return &Conn{Conn: conn, reader: reader, initial: initial}, nil
+	}
+	return &Conn{Conn: conn, reader: reader, encrypt: encrypt, decrypt: decrypt, initial: initial}, nil
+}
+
+func findInfoHash(skeyHash []byte, infoHashes [][20]byte) ([20]byte, bool) {
+	for _, infoHash := range infoHashes {
+		if bytes.Equal(hash([]byte("req2"), infoHash[:]), skeyHash) {
+			return infoHash, true
+		}
+	}
+	return [20]byte{}, false
+}
@@ -0,0 +1,193 @@
+package networking
+
+import (
+	"GoTorrent/bencode"
+	clientImport "GoTorrent/client"
+	"GoTorrent/handshake"
+	"GoTorrent/mse"
+	"GoTorrent/utp"
+	"errors"
+	"log"
+	"net"
+	"sync"
+)
+
+// Listener accepts incoming peer connections and hands each one to the
+// connection manager of the torrent named in its handshake.
+type Listener struct {
+	listeners  []net.Listener
+	utp        *utp.Socket
+	mutex      sync.RWMutex
+	managers   map[[20]byte]*ConnectionManager
+	encryption mse.Policy
+}
+
+// Listen accepts peers on address. Without a host it listens on IPv4 and
+// IPv6 separately, so both work even where IPv6 sockets don't accept IPv4
+// connections. Only one of the two has to succeed. uTP peers are accepted on
+// the UDP port with the same number, when it is free.
+func Listen(address string) (*Listener, error) {
+	listener := Listener{managers: make(map[[20]byte]*ConnectionManager)}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if host != "" {
+		tcpListener, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		listener.listeners = append(listener.listeners, tcpListener)
+		listener.listenUTP("udp", tcpListener.Addr().String())
+		return &listener, nil
+	}
+
+	var listenErr error
+	for _, network := range []string{"tcp4", "tcp6"} {
+		tcpListener, err := net.Listen(network, net.JoinHostPort("", port))
+		if err != nil {
+			listenErr = err
+			continue
+		}
+		listener.listeners = append(listener.listeners, tcpListener)
+		// With port 0 the second listener takes the port the first was given
+		_, port, _ = net.SplitHostPort(tcpListener.Addr().String())
+	}
+	if len(listener.listeners) == 0 {
+		return nil, listenErr
+	}
+	// IPv4 only, the socket is shared with the DHT which only speaks IPv4
+	listener.listenUTP("udp4", net.JoinHostPort("", port))
+	return &listener, nil
+}
+
+func (listener *Listener) listenUTP(network string, address string) {
+	socket, err := utp.Listen(network, address)
+	if err != nil {
+		log.Printf("not accepting uTP peers: %v\n", err)
+		return
+	}
+	listener.utp = socket
+	listener.listeners = append(listener.listeners, socket)
+}
+
+// UTP returns the socket uTP peers connect to, nil when it couldn't be opened.
+// Outgoing uTP connections use it too, so peers see our listening port.
+func (listener *Listener) UTP() *utp.Socket {
+	return listener.utp
+}
+
+func (listener *Listener) Addr() net.Addr {
+	return listener.listeners[0].Addr()
+}
+
+// SetEncryption decides which incoming connections are accepted: plaintext
+// only, both plaintext and encrypted, or encrypted only
+func (listener *Listener) SetEncryption(policy mse.Policy) {
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+	listener.encryption = policy
+}
+
+func (listener *Listener) Register(manager *ConnectionManager) {
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+	listener.managers[manager.Torrent().InfoHash] = manager
+}
+
+func (listener *Listener) Unregister(infoHash [20]byte) {
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+	delete(listener.managers, infoHash)
+}
+
+func (listener *Listener) infoHashes() [][20]byte {
+	listener.mutex.RLock()
+	defer listener.mutex.RUnlock()
+	infoHashes := make([][20]byte, 0, len(listener.managers))
+	for infoHash := range listener.managers {
+		infoHashes = append(infoHashes, infoHash)
+	}
+	return infoHashes
+}
+
+func (listener *Listener) manager(infoHash [20]byte) (*ConnectionManager, bool) {
+	listener.mutex.RLock()
+	defer listener.mutex.RUnlock()
+	manager, ok := listener.managers[infoHash]
+	return manager, ok
+}
+
+// Serve accepts connections until the listener is closed
+func (listener *Listener) Serve() error {
+	errs := make(chan error, len(listener.listeners))
+	for _, acceptor := range listener.listeners {
+		go func() {
+			errs <- listener.accept(acceptor)
+		}()
+	}
+
+	var err error
+	for range listener.listeners {
+		acceptErr := <-errs
+		if acceptErr != nil && err == nil {
+			err = acceptErr
+			listener.Close()
+		}
+	}
+	return err
+}
+
+func (listener *Listener) accept(acceptor net.Listener) error {
+	for {
+		conn, err := acceptor.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go listener.handle(conn)
+	}
+}
+
+func (listener *Listener) Close() error {
+	var err error
+	for _, acceptor := range listener.listeners {
+		closeErr := acceptor.Close()
+		if closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (listener *Listener) handle(rawConn net.Conn) {
+	listener.mutex.RLock()
+	policy := listener.encryption
+	listener.mutex.RUnlock()
+	conn, err := mse.Accept(rawConn, policy, listener.infoHashes)
+	if err != nil {
+		log.Printf("rejected incoming connection from [%v]: %v\n", rawConn.RemoteAddr(), err)
+		rawConn.Close()
+		return
+	}
+
+	var manager *ConnectionManager
+	lookup := func(infoHash [20]byte) (*bencode.TorrentType, bool) {
+		var ok bool
+		manager, ok = listener.manager(infoHash)
+		if !ok {
+			return nil, false
+		}
+		return manager.Torrent(), true
+	}
+
+	peerHandshake, _, err := handshake.ReceiveHandshake(conn, clientImport.ProtocolIdentifier, clientImport.LocalReserved, lookup)
+	if err != nil {
+		log.Printf("rejected incoming connection from [%v]: %v\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	manager.Accept(conn, peerHandshake)
+}
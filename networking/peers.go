@@ -0,0 +1,342 @@
+package networking
+
+import (
+	"GoTorrent/bencode"
+	clientImport "GoTorrent/client"
+	"GoTorrent/handshake"
+	"GoTorrent/peer_discovery"
+	"GoTorrent/ratelimit"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const DefaultMaxConnections = 50
+
+// ConnectionLimiter caps the number of open peer connections. One limiter is
+// shared by dialed and accepted connections.
+type ConnectionLimiter struct {
+	slots chan struct{}
+}
+
+func NewConnectionLimiter(maxConnections int) *ConnectionLimiter {
+	return &ConnectionLimiter{slots: make(chan struct{}, maxConnections)}
+}
+
+// Acquire waits for a free slot, it returns false if cancel is closed first
+func (limiter *ConnectionLimiter) Acquire(cancel <-chan struct{}) bool {
+	select {
+	case limiter.slots <- struct{}{}:
+		return true
+	case <-cancel:
+		return false
+	}
+}
+
+func (limiter *ConnectionLimiter) TryAcquire() bool {
+	select {
+	case limiter.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (limiter *ConnectionLimiter) Release() {
+	<-limiter.slots
+}
+
+// ConnectionManager runs the download and upload loop for every peer of one
+// torrent, whether we dialed the peer or it connected to us.
+type ConnectionManager struct {
+	torrent   *bencode.TorrentType
+	scheduler *Scheduler
+	results   chan *WorkResults
+	uploader  *Uploader
+	limiter   *ConnectionLimiter
+	dialer    *Dialer
+	rates     *ratelimit.TorrentLimits // nil for unlimited
+	mutex     sync.Mutex
+	idle      *sync.Cond
+	active    int
+	addresses map[string]bool                   // peers being dialed or connected to
+	peerIDs   map[[20]byte]bool                 // peers with a running connection
+	clients   map[*clientImport.Client]struct{} // connections Close closes
+	closed    bool
+	done      chan struct{} // closed by Close
+}
+
+func NewConnectionManager(torrent *bencode.TorrentType, scheduler *Scheduler, results chan *WorkResults, uploader *Uploader, limiter *ConnectionLimiter, dialer *Dialer, rates *ratelimit.TorrentLimits) *ConnectionManager {
+	manager := ConnectionManager{
+		torrent:   torrent,
+		scheduler: scheduler,
+		results:   results,
+		uploader:  uploader,
+		limiter:   limiter,
+		dialer:    dialer,
+		rates:     rates,
+		addresses: make(map[string]bool),
+		peerIDs:   make(map[[20]byte]bool),
+		clients:   make(map[*clientImport.Client]struct{}),
+		done:      make(chan struct{}),
+	}
+	manager.idle = sync.NewCond(&manager.mutex)
+	return &manager
+}
+
+func (manager *ConnectionManager) Torrent() *bencode.TorrentType {
+	return manager.torrent
+}
+
+// AddPeers dials every peer we are not already connected to. Dials wait for a
+// free connection slot.
+func (manager *ConnectionManager) AddPeers(peers []peer_discovery.Peer) {
+	for _, peer := range peers {
+		address := peer.GetTCPAddress()
+		manager.mutex.Lock()
+		if manager.closed || manager.addresses[address] {
+			manager.mutex.Unlock()
+			continue
+		}
+		manager.addresses[address] = true
+		manager.active++
+		manager.mutex.Unlock()
+
+		go manager.connect(peer)
+	}
+}
+
+// Accept takes over a connection the listener received a handshake on
+func (manager *ConnectionManager) Accept(conn net.Conn, peerHandshake *handshake.Handshake) {
+	if !manager.limiter.TryAcquire() {
+		log.Printf("connection limit reached, dropping peer [%v]\n", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	defer manager.limiter.Release()
+
+	manager.mutex.Lock()
+	if manager.closed {
+		manager.mutex.Unlock()
+		conn.Close()
+		return
+	}
+	manager.active++
+	manager.mutex.Unlock()
+	defer manager.finish("")
+
+	conn = manager.rates.Conn(conn)
+	client, err := clientImport.NewFromConn(conn, manager.torrent, peerHandshake, manager.uploader.Bitfield())
+	if err != nil {
+		log.Printf("failed to set up incoming peer [%v]: %v\n", conn.RemoteAddr(), err)
+		return
+	}
+	log.Printf("accepted client from peer [%v]\n", client.Peer.GetTCPAddress())
+	manager.runPeer(client)
+}
+
+// Wait blocks until no connection is running or waiting to be dialed
+func (manager *ConnectionManager) Wait() {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	for manager.active > 0 {
+		manager.idle.Wait()
+	}
+}
+
+// Close disconnects every peer and refuses new ones. Dials waiting for a slot
+// give up, those in progress once they connect. Wait returns when they are done.
+func (manager *ConnectionManager) Close() {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	if !manager.closed {
+		close(manager.done)
+	}
+	manager.closed = true
+	for client := range manager.clients {
+		client.Conn.Close()
+	}
+}
+
+func (manager *ConnectionManager) finish(address string) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	if address != "" {
+		delete(manager.addresses, address)
+	}
+	manager.active--
+	if manager.active == 0 {
+		manager.idle.Broadcast()
+	}
+}
+
+func (manager *ConnectionManager) connect(peer peer_discovery.Peer) {
+	address := peer.GetTCPAddress()
+	defer manager.finish(address)
+	if !manager.limiter.Acquire(manager.done) {
+		return
+	}
+	defer manager.limiter.Release()
+
+	dial := manager.dialer.ForTorrent(manager.torrent.InfoHash)
+	limitedDial := func(address string, timeout time.Duration) (net.Conn, error) {
+		conn, err := dial(address, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return manager.rates.Conn(conn), nil
+	}
+
+	var client *clientImport.Client
+	var err error
+	for i := 0; i < clientCreationRetries; i++ {
+		client, err = clientImport.New(peer, manager.torrent, manager.uploader.Bitfield(), limitedDial)
+		if err != nil {
+			log.Printf("retry create client [%v]\n", err)
+			time.Sleep(clientCreationTimeout * time.Second)
+			continue
+		}
+		break
+	}
+	if err != nil {
+		log.Printf("failed to create client [%v]\n", err)
+		return
+	}
+
+	log.Printf("created client with peer [%v]\n", address)
+	manager.runPeer(client)
+}
+
+// register refuses a second connection to the same peer and connections to ourselves
+func (manager *ConnectionManager) register(client *clientImport.Client) bool {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	peerID := client.PeerID()
+	if manager.closed || peerID == manager.torrent.PeerID || manager.peerIDs[peerID] {
+		return false
+	}
+	manager.peerIDs[peerID] = true
+	manager.clients[client] = struct{}{}
+	return true
+}
+
+func (manager *ConnectionManager) unregister(client *clientImport.Client) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	delete(manager.peerIDs, client.PeerID())
+	delete(manager.clients, client)
+}
+
+// interesting reports whether the peer has a piece we are still missing
+func interesting(client *clientImport.Client, have clientImport.Bitfield) bool {
+	for _, index := range client.Bitfield.Pieces() {
+		if !have.HasPiece(index) {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForWork reads the next message from a peer that has no piece for us,
+// returning early without error when the scheduler wakes the peer.
+func (manager *ConnectionManager) waitForWork(client *clientImport.Client) error {
+	if client.AmInterested && !interesting(client, manager.uploader.Bitfield()) {
+		err := client.SendNotInterested()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := client.WaitForMessage()
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	manager.scheduler.StopWaiting(client)
+
+	workProgress := WorkProgress{
+		Index:  -1,
+		Client: client,
+	}
+	err = workProgress.ReadMessage()
+	if err != nil {
+		return err
+	}
+	manager.scheduler.UpdatePeer(client)
+	return manager.uploader.Serve(client)
+}
+
+func (manager *ConnectionManager) runPeer(client *clientImport.Client) {
+	defer client.Conn.Close()
+	if !manager.register(client) {
+		log.Printf("already connected to peer [%v]\n", client.Peer.GetTCPAddress())
+		return
+	}
+	defer manager.unregister(client)
+
+	uploader := manager.uploader
+	uploader.Add(client)
+	defer uploader.Remove(client)
+	scheduler := manager.scheduler
+	scheduler.AddPeer(client)
+	defer scheduler.RemovePeer(client)
+
+	for !scheduler.Closed() {
+		state := scheduler.next(client)
+		if state == nil {
+			err := manager.waitForWork(client)
+			if err != nil {
+				log.Printf("peer [%v] disconnected while waiting for work: %v\n", client.Peer.GetTCPAddress(), err)
+				return
+			}
+			continue
+		}
+		work := state.work
+
+		if !client.AmInterested {
+			err := client.SendInterested()
+			if err != nil {
+				log.Printf("failed to send interested [%v]\n", err)
+				scheduler.release(state, client)
+				return
+			}
+		}
+
+		buf, finished, err := attemptPieceDownload(client, state, uploader, scheduler)
+		if err != nil {
+			log.Printf("failed to download piece [%d], %v\n", work.Index, err)
+			scheduler.release(state, client)
+			return
+		}
+		if !finished {
+			scheduler.release(state, client)
+			continue
+		}
+
+		err = compareHash(work, buf)
+		if err != nil {
+			log.Printf("failed hash check [%d]\n", work.Index)
+			scheduler.releaseFailed(state, client)
+			continue
+		}
+
+		manager.results <- &WorkResults{PieceIndex: work.Index, Buf: buf}
+		scheduler.release(state, client)
+	}
+
+	if !uploader.Seed {
+		return
+	}
+	if client.AmInterested {
+		err := client.SendNotInterested()
+		if err != nil {
+			return
+		}
+	}
+	seed(client, uploader)
+}
@@ -0,0 +1,272 @@
+package networking
+
+import (
+	clientImport "GoTorrent/client"
+	"sync"
+	"time"
+)
+
+// pieceState collects the blocks of one piece. Normally a single peer
+// downloads a piece, in endgame mode several peers share one pieceState and
+// each block is taken from whichever peer delivers it first.
+type pieceState struct {
+	work        *Work
+	mutex       sync.Mutex
+	buf         []byte
+	received    []bool
+	remaining   int
+	complete    bool
+	outstanding map[*clientImport.Client]map[int]bool // blocks each downloader requested and hasn't received
+	rejected    map[*clientImport.Client]map[int]bool // blocks each downloader refused, not asked for again until it unchokes us
+	waiting     map[*clientImport.Client]struct{}
+	webSeeds    int // web seeds fetching the whole piece over HTTP
+}
+
+func newPieceState(work *Work) *pieceState {
+	numBlocks := (work.Length + requestSize - 1) / requestSize
+	return &pieceState{
+		work:        work,
+		buf:         make([]byte, work.Length),
+		received:    make([]bool, numBlocks),
+		remaining:   numBlocks,
+		outstanding: make(map[*clientImport.Client]map[int]bool),
+		rejected:    make(map[*clientImport.Client]map[int]bool),
+		waiting:     make(map[*clientImport.Client]struct{}),
+	}
+}
+
+func (state *pieceState) blockLength(block int) int {
+	return min(requestSize, state.work.Length-block*requestSize)
+}
+
+func (state *pieceState) addDownloader(client *clientImport.Client) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	state.outstanding[client] = make(map[int]bool)
+	state.rejected[client] = make(map[int]bool)
+}
+
+// removeDownloader returns the number of peers still downloading the piece
+func (state *pieceState) removeDownloader(client *clientImport.Client) int {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	delete(state.outstanding, client)
+	delete(state.rejected, client)
+	delete(state.waiting, client)
+	return len(state.outstanding) + state.webSeeds
+}
+
+func (state *pieceState) addWebSeed() {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	state.webSeeds++
+}
+
+// removeWebSeed returns the number of peers and web seeds still downloading the piece
+func (state *pieceState) removeWebSeed() int {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	state.webSeeds--
+	return len(state.outstanding) + state.webSeeds
+}
+
+func (state *pieceState) hasWebSeed() bool {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	return state.webSeeds > 0
+}
+
+func (state *pieceState) downloaders() int {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	return len(state.outstanding) + state.webSeeds
+}
+
+func (state *pieceState) hasDownloader(client *clientImport.Client) bool {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	_, ok := state.outstanding[client]
+	return ok
+}
+
+func (state *pieceState) hasOutstanding(client *clientImport.Client) bool {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	return len(state.outstanding[client]) > 0
+}
+
+func (state *pieceState) isComplete() bool {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	return state.complete
+}
+
+// nextRequests picks the blocks the peer should request next, keeping at most
+// backlog of its requests outstanding, and records them as requested.
+func (state *pieceState) nextRequests(client *clientImport.Client, backlog int) []int {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	outstanding := state.outstanding[client]
+	rejected := state.rejected[client]
+	var blocks []int
+	for block := range state.received {
+		if len(outstanding) >= backlog {
+			break
+		}
+		if state.received[block] || outstanding[block] || rejected[block] {
+			continue
+		}
+		outstanding[block] = true
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+// choked forgets the peer's outstanding requests, a choking peer discards
+// them. Fast extension peers reject each one instead.
+func (state *pieceState) choked(client *clientImport.Client) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	if _, ok := state.outstanding[client]; ok {
+		state.outstanding[client] = make(map[int]bool)
+	}
+}
+
+// reject records that the peer refused a block, so it can be requested elsewhere
+func (state *pieceState) reject(client *clientImport.Client, index int, begin int) {
+	if index != state.work.Index || begin%requestSize != 0 {
+		return
+	}
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	block := begin / requestSize
+	if _, ok := state.outstanding[client]; !ok {
+		return
+	}
+	delete(state.outstanding[client], block)
+	state.rejected[client][block] = true
+}
+
+// unchoked lets us ask the peer again for blocks it rejected while choking us
+func (state *pieceState) unchoked(client *clientImport.Client) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	if _, ok := state.rejected[client]; ok {
+		state.rejected[client] = make(map[int]bool)
+	}
+}
+
+// receive stores a block from the peer and cancels the same block at every
+// other peer that requested it. It returns true for the block that completes
+// the piece. Blocks of other pieces, e.g. ones that arrived after a cancel,
+// are ignored.
+func (state *pieceState) receive(client *clientImport.Client, index int, begin int, data []byte) bool {
+	if index != state.work.Index || begin%requestSize != 0 {
+		return false
+	}
+	block := begin / requestSize
+	if block >= len(state.received) || len(data) != state.blockLength(block) {
+		return false
+	}
+
+	state.mutex.Lock()
+	delete(state.outstanding[client], block)
+	if state.complete || state.received[block] {
+		state.mutex.Unlock()
+		return false
+	}
+	copy(state.buf[begin:], data)
+	state.received[block] = true
+	state.remaining--
+
+	var cancel []*clientImport.Client
+	for other, outstanding := range state.outstanding {
+		if outstanding[block] {
+			delete(outstanding, block)
+			cancel = append(cancel, other)
+		}
+	}
+	finished := state.remaining == 0
+	if finished {
+		state.complete = true
+		for other := range state.waiting {
+			delete(state.waiting, other)
+			other.Conn.SetReadDeadline(time.Now())
+		}
+	}
+	state.mutex.Unlock()
+
+	for _, other := range cancel {
+		other.SendCancel(index, begin, len(data))
+	}
+	return finished
+}
+
+// fill stores a whole piece a web seed fetched, after its hash was checked.
+// Like receive it cancels the blocks peers still have requested and wakes the
+// peers waiting on the piece. It returns false if the piece was already complete.
+func (state *pieceState) fill(buf []byte) bool {
+	state.mutex.Lock()
+	if state.complete {
+		state.mutex.Unlock()
+		return false
+	}
+	copy(state.buf, buf)
+	for block := range state.received {
+		state.received[block] = true
+	}
+	state.remaining = 0
+	state.complete = true
+
+	cancel := make(map[*clientImport.Client][]int)
+	for other, outstanding := range state.outstanding {
+		for block := range outstanding {
+			cancel[other] = append(cancel[other], block)
+		}
+		state.outstanding[other] = make(map[int]bool)
+	}
+	for other := range state.waiting {
+		delete(state.waiting, other)
+		other.Conn.SetReadDeadline(time.Now())
+	}
+	state.mutex.Unlock()
+
+	for other, blocks := range cancel {
+		for _, block := range blocks {
+			other.SendCancel(state.work.Index, block*requestSize, state.blockLength(block))
+		}
+	}
+	return true
+}
+
+// reset throws away the downloaded blocks after a failed hash check
+func (state *pieceState) reset() {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	for block := range state.received {
+		state.received[block] = false
+	}
+	state.remaining = len(state.received)
+	state.complete = false
+}
+
+// beginWait registers the peer as waiting for its next message, so that it is
+// woken if another peer completes the piece first. It returns false if the
+// piece is already complete.
+func (state *pieceState) beginWait(client *clientImport.Client) bool {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	if state.complete {
+		return false
+	}
+	state.waiting[client] = struct{}{}
+	return true
+}
+
+// endWait restores the peer's read deadline, which a wake may have moved
+func (state *pieceState) endWait(client *clientImport.Client, deadline time.Time) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	delete(state.waiting, client)
+	client.Conn.SetReadDeadline(deadline)
+}
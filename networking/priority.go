@@ -0,0 +1,82 @@
+package networking
+
+import (
+	"GoTorrent/bencode"
+	"fmt"
+)
+
+// Priority decides whether and how soon a file of the torrent is downloaded
+type Priority int
+
+const (
+	PrioritySkip Priority = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
+func ParsePriority(name string) (Priority, error) {
+	switch name {
+	case "skip":
+		return PrioritySkip, nil
+	case "low":
+		return PriorityLow, nil
+	case "normal":
+		return PriorityNormal, nil
+	case "high":
+		return PriorityHigh, nil
+	}
+	return PriorityNormal, fmt.Errorf("unknown priority %q, expected skip, low, normal or high", name)
+}
+
+func (priority Priority) String() string {
+	switch priority {
+	case PrioritySkip:
+		return "skip"
+	case PriorityLow:
+		return "low"
+	case PriorityHigh:
+		return "high"
+	}
+	return "normal"
+}
+
+// checkPriorities makes sure there is a valid priority for every file, nil
+// meaning every file is normal
+func checkPriorities(torrent *bencode.TorrentType, filePriorities []Priority) error {
+	if filePriorities == nil {
+		return nil
+	}
+	if len(filePriorities) != len(torrent.Files) {
+		return fmt.Errorf("got %d file priorities for %d files", len(filePriorities), len(torrent.Files))
+	}
+	for i, priority := range filePriorities {
+		if priority < PrioritySkip || priority > PriorityHigh {
+			return fmt.Errorf("invalid priority %d for file [%d]", priority, i)
+		}
+	}
+	return nil
+}
+
+// piecePriorities gives every piece the highest priority of the files it
+// overlaps, since a piece shared with a file we want has to be downloaded whole
+func piecePriorities(torrent *bencode.TorrentType, filePriorities []Priority) []Priority {
+	priorities := make([]Priority, torrent.NumPieces)
+	if filePriorities == nil {
+		for index := range priorities {
+			priorities[index] = PriorityNormal
+		}
+		return priorities
+	}
+	for i, f := range torrent.Files {
+		if f.Length == 0 {
+			continue
+		}
+		first := int(f.Offset / torrent.PieceLength)
+		last := int((f.Offset + f.Length - 1) / torrent.PieceLength)
+		for index := first; index <= last && index < torrent.NumPieces; index++ {
+			priorities[index] = max(priorities[index], filePriorities[i])
+		}
+	}
+	return priorities
+}
@@ -0,0 +1,179 @@
+package networking
+
+import (
+	"GoTorrent/bencode"
+	clientImport "GoTorrent/client"
+	"crypto/sha1"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+/*
+A resume file records which pieces were complete the last time the download
+stopped, along with the size and modification time of every file and of the
+part file. If any of them changed since then, the saved bitfield can't be
+trusted and the data is rechecked instead. Files that don't exist are saved
+with a zero size and time.
+*/
+
+type resumeFile struct {
+	Length  int64 `bencode:"length"`
+	ModTime int64 `bencode:"mtime"`
+}
+
+type resumeState struct {
+	InfoHash string       `bencode:"info hash"`
+	Bitfield string       `bencode:"bitfield"`
+	Files    []resumeFile `bencode:"files"`
+	PartFile resumeFile   `bencode:"part file"`
+}
+
+func fileState(file *os.File) (resumeFile, error) {
+	if file == nil {
+		return resumeFile{}, nil
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return resumeFile{}, err
+	}
+	return resumeFile{Length: info.Size(), ModTime: info.ModTime().UnixNano()}, nil
+}
+
+// fileStates returns the state of every file followed by the part file
+func (storage *Storage) fileStates() ([]resumeFile, error) {
+	storage.filesMutex.RLock()
+	defer storage.filesMutex.RUnlock()
+	storage.partMutex.Lock()
+	defer storage.partMutex.Unlock()
+	files := make([]resumeFile, len(storage.files)+1)
+	for i, file := range append(storage.files, storage.partFile) {
+		var err error
+		files[i], err = fileState(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// SaveResume writes the pieces we have to path, replacing the file atomically
+func (storage *Storage) SaveResume(path string) error {
+	files, err := storage.fileStates()
+	if err != nil {
+		return err
+	}
+	state := resumeState{
+		InfoHash: string(storage.torrent.InfoHash[:]),
+		Bitfield: string(storage.Bitfield()),
+		Files:    files[:len(files)-1],
+		PartFile: files[len(files)-1],
+	}
+
+	data, err := bencode.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// LoadResume marks the pieces saved in the resume file at path as complete.
+// It fails without changing anything if the file belongs to another torrent
+// or the data on disk was modified after it was saved.
+func (storage *Storage) LoadResume(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	state := resumeState{}
+	err = bencode.Unmarshal(data, &state)
+	if err != nil {
+		return err
+	}
+	if state.InfoHash != string(storage.torrent.InfoHash[:]) {
+		return errors.New("resume file belongs to a different torrent")
+	}
+	if len(state.Bitfield) != (storage.torrent.NumPieces+7)/8 {
+		return errors.New("resume file has the wrong number of pieces")
+	}
+
+	files, err := storage.fileStates()
+	if err != nil {
+		return err
+	}
+	if len(state.Files) != len(files)-1 {
+		return errors.New("resume file has the wrong number of files")
+	}
+	saved := append(state.Files, state.PartFile)
+	for i := range files {
+		if files[i] != saved[i] {
+			return errors.New("files were modified since the resume file was saved")
+		}
+	}
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	storage.have = clientImport.Bitfield(state.Bitfield)
+	storage.notifyWritten()
+	return nil
+}
+
+// Verify hashes every piece on disk with the given number of workers and
+// marks the ones that match as complete and the rest as missing, so it can
+// recheck a torrent that was downloaded before. It returns how many pieces
+// passed.
+func (storage *Storage) Verify(workers int) int {
+	indexes := make(chan int)
+	var verified int
+	have := make(clientImport.Bitfield, (storage.torrent.NumPieces+7)/8)
+	var verifiedMutex sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				buf, err := storage.ReadBlock(index, 0, storage.torrent.CalcPieceSize(index))
+				if errors.Is(err, errNotStored) {
+					continue // Part of a skipped file we never downloaded
+				}
+				if err != nil {
+					log.Printf("failed to read piece [%d] for verification: %v\n", index, err)
+					continue
+				}
+				if sha1.Sum(buf) != storage.torrent.PieceHashes[index] {
+					continue
+				}
+				verifiedMutex.Lock()
+				have.SetPiece(index)
+				verified++
+				verifiedMutex.Unlock()
+			}
+		}()
+	}
+
+	for index := 0; index < storage.torrent.NumPieces; index++ {
+		indexes <- index
+	}
+	close(indexes)
+	wg.Wait()
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	storage.have = have
+	storage.notifyWritten()
+	return verified
+}
@@ -0,0 +1,525 @@
+package networking
+
+import (
+	"GoTorrent/bencode"
+	clientImport "GoTorrent/client"
+	"bytes"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const waitTimeout = 120 // seconds a peer with nothing to download waits before checking again
+
+/*
+The scheduler hands out pieces rarest first: availability counts how many
+connected peers have each piece, from their bitfields and have messages, and a
+peer is given the pending piece it has that the fewest other peers have. Ties
+are broken at random so peers don't all start on the same piece. File
+priorities come before rarity: a piece has the highest priority of the files it
+overlaps, and pieces of lower priority are only handed out once no piece of a
+higher one is pending. Pieces of skipped files are set aside until their
+priority changes. In sequential mode pieces of the same priority are handed
+out in order instead of rarest first.
+
+Streams reading a file give the pieces ahead of their position deadlines,
+which come before any priority: the pending piece with the earliest deadline
+goes first. A piece whose deadline passed while it is still being downloaded
+is time critical and peers with nothing else to do join it as in endgame mode. Fast
+extension peers can steer this: while a peer chokes us we take a piece it
+allows us to download anyway, and pieces it suggests go before the rarest.
+
+Once every piece has been handed out the download is in endgame mode: a peer
+with nothing left to do joins the download of an unfinished piece it has, with
+the fewest peers already on it. Each block is then requested from every peer
+downloading the piece and cancelled at the others as soon as one delivers it,
+so the last pieces don't wait on the slowest peer.
+
+Web seeds have every piece and take the rarest pending one like a peer would,
+fetching it whole. In endgame mode each web seed joins an unfinished piece no
+other web seed is on, and a piece it delivers first is cancelled at the peers.
+
+A peer with nothing to download waits for its next message through
+Client.WaitForMessage. The scheduler wakes waiting peers that have a piece put
+back in the queue by moving their read deadline to now, which interrupts the
+wait without consuming anything from the connection.
+*/
+
+type Scheduler struct {
+	torrent      *bencode.TorrentType
+	mutex        sync.Mutex
+	pending      map[int]*pieceState // pieces waiting to be handed to a peer
+	active       map[int]*pieceState // pieces being downloaded
+	skipped      map[int]*pieceState // pieces we don't have that only skipped files need
+	priorities   []Priority          // of every piece
+	sequential   bool
+	streams      map[*FileReader]map[int]time.Time // the deadlines each stream set
+	deadlines    map[int]time.Time                 // the earliest deadline of every piece a stream needs
+	availability []int
+	peers        map[*clientImport.Client]clientImport.Bitfield // the pieces each peer had when last counted
+	waiting      map[*clientImport.Client]struct{}
+	closed       bool
+	done         chan struct{} // closed by Close
+}
+
+// NewScheduler queues every piece that is not already in have, all with
+// normal priority until SetFilePriorities is called
+func NewScheduler(torrent *bencode.TorrentType, have clientImport.Bitfield) *Scheduler {
+	scheduler := Scheduler{
+		torrent:      torrent,
+		pending:      make(map[int]*pieceState),
+		active:       make(map[int]*pieceState),
+		skipped:      make(map[int]*pieceState),
+		priorities:   piecePriorities(torrent, nil),
+		streams:      make(map[*FileReader]map[int]time.Time),
+		deadlines:    make(map[int]time.Time),
+		availability: make([]int, torrent.NumPieces),
+		peers:        make(map[*clientImport.Client]clientImport.Bitfield),
+		waiting:      make(map[*clientImport.Client]struct{}),
+		done:         make(chan struct{}),
+	}
+	for index, hash := range torrent.PieceHashes {
+		if have.HasPiece(index) {
+			continue
+		}
+		work := Work{Index: index, WorkHash: hash, Length: torrent.CalcPieceSize(index)}
+		scheduler.pending[index] = newPieceState(&work)
+	}
+	return &scheduler
+}
+
+// SetFilePriorities reorders the pending pieces for new file priorities and
+// may be called while the download runs. Pieces that only skipped files need
+// are set aside, those being downloaded are finished first.
+func (scheduler *Scheduler) SetFilePriorities(filePriorities []Priority) error {
+	err := checkPriorities(scheduler.torrent, filePriorities)
+	if err != nil {
+		return err
+	}
+
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	scheduler.priorities = piecePriorities(scheduler.torrent, filePriorities)
+	for index, state := range scheduler.pending {
+		if scheduler.priorities[index] == PrioritySkip {
+			delete(scheduler.pending, index)
+			scheduler.skipped[index] = state
+		}
+	}
+	for index, state := range scheduler.skipped {
+		if scheduler.priorities[index] != PrioritySkip {
+			delete(scheduler.skipped, index)
+			scheduler.requeue(state)
+		}
+	}
+	if len(scheduler.pending) == 0 {
+		// Endgame may have started, waiting peers may be able to help with the last pieces
+		for waiting := range scheduler.waiting {
+			scheduler.wake(waiting)
+		}
+	}
+	return nil
+}
+
+// SetSequential switches between handing out pieces in order and rarest first
+func (scheduler *Scheduler) SetSequential(sequential bool) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	scheduler.sequential = sequential
+}
+
+// setDeadlines replaces the deadlines of the stream's pieces, nil removes them
+func (scheduler *Scheduler) setDeadlines(stream *FileReader, deadlines map[int]time.Time) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	if deadlines == nil {
+		delete(scheduler.streams, stream)
+	} else {
+		scheduler.streams[stream] = deadlines
+	}
+
+	scheduler.deadlines = make(map[int]time.Time)
+	for _, streamDeadlines := range scheduler.streams {
+		for index, deadline := range streamDeadlines {
+			earliest, ok := scheduler.deadlines[index]
+			if !ok || deadline.Before(earliest) {
+				scheduler.deadlines[index] = deadline
+			}
+		}
+	}
+	// Waiting peers may be able to join a time critical piece
+	for waiting := range scheduler.waiting {
+		scheduler.wake(waiting)
+	}
+}
+
+func (scheduler *Scheduler) copyBitfield(bitfield clientImport.Bitfield) clientImport.Bitfield {
+	snapshot := make(clientImport.Bitfield, (scheduler.torrent.NumPieces+7)/8)
+	copy(snapshot, bitfield)
+	return snapshot
+}
+
+// AddPeer counts the pieces of a newly connected peer
+func (scheduler *Scheduler) AddPeer(client *clientImport.Client) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	snapshot := scheduler.copyBitfield(client.Bitfield)
+	scheduler.peers[client] = snapshot
+	for _, index := range snapshot.Pieces() {
+		if index < len(scheduler.availability) {
+			scheduler.availability[index]++
+		}
+	}
+}
+
+func (scheduler *Scheduler) RemovePeer(client *clientImport.Client) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	snapshot, ok := scheduler.peers[client]
+	if !ok {
+		return
+	}
+	for _, index := range snapshot.Pieces() {
+		if index < len(scheduler.availability) {
+			scheduler.availability[index]--
+		}
+	}
+	delete(scheduler.peers, client)
+	delete(scheduler.waiting, client)
+}
+
+// UpdatePeer recounts the pieces of a peer after it sent have or bitfield messages
+func (scheduler *Scheduler) UpdatePeer(client *clientImport.Client) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	snapshot, ok := scheduler.peers[client]
+	if !ok || bytes.Equal(snapshot, client.Bitfield) {
+		return
+	}
+	for index := range scheduler.availability {
+		had := snapshot.HasPiece(index)
+		has := client.Bitfield.HasPiece(index)
+		if has && !had {
+			scheduler.availability[index]++
+		} else if had && !has {
+			scheduler.availability[index]--
+		}
+	}
+	scheduler.peers[client] = scheduler.copyBitfield(client.Bitfield)
+}
+
+// next hands the peer a late piece to help with, or the rarest pending piece
+// it has, or in endgame mode an unfinished piece to download alongside other
+// peers. When there is nothing it returns nil and the peer is counted as
+// waiting until it calls StopWaiting.
+func (scheduler *Scheduler) next(client *clientImport.Client) *pieceState {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	if scheduler.closed {
+		return nil
+	}
+
+	// A stream is already waiting for a late piece, helping with it comes first
+	state := scheduler.latePiece(client)
+	if state == nil {
+		state = scheduler.preferredPending(client)
+		if state == nil {
+			state = scheduler.rarestPending(client.Bitfield.HasPiece)
+		}
+		if state != nil {
+			scheduler.activate(state)
+		} else if len(scheduler.pending) == 0 {
+			state = scheduler.endgamePiece(client)
+		}
+	}
+
+	if state == nil {
+		scheduler.waiting[client] = struct{}{}
+		client.Conn.SetReadDeadline(time.Now().Add(waitTimeout * time.Second))
+		return nil
+	}
+	delete(scheduler.waiting, client)
+	state.addDownloader(client)
+	return state
+}
+
+// nextWebSeed hands a web seed the rarest pending piece, leaving the pieces
+// many peers have to them. In endgame mode it joins the unfinished piece with
+// the fewest downloaders that no web seed is fetching yet. It returns nil
+// when there is nothing to fetch.
+func (scheduler *Scheduler) nextWebSeed() *pieceState {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	if scheduler.closed {
+		return nil
+	}
+
+	state := scheduler.rarestPending(func(index int) bool { return true })
+	if state != nil {
+		scheduler.activate(state)
+	} else {
+		bestDownloaders := 0
+		for _, active := range scheduler.active {
+			if active.isComplete() || active.hasWebSeed() {
+				continue
+			}
+			downloaders := active.downloaders()
+			if state == nil || downloaders < bestDownloaders {
+				state = active
+				bestDownloaders = downloaders
+			}
+		}
+	}
+
+	if state == nil {
+		return nil
+	}
+	state.addWebSeed()
+	return state
+}
+
+// activate moves a pending piece to the pieces being downloaded
+func (scheduler *Scheduler) activate(state *pieceState) {
+	delete(scheduler.pending, state.work.Index)
+	scheduler.active[state.work.Index] = state
+	if len(scheduler.pending) == 0 {
+		// Endgame starts, waiting peers may be able to help with the last pieces
+		for waiting := range scheduler.waiting {
+			scheduler.wake(waiting)
+		}
+	}
+}
+
+// preferredPending picks a pending piece the peer lets us download while it
+// chokes us, or else the oldest pending piece it suggested. Suggestions that
+// are no longer pending are dropped.
+func (scheduler *Scheduler) preferredPending(client *clientImport.Client) *pieceState {
+	if client.Choked {
+		for index, state := range scheduler.pending {
+			if client.CanRequest(index) && client.Bitfield.HasPiece(index) {
+				return state
+			}
+		}
+	}
+
+	for len(client.Suggested) > 0 {
+		index := client.Suggested[0]
+		client.Suggested = client.Suggested[1:]
+		state, ok := scheduler.pending[index]
+		if ok && client.Bitfield.HasPiece(index) {
+			return state
+		}
+	}
+	return nil
+}
+
+// allowedFastPending reports whether a pending piece can be downloaded from the peer while it chokes us
+func (scheduler *Scheduler) allowedFastPending(client *clientImport.Client) bool {
+	if !client.Fast {
+		return false
+	}
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	for _, index := range client.AllowedFast.Pieces() {
+		if _, ok := scheduler.pending[index]; ok && client.Bitfield.HasPiece(index) {
+			return true
+		}
+	}
+	return false
+}
+
+// before reports whether piece a should be downloaded before piece b: the one
+// with the earlier deadline, or the higher priority, or else the one that
+// comes first in sequential mode and the one fewer peers have otherwise
+func (scheduler *Scheduler) before(a int, b int) bool {
+	deadlineA, hasDeadlineA := scheduler.deadlines[a]
+	deadlineB, hasDeadlineB := scheduler.deadlines[b]
+	if hasDeadlineA != hasDeadlineB {
+		return hasDeadlineA
+	}
+	if hasDeadlineA && !deadlineA.Equal(deadlineB) {
+		return deadlineA.Before(deadlineB)
+	}
+	if scheduler.priorities[a] != scheduler.priorities[b] {
+		return scheduler.priorities[a] > scheduler.priorities[b]
+	}
+	if scheduler.sequential {
+		return a < b
+	}
+	return scheduler.availability[a] < scheduler.availability[b]
+}
+
+// rarestPending picks the pending piece of the highest priority that the
+// fewest peers have among the ones the downloader has
+func (scheduler *Scheduler) rarestPending(has func(index int) bool) *pieceState {
+	var best *pieceState
+	ties := 0
+	for index, state := range scheduler.pending {
+		if !has(index) {
+			continue
+		}
+		if best == nil || scheduler.before(index, best.work.Index) {
+			best = state
+			ties = 1
+			continue
+		}
+		if !scheduler.before(best.work.Index, index) {
+			// Reservoir sampling keeps every tied piece equally likely
+			ties++
+			if rand.Intn(ties) == 0 {
+				best = state
+			}
+		}
+	}
+	return best
+}
+
+func (scheduler *Scheduler) endgamePiece(client *clientImport.Client) *pieceState {
+	return scheduler.joinActive(client, func(index int) bool { return true })
+}
+
+// latePiece picks a piece being downloaded whose deadline has passed, for the
+// peer to help with
+func (scheduler *Scheduler) latePiece(client *clientImport.Client) *pieceState {
+	if len(scheduler.deadlines) == 0 {
+		return nil
+	}
+	now := time.Now()
+	return scheduler.joinActive(client, func(index int) bool {
+		deadline, ok := scheduler.deadlines[index]
+		return ok && deadline.Before(now)
+	})
+}
+
+// joinActive picks the unfinished piece accepted by filter that the peer has
+// and the fewest peers are downloading, without the peer already on it
+func (scheduler *Scheduler) joinActive(client *clientImport.Client, filter func(index int) bool) *pieceState {
+	var best *pieceState
+	bestDownloaders := 0
+	for index, state := range scheduler.active {
+		if !client.Bitfield.HasPiece(index) || state.isComplete() || state.hasDownloader(client) || !filter(index) {
+			continue
+		}
+		downloaders := state.downloaders()
+		if best == nil || downloaders < bestDownloaders {
+			best = state
+			bestDownloaders = downloaders
+		}
+	}
+	return best
+}
+
+// release is called when the peer stops downloading the piece. An unfinished
+// piece nobody is downloading anymore goes back in the queue, keeping the
+// blocks that already arrived.
+func (scheduler *Scheduler) release(state *pieceState, client *clientImport.Client) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	scheduler.releaseLocked(state, state.removeDownloader(client))
+}
+
+// releaseFailed is called by the peer that completed the piece when its hash
+// check failed. The piece starts over and is requeued once nobody is
+// downloading it. Peers woken by the completion may already have released it
+// as done and taken it out of active, so it is put back first.
+func (scheduler *Scheduler) releaseFailed(state *pieceState, client *clientImport.Client) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	state.reset()
+	scheduler.active[state.work.Index] = state
+	scheduler.releaseLocked(state, state.removeDownloader(client))
+}
+
+// releaseWebSeed is called when a web seed stops fetching the piece
+func (scheduler *Scheduler) releaseWebSeed(state *pieceState) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	scheduler.releaseLocked(state, state.removeWebSeed())
+}
+
+// releaseLocked requeues the piece if it is unfinished and remaining, the
+// number of peers and web seeds still downloading it, is zero. A piece that
+// was skipped while it was downloaded is set aside instead.
+func (scheduler *Scheduler) releaseLocked(state *pieceState, remaining int) {
+	index := state.work.Index
+	if state.isComplete() {
+		delete(scheduler.active, index)
+		return
+	}
+	if remaining > 0 || scheduler.active[index] != state {
+		return
+	}
+
+	delete(scheduler.active, index)
+	if scheduler.priorities[index] == PrioritySkip {
+		scheduler.skipped[index] = state
+		return
+	}
+	scheduler.requeue(state)
+}
+
+// requeue makes the piece pending and wakes the waiting peers that have it
+func (scheduler *Scheduler) requeue(state *pieceState) {
+	index := state.work.Index
+	scheduler.pending[index] = state
+	for waiting := range scheduler.waiting {
+		snapshot := scheduler.peers[waiting]
+		if snapshot.HasPiece(index) {
+			scheduler.wake(waiting)
+		}
+	}
+}
+
+// redownload queues a piece that was downloaded but couldn't be written, so
+// it is fetched again instead of the torrent never completing
+func (scheduler *Scheduler) redownload(index int) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	if scheduler.pending[index] != nil || scheduler.active[index] != nil || scheduler.skipped[index] != nil {
+		return
+	}
+	work := Work{Index: index, WorkHash: scheduler.torrent.PieceHashes[index], Length: scheduler.torrent.CalcPieceSize(index)}
+	state := newPieceState(&work)
+	if scheduler.priorities[index] == PrioritySkip {
+		scheduler.skipped[index] = state
+		return
+	}
+	scheduler.requeue(state)
+}
+
+// StopWaiting is called by a waiting peer once it has something to read
+func (scheduler *Scheduler) StopWaiting(client *clientImport.Client) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	delete(scheduler.waiting, client)
+	client.Conn.SetReadDeadline(time.Now().Add(waitTimeout * time.Second))
+}
+
+func (scheduler *Scheduler) wake(client *clientImport.Client) {
+	delete(scheduler.waiting, client)
+	client.Conn.SetReadDeadline(time.Now())
+}
+
+// Close stops handing out pieces and wakes every waiting peer
+func (scheduler *Scheduler) Close() {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	if !scheduler.closed {
+		close(scheduler.done)
+	}
+	scheduler.closed = true
+	for client := range scheduler.waiting {
+		scheduler.wake(client)
+	}
+}
+
+// Done returns a channel that is closed once the scheduler is closed
+func (scheduler *Scheduler) Done() <-chan struct{} {
+	return scheduler.done
+}
+
+func (scheduler *Scheduler) Closed() bool {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	return scheduler.closed
+}
@@ -0,0 +1,98 @@
+package networking
+
+import (
+	clientImport "GoTorrent/client"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testPeer returns a peer that has every piece of the torrent
+func testPeer(t *testing.T, numPieces int) *clientImport.Client {
+	t.Helper()
+	conn, other := net.Pipe()
+	t.Cleanup(func() {
+		conn.Close()
+		other.Close()
+	})
+	bitfield := make(clientImport.Bitfield, (numPieces+7)/8)
+	for index := 0; index < numPieces; index++ {
+		bitfield.SetPiece(index)
+	}
+	return &clientImport.Client{Conn: conn, Bitfield: bitfield}
+}
+
+func TestEndgameHashFailureRequeues(t *testing.T) {
+	torrent, data := testTorrent("file.bin", []testFile{{path: "file.bin", data: randomData(6, testPieceLength)}})
+	scheduler := NewScheduler(torrent, make(clientImport.Bitfield, 1))
+	first := testPeer(t, torrent.NumPieces)
+	second := testPeer(t, torrent.NumPieces)
+	scheduler.AddPeer(first)
+	scheduler.AddPeer(second)
+
+	// Both peers download the only piece, the second one in endgame mode
+	state := scheduler.next(first)
+	if state == nil || scheduler.next(second) != state {
+		t.Fatal("the peers aren't both downloading the piece")
+	}
+	state.nextRequests(first, maxBacklog)
+	corrupted := append([]byte(nil), data...)
+	corrupted[0] ^= 0xff
+	if !state.receive(first, 0, 0, corrupted) {
+		t.Fatal("the block didn't complete the piece")
+	}
+
+	// Woken by the completion, the second peer lets go of the piece before
+	// the first one finds out it's corrupted
+	scheduler.release(state, second)
+	scheduler.releaseFailed(state, first)
+
+	if scheduler.next(second) != state {
+		t.Fatal("the piece wasn't requeued after its hash check failed")
+	}
+	if state.isComplete() {
+		t.Fatal("the requeued piece is still complete")
+	}
+}
+
+func TestFailedWriteRedownloads(t *testing.T) {
+	torrent, data := testTorrent("file.bin", []testFile{{path: "file.bin", data: randomData(7, 2*testPieceLength)}})
+	savePath := t.TempDir()
+	storage, err := NewStorage(torrent, savePath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(storage.Close)
+	scheduler := NewScheduler(torrent, storage.Bitfield())
+	peer := testPeer(t, torrent.NumPieces)
+	scheduler.AddPeer(peer)
+
+	// The piece is downloaded and released as done
+	state := scheduler.next(peer)
+	index := state.work.Index
+	state.nextRequests(peer, maxBacklog)
+	start := index * testPieceLength
+	if !state.receive(peer, index, 0, data[start:start+testPieceLength]) {
+		t.Fatal("the block didn't complete the piece")
+	}
+	scheduler.release(state, peer)
+
+	// Writes to a file opened read only fail
+	readOnly, err := os.Open(filepath.Join(savePath, "file.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.files[0].Close()
+	storage.files[0] = readOnly
+	writePiece(&WorkResults{PieceIndex: index, Buf: state.buf}, storage, NewUploader(storage, false), scheduler)
+	if storage.HasPiece(index) {
+		t.Fatal("the piece was stored")
+	}
+
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	if scheduler.pending[index] == nil {
+		t.Fatal("the piece that couldn't be written wasn't queued again")
+	}
+}
@@ -0,0 +1,404 @@
+package networking
+
+import (
+	"GoTorrent/bencode"
+	clientImport "GoTorrent/client"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+Files with priority skip are not created. A piece that spans a skipped file
+and a file we want is still downloaded whole, so the bytes of the skipped file
+need somewhere to go: they are kept in a part file next to the download, which
+has a slot of one piece length for every piece spanning several files. When a
+skipped file is wanted again it is created and its bytes are moved out of the
+part file, and once every file exists the part file is removed.
+*/
+
+var errNotStored = errors.New("data belongs to a skipped file and isn't stored")
+
+// Storage maps pieces onto the torrent's files and remembers which pieces
+// have been written, so they can be read back and uploaded.
+type Storage struct {
+	torrent        *bencode.TorrentType
+	savePath       string
+	filesMutex     sync.RWMutex // held for reading while data is read or written, so files aren't opened in between
+	files          []*os.File   // nil for a file that was skipped and never created
+	partSlots      map[int]int  // slot in the part file of every piece spanning several files
+	partMutex      sync.Mutex
+	partFile       *os.File // created with the first bytes of a skipped file
+	mutex          sync.RWMutex
+	have           clientImport.Bitfield
+	written        chan struct{} // closed and replaced whenever pieces are added to have
+	filePriorities []Priority
+	priorities     []Priority // of every piece
+	downloaded     int64      // bytes written this session
+}
+
+// NewStorage opens the files of the torrent under savePath. Files that are
+// skipped are only opened if they already exist, nil priorities means every
+// file is wanted.
+func NewStorage(torrent *bencode.TorrentType, savePath string, filePriorities []Priority) (*Storage, error) {
+	storage := Storage{
+		torrent:   torrent,
+		savePath:  savePath,
+		files:     make([]*os.File, len(torrent.Files)),
+		partSlots: make(map[int]int),
+		have:      make(clientImport.Bitfield, (torrent.NumPieces+7)/8),
+		written:   make(chan struct{}),
+	}
+	var boundaries []int
+	for i, f := range torrent.Files {
+		if i > 0 && f.Offset%torrent.PieceLength != 0 && f.Offset < torrent.Length {
+			boundaries = append(boundaries, int(f.Offset/torrent.PieceLength))
+		}
+	}
+	sort.Ints(boundaries)
+	for _, index := range boundaries {
+		if _, ok := storage.partSlots[index]; !ok {
+			storage.partSlots[index] = len(storage.partSlots)
+		}
+	}
+
+	partFile, err := os.OpenFile(storage.partPath(), os.O_RDWR, 0644)
+	if err == nil {
+		storage.partFile = partFile
+	}
+	for i, f := range torrent.Files {
+		_, err := os.Stat(filepath.Join(savePath, f.Path))
+		if err != nil {
+			continue // Created by SetFilePriorities if it is wanted
+		}
+		storage.files[i], err = bencode.OpenFile(torrent, savePath, i)
+		if err != nil {
+			storage.Close()
+			return nil, err
+		}
+	}
+
+	err = storage.SetFilePriorities(filePriorities)
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+	return &storage, nil
+}
+
+func (storage *Storage) partPath() string {
+	return filepath.Join(storage.savePath, fmt.Sprintf(".%x.parts", storage.torrent.InfoHash))
+}
+
+func (storage *Storage) Torrent() *bencode.TorrentType {
+	return storage.torrent
+}
+
+// Close closes the files of the torrent
+func (storage *Storage) Close() {
+	storage.filesMutex.Lock()
+	defer storage.filesMutex.Unlock()
+	for i, file := range storage.files {
+		if file != nil {
+			file.Close()
+			storage.files[i] = nil
+		}
+	}
+	storage.partMutex.Lock()
+	defer storage.partMutex.Unlock()
+	if storage.partFile != nil {
+		storage.partFile.Close()
+		storage.partFile = nil
+	}
+}
+
+// SetFilePriorities changes which files are downloaded, which may happen
+// while the download runs. Files that become wanted are created and filled
+// with their bytes from the part file. Files that become skipped are kept.
+func (storage *Storage) SetFilePriorities(filePriorities []Priority) error {
+	err := checkPriorities(storage.torrent, filePriorities)
+	if err != nil {
+		return err
+	}
+
+	storage.filesMutex.Lock()
+	defer storage.filesMutex.Unlock()
+	for i := range storage.torrent.Files {
+		if storage.files[i] != nil || filePriorities != nil && filePriorities[i] == PrioritySkip {
+			continue
+		}
+		file, err := bencode.OpenFile(storage.torrent, storage.savePath, i)
+		if err != nil {
+			return err
+		}
+		err = storage.movePartData(i, file)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		storage.files[i] = file
+	}
+	storage.removePartFile()
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	storage.filePriorities = make([]Priority, len(storage.torrent.Files))
+	for i := range storage.filePriorities {
+		storage.filePriorities[i] = PriorityNormal
+		if filePriorities != nil {
+			storage.filePriorities[i] = filePriorities[i]
+		}
+	}
+	storage.priorities = piecePriorities(storage.torrent, filePriorities)
+	return nil
+}
+
+// FilePriorities returns the priority of every file
+func (storage *Storage) FilePriorities() []Priority {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	return append([]Priority(nil), storage.filePriorities...)
+}
+
+// movePartData copies the bytes of the file at fileIndex that are in the
+// part file into the newly created file. Slots that were never written read
+// as zeros, the same as the new file, so they don't need to be told apart.
+func (storage *Storage) movePartData(fileIndex int, file *os.File) error {
+	storage.partMutex.Lock()
+	defer storage.partMutex.Unlock()
+	if storage.partFile == nil {
+		return nil
+	}
+
+	f := storage.torrent.Files[fileIndex]
+	pieceLength := storage.torrent.PieceLength
+	for index, slot := range storage.partSlots {
+		pieceStart := int64(index) * pieceLength
+		segmentStart := max(pieceStart, f.Offset)
+		segmentEnd := min(pieceStart+pieceLength, f.Offset+f.Length)
+		if segmentStart >= segmentEnd {
+			continue // The piece doesn't touch this file
+		}
+
+		buf := make([]byte, segmentEnd-segmentStart)
+		n, err := storage.partFile.ReadAt(buf, int64(slot)*pieceLength+segmentStart-pieceStart)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		_, err = file.WriteAt(buf[:n], segmentStart-f.Offset)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removePartFile deletes the part file once every file has been created,
+// nothing can be stored in it anymore
+func (storage *Storage) removePartFile() {
+	for _, file := range storage.files {
+		if file == nil {
+			return
+		}
+	}
+	storage.partMutex.Lock()
+	defer storage.partMutex.Unlock()
+	if storage.partFile != nil {
+		storage.partFile.Close()
+		storage.partFile = nil
+		os.Remove(storage.partPath())
+	}
+}
+
+// partSegment returns where the byte of the torrent at start is kept in the
+// part file, creating the part file if create is set
+func (storage *Storage) partSegment(start int64, create bool) (*os.File, int64, error) {
+	pieceLength := storage.torrent.PieceLength
+	index := int(start / pieceLength)
+	slot, ok := storage.partSlots[index]
+	if !ok {
+		return nil, 0, errNotStored
+	}
+
+	storage.partMutex.Lock()
+	defer storage.partMutex.Unlock()
+	if storage.partFile == nil {
+		if !create {
+			return nil, 0, errNotStored
+		}
+		err := os.MkdirAll(storage.savePath, 0755)
+		if err != nil {
+			return nil, 0, err
+		}
+		storage.partFile, err = os.OpenFile(storage.partPath(), os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return storage.partFile, int64(slot)*pieceLength + start - int64(index)*pieceLength, nil
+}
+
+func (storage *Storage) HasPiece(index int) bool {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	return storage.have.HasPiece(index)
+}
+
+// Bitfield returns a copy of the pieces we have
+func (storage *Storage) Bitfield() clientImport.Bitfield {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	bitfield := make(clientImport.Bitfield, len(storage.have))
+	copy(bitfield, storage.have)
+	return bitfield
+}
+
+func (storage *Storage) setPiece(index int) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	storage.have.SetPiece(index)
+	storage.notifyWritten()
+}
+
+// notifyWritten wakes everyone in waitPiece, the mutex must be held
+func (storage *Storage) notifyWritten() {
+	close(storage.written)
+	storage.written = make(chan struct{})
+}
+
+// waitPiece blocks until we have the piece. It returns false if stop is closed first.
+func (storage *Storage) waitPiece(index int, stop chan struct{}) bool {
+	for {
+		storage.mutex.RLock()
+		has := storage.have.HasPiece(index)
+		written := storage.written
+		storage.mutex.RUnlock()
+		if has {
+			return true
+		}
+		select {
+		case <-written:
+		case <-stop:
+			return false
+		}
+	}
+}
+
+// forEachSegment calls segmentFunc for every file that the byte range
+// [start, start+length) of the torrent overlaps, with the matching range of
+// buf. The range lies within one piece. Segments of files that weren't
+// created are in the part file, which is created if create is set.
+func (storage *Storage) forEachSegment(start int64, length int, create bool, segmentFunc func(file *os.File, fileOffset int64, bufStart int64, bufEnd int64) error) error {
+	end := start + int64(length)
+	for i, f := range storage.torrent.Files {
+		fileStart := f.Offset
+		fileEnd := f.Offset + f.Length
+		if end <= fileStart || start >= fileEnd {
+			continue // Range does not touch this file
+		}
+
+		segmentStart := max(start, fileStart)
+		segmentEnd := min(end, fileEnd)
+		file := storage.files[i]
+		fileOffset := segmentStart - fileStart
+		if file == nil {
+			var err error
+			file, fileOffset, err = storage.partSegment(segmentStart, create)
+			if err != nil {
+				return err
+			}
+		}
+		err := segmentFunc(file, fileOffset, segmentStart-start, segmentEnd-start)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WritePiece stores the piece and marks it as complete. It fails with
+// errNotStored for a piece of skipped files only, which has nowhere to go.
+func (storage *Storage) WritePiece(index int, buf []byte) error {
+	storage.filesMutex.RLock()
+	defer storage.filesMutex.RUnlock()
+	pieceStart := int64(index) * storage.torrent.PieceLength
+	err := storage.forEachSegment(pieceStart, len(buf), true, func(file *os.File, fileOffset int64, bufStart int64, bufEnd int64) error {
+		_, err := file.WriteAt(buf[bufStart:bufEnd], fileOffset)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	storage.setPiece(index)
+	atomic.AddInt64(&storage.downloaded, int64(len(buf)))
+	return nil
+}
+
+func (storage *Storage) Downloaded() int64 {
+	return atomic.LoadInt64(&storage.downloaded)
+}
+
+// Left returns the number of bytes of the wanted pieces we don't have yet
+func (storage *Storage) Left() int64 {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	var left int64
+	for index := 0; index < storage.torrent.NumPieces; index++ {
+		if storage.priorities[index] != PrioritySkip && !storage.have.HasPiece(index) {
+			left += int64(storage.torrent.CalcPieceSize(index))
+		}
+	}
+	return left
+}
+
+// Progress returns how many of the wanted pieces we have and how many are wanted
+func (storage *Storage) Progress() (int, int) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	var done, wanted int
+	for index := 0; index < storage.torrent.NumPieces; index++ {
+		if storage.priorities[index] == PrioritySkip {
+			continue
+		}
+		wanted++
+		if storage.have.HasPiece(index) {
+			done++
+		}
+	}
+	return done, wanted
+}
+
+// Complete reports whether we have every wanted piece
+func (storage *Storage) Complete() bool {
+	done, wanted := storage.Progress()
+	return done == wanted
+}
+
+// ReadBlock reads part of a piece back from disk, the inverse of WritePiece
+func (storage *Storage) ReadBlock(index int, begin int, length int) ([]byte, error) {
+	pieceSize := storage.torrent.CalcPieceSize(index)
+	if begin < 0 || length <= 0 || begin+length > pieceSize {
+		return nil, fmt.Errorf("block [%d] begin %d length %d outside piece of size %d", index, begin, length, pieceSize)
+	}
+
+	storage.filesMutex.RLock()
+	defer storage.filesMutex.RUnlock()
+	buf := make([]byte, length)
+	blockStart := int64(index)*storage.torrent.PieceLength + int64(begin)
+	err := storage.forEachSegment(blockStart, length, false, func(file *os.File, fileOffset int64, bufStart int64, bufEnd int64) error {
+		_, err := file.ReadAt(buf[bufStart:bufEnd], fileOffset)
+		if errors.Is(err, io.EOF) {
+			return errNotStored // Files are sized up front, only the part file ends early
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
@@ -0,0 +1,189 @@
+package networking
+
+import (
+	"GoTorrent/bencode"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const DefaultReadahead = 8 * 1024 * 1024 // bytes ahead of the read position that get deadlines
+const pieceDeadlineStep = 500            // milliseconds between the deadlines of consecutive pieces
+
+// FileReader streams one file of the torrent while it downloads. A read blocks
+// until the piece it needs has been verified and written, and the pieces from
+// the read position up to the readahead get deadlines so they are downloaded
+// first: the piece being read is due now, each following one a little later.
+//
+// Read, Seek and SetReadahead must not be called concurrently, Close may be
+// called from any goroutine and makes a blocked read return os.ErrClosed.
+//
+// Every run of the torrent has a scheduler of its own, so the reader is moved
+// to the new one with SetScheduler when the torrent is paused and resumed.
+type FileReader struct {
+	storage   *Storage
+	scheduler *Scheduler // nil while the torrent is paused
+	file      bencode.TorrentFile
+	position  int64
+	readahead int64
+	window    int               // piece the current deadlines start at, -1 if none are set
+	deadlines map[int]time.Time // the deadlines last set, for the scheduler of the next run
+	mutex     sync.Mutex        // guards the scheduler and deadlines, keeps Close from racing with new deadlines
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewFileReader opens the file at fileIndex of the torrent for streaming. The
+// file must not be skipped, its pieces would never be downloaded. scheduler
+// is nil if the torrent is paused.
+func NewFileReader(storage *Storage, scheduler *Scheduler, fileIndex int) (*FileReader, error) {
+	torrent := storage.Torrent()
+	if fileIndex < 0 || fileIndex >= len(torrent.Files) {
+		return nil, fmt.Errorf("file index %d out of range, the torrent has %d files", fileIndex, len(torrent.Files))
+	}
+	if storage.FilePriorities()[fileIndex] == PrioritySkip {
+		return nil, fmt.Errorf("file [%d] is skipped", fileIndex)
+	}
+	return &FileReader{
+		storage:   storage,
+		scheduler: scheduler,
+		file:      torrent.Files[fileIndex],
+		readahead: DefaultReadahead,
+		window:    -1,
+		closed:    make(chan struct{}),
+	}, nil
+}
+
+// SetReadahead changes how many bytes past the read position are prioritised
+func (reader *FileReader) SetReadahead(readahead int64) {
+	reader.readahead = max(readahead, 0)
+	reader.window = -1
+	reader.updateDeadlines()
+}
+
+func (reader *FileReader) Length() int64 {
+	return reader.file.Length
+}
+
+// updateDeadlines gives the pieces from the read position up to the
+// readahead deadlines, unless they were already given from the same piece
+func (reader *FileReader) updateDeadlines() {
+	if reader.position >= reader.file.Length {
+		return
+	}
+	pieceLength := reader.storage.Torrent().PieceLength
+	start := reader.file.Offset + reader.position
+	first := int(start / pieceLength)
+	if first == reader.window {
+		return
+	}
+	end := min(start+reader.readahead, reader.file.Offset+reader.file.Length)
+	last := int((max(end, start+1) - 1) / pieceLength)
+
+	now := time.Now()
+	deadlines := make(map[int]time.Time)
+	for index := first; index <= last; index++ {
+		if !reader.storage.HasPiece(index) {
+			deadlines[index] = now.Add(time.Duration(index-first) * pieceDeadlineStep * time.Millisecond)
+		}
+	}
+	reader.window = first
+
+	reader.mutex.Lock()
+	defer reader.mutex.Unlock()
+	select {
+	case <-reader.closed:
+	default:
+		reader.deadlines = deadlines
+		if reader.scheduler != nil {
+			reader.scheduler.setDeadlines(reader, deadlines)
+		}
+	}
+}
+
+// SetScheduler moves the reader's deadlines to the scheduler of the torrent's
+// new run, nil while it is paused
+func (reader *FileReader) SetScheduler(scheduler *Scheduler) {
+	reader.mutex.Lock()
+	defer reader.mutex.Unlock()
+	select {
+	case <-reader.closed:
+		return
+	default:
+	}
+	if reader.scheduler != nil {
+		reader.scheduler.setDeadlines(reader, nil)
+	}
+	reader.scheduler = scheduler
+	if scheduler != nil && reader.deadlines != nil {
+		scheduler.setDeadlines(reader, reader.deadlines)
+	}
+}
+
+func (reader *FileReader) Read(p []byte) (int, error) {
+	select {
+	case <-reader.closed:
+		return 0, os.ErrClosed
+	default:
+	}
+	if reader.position >= reader.file.Length {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	reader.updateDeadlines()
+	torrent := reader.storage.Torrent()
+	start := reader.file.Offset + reader.position
+	index := int(start / torrent.PieceLength)
+	if !reader.storage.waitPiece(index, reader.closed) {
+		return 0, os.ErrClosed
+	}
+
+	begin := int(start - int64(index)*torrent.PieceLength)
+	length := min(len(p), torrent.CalcPieceSize(index)-begin)
+	length = int(min(int64(length), reader.file.Length-reader.position))
+	buf, err := reader.storage.ReadBlock(index, begin, length)
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, buf)
+	reader.position += int64(n)
+	return n, nil
+}
+
+func (reader *FileReader) Seek(offset int64, whence int) (int64, error) {
+	position := offset
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		position += reader.position
+	case io.SeekEnd:
+		position += reader.file.Length
+	default:
+		return reader.position, errors.New("invalid whence")
+	}
+	if position < 0 {
+		return reader.position, errors.New("negative position")
+	}
+	reader.position = position
+	reader.updateDeadlines()
+	return position, nil
+}
+
+// Close removes the reader's deadlines and wakes a blocked read
+func (reader *FileReader) Close() error {
+	reader.closeOnce.Do(func() {
+		reader.mutex.Lock()
+		defer reader.mutex.Unlock()
+		close(reader.closed)
+		if reader.scheduler != nil {
+			reader.scheduler.setDeadlines(reader, nil)
+		}
+	})
+	return nil
+}
@@ -0,0 +1,389 @@
+package networking
+
+import (
+	"encoding/hex"
+	"html/template"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+The stream server serves the files of the torrents being downloaded over HTTP,
+so a player can open one while it downloads. Every file has a stable URL made
+of the torrent's infohash and the file's path, e.g.
+
+	http://127.0.0.1:8080/<infohash in hex>/<dir>/<file>
+
+and /<infohash>/ is an index page linking to the files of the torrent. Files
+are served with http.ServeContent over a FileReader, which answers Range
+requests by seeking, and every seek gives the pieces from the requested
+position on deadlines. Requesting a skipped file downloads it with normal
+priority.
+*/
+
+// Content types of media files that mime.TypeByExtension may not know
+var mediaTypes = map[string]string{
+	".mkv":  "video/x-matroska",
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".webm": "video/webm",
+	".avi":  "video/x-msvideo",
+	".mov":  "video/quicktime",
+	".ts":   "video/mp2t",
+	".mp3":  "audio/mpeg",
+	".flac": "audio/flac",
+	".ogg":  "audio/ogg",
+	".opus": "audio/opus",
+	".m4a":  "audio/mp4",
+	".wav":  "audio/wav",
+	".srt":  "application/x-subrip",
+	".vtt":  "text/vtt",
+	".ass":  "text/x-ssa",
+	".nfo":  "text/plain; charset=utf-8",
+	".txt":  "text/plain; charset=utf-8",
+}
+
+func contentType(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	if mediaType, ok := mediaTypes[ext]; ok {
+		return mediaType
+	}
+	if mediaType := mime.TypeByExtension(ext); mediaType != "" {
+		return mediaType
+	}
+	// Not left to ServeContent, sniffing would wait for the first piece
+	return "application/octet-stream"
+}
+
+type streamTorrent struct {
+	storage       *Storage
+	scheduler     *Scheduler // of the current run, nil while paused, guarded by the server's mutex
+	setPriorities func(priorities []Priority) error
+	files         map[string]int           // index of every file by its URL path
+	readers       map[*FileReader]struct{} // open readers, guarded by the server's mutex
+	removed       bool                     // no readers are opened once it is set, guarded by the server's mutex
+	mutex         sync.Mutex               // serialises changing the file priorities
+}
+
+// StreamServer serves the files of torrents over HTTP while they download
+type StreamServer struct {
+	listener  net.Listener
+	server    *http.Server
+	readahead int64
+	mutex     sync.Mutex
+	torrents  map[string]*streamTorrent // by hex infohash
+}
+
+// ListenStream creates a stream server listening on address, readahead bytes
+// past every read position are downloaded first
+func ListenStream(address string, readahead int64) (*StreamServer, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	streamServer := StreamServer{
+		listener:  listener,
+		readahead: readahead,
+		torrents:  make(map[string]*streamTorrent),
+	}
+	streamServer.server = &http.Server{
+		Handler:           &streamServer,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return &streamServer, nil
+}
+
+// URL returns the address of the index of all torrents
+func (streamServer *StreamServer) URL() string {
+	return "http://" + streamServer.listener.Addr().String() + "/"
+}
+
+func (streamServer *StreamServer) Serve() {
+	err := streamServer.server.Serve(streamServer.listener)
+	if err != nil && err != http.ErrServerClosed {
+		log.Printf("stream server stopped: %v\n", err)
+	}
+}
+
+func (streamServer *StreamServer) Close() error {
+	return streamServer.server.Close()
+}
+
+// Add makes the files of the torrent available. setPriorities changes the file
+// priorities of the storage and the download together. Until SetScheduler is
+// called the torrent is taken to be paused.
+func (streamServer *StreamServer) Add(storage *Storage, setPriorities func(priorities []Priority) error) {
+	torrent := storage.Torrent()
+	files := make(map[string]int)
+	for i, f := range torrent.Files {
+		files[filepath.ToSlash(f.Path)] = i
+	}
+	streamServer.mutex.Lock()
+	defer streamServer.mutex.Unlock()
+	streamServer.torrents[hex.EncodeToString(torrent.InfoHash[:])] = &streamTorrent{
+		storage:       storage,
+		setPriorities: setPriorities,
+		files:         files,
+		readers:       make(map[*FileReader]struct{}),
+	}
+}
+
+// SetScheduler gives the torrent's readers the scheduler of its new run, or
+// nil when it is paused
+func (streamServer *StreamServer) SetScheduler(infoHash [20]byte, scheduler *Scheduler) {
+	streamServer.mutex.Lock()
+	defer streamServer.mutex.Unlock()
+	torrent, ok := streamServer.torrents[hex.EncodeToString(infoHash[:])]
+	if !ok {
+		return
+	}
+	torrent.scheduler = scheduler
+	for reader := range torrent.readers {
+		reader.SetScheduler(scheduler)
+	}
+}
+
+// Remove takes the torrent off the server and closes its open readers, so no
+// read is left waiting for a piece once the storage is closed
+func (streamServer *StreamServer) Remove(infoHash [20]byte) {
+	key := hex.EncodeToString(infoHash[:])
+	streamServer.mutex.Lock()
+	torrent, ok := streamServer.torrents[key]
+	if !ok {
+		streamServer.mutex.Unlock()
+		return
+	}
+	delete(streamServer.torrents, key)
+	torrent.removed = true
+	readers := make([]*FileReader, 0, len(torrent.readers))
+	for reader := range torrent.readers {
+		readers = append(readers, reader)
+	}
+	streamServer.mutex.Unlock()
+
+	for _, reader := range readers {
+		reader.Close()
+	}
+}
+
+// FileURL returns the stable URL of a file of the torrent
+func (streamServer *StreamServer) FileURL(infoHash [20]byte, filePath string) string {
+	return streamServer.URL() + hex.EncodeToString(infoHash[:]) + "/" + escapePath(filepath.ToSlash(filePath))
+}
+
+// escapePath escapes every segment of a slash separated path for a URL
+func escapePath(filePath string) string {
+	segments := strings.Split(filePath, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func (streamServer *StreamServer) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		writer.Header().Set("Allow", "GET, HEAD")
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	infoHash, filePath, _ := strings.Cut(strings.TrimPrefix(request.URL.Path, "/"), "/")
+	if infoHash == "" {
+		streamServer.serveTorrents(writer)
+		return
+	}
+	streamServer.mutex.Lock()
+	torrent, ok := streamServer.torrents[strings.ToLower(infoHash)]
+	streamServer.mutex.Unlock()
+	if !ok {
+		http.NotFound(writer, request)
+		return
+	}
+	if filePath == "" {
+		if !strings.HasSuffix(request.URL.Path, "/") {
+			http.Redirect(writer, request, request.URL.Path+"/", http.StatusMovedPermanently)
+			return
+		}
+		streamServer.serveIndex(writer, torrent)
+		return
+	}
+
+	fileIndex, ok := torrent.files[filePath]
+	if !ok {
+		http.NotFound(writer, request)
+		return
+	}
+	streamServer.serveFile(writer, request, torrent, fileIndex)
+}
+
+func (streamServer *StreamServer) serveFile(writer http.ResponseWriter, request *http.Request, torrent *streamTorrent, fileIndex int) {
+	err := streamServer.unskip(torrent, fileIndex)
+	if err != nil {
+		log.Printf("can't stream file [%d]: %v\n", fileIndex, err)
+		http.Error(writer, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	streamServer.mutex.Lock()
+	if torrent.removed {
+		streamServer.mutex.Unlock()
+		http.NotFound(writer, request)
+		return
+	}
+	reader, err := NewFileReader(torrent.storage, torrent.scheduler, fileIndex)
+	if err == nil {
+		torrent.readers[reader] = struct{}{}
+	}
+	streamServer.mutex.Unlock()
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer func() {
+		streamServer.mutex.Lock()
+		delete(torrent.readers, reader)
+		streamServer.mutex.Unlock()
+		reader.Close()
+	}()
+	reader.SetReadahead(streamServer.readahead)
+
+	// A read waiting for a piece returns once the player goes away
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-request.Context().Done():
+			reader.Close()
+		case <-done:
+		}
+	}()
+
+	f := torrent.storage.Torrent().Files[fileIndex]
+	writer.Header().Set("Content-Type", contentType(f.Path))
+	http.ServeContent(writer, request, path.Base(filepath.ToSlash(f.Path)), time.Time{}, reader)
+}
+
+// unskip gives a skipped file normal priority so that it can be streamed.
+// Unskipping creates the file and moves its data out of the part file, so only
+// the torrent's own mutex is held, not the server's.
+func (streamServer *StreamServer) unskip(torrent *streamTorrent, fileIndex int) error {
+	torrent.mutex.Lock()
+	defer torrent.mutex.Unlock()
+	priorities := torrent.storage.FilePriorities()
+	if priorities[fileIndex] != PrioritySkip {
+		return nil
+	}
+
+	log.Printf("file [%d] was skipped, downloading it for streaming\n", fileIndex)
+	priorities[fileIndex] = PriorityNormal
+	return torrent.setPriorities(priorities)
+}
+
+type indexFile struct {
+	Path     string
+	URL      string
+	Length   int64
+	Priority Priority
+	Percent  float64
+}
+
+type torrentLink struct {
+	Name string
+	URL  string
+}
+
+type indexPage struct {
+	Name  string
+	Files []indexFile
+}
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Name}}</title></head>
+<body>
+<h1>{{.Name}}</h1>
+<table>
+<tr><th>File</th><th>Size</th><th>Priority</th><th>Done</th></tr>
+{{range .Files}}<tr><td><a href="{{.URL}}">{{.Path}}</a></td><td>{{.Length}}</td><td>{{.Priority}}</td><td>{{printf "%.1f" .Percent}}%</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+var torrentsTemplate = template.Must(template.New("torrents").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Torrents</title></head>
+<body>
+<h1>Torrents</h1>
+<ul>
+{{range .}}<li><a href="{{.URL}}">{{.Name}}</a></li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+// serveTorrents lists the torrents with links to their index pages
+func (streamServer *StreamServer) serveTorrents(writer http.ResponseWriter) {
+	streamServer.mutex.Lock()
+	var links []torrentLink
+	for infoHash, torrent := range streamServer.torrents {
+		links = append(links, torrentLink{Name: torrent.storage.Torrent().Name, URL: infoHash + "/"})
+	}
+	streamServer.mutex.Unlock()
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].Name < links[j].Name
+	})
+
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := torrentsTemplate.Execute(writer, links)
+	if err != nil {
+		log.Printf("failed to write torrent list [%v]\n", err)
+	}
+}
+
+// serveIndex lists the files of the torrent with how much of each is done
+func (streamServer *StreamServer) serveIndex(writer http.ResponseWriter, torrent *streamTorrent) {
+	info := torrent.storage.Torrent()
+	priorities := torrent.storage.FilePriorities()
+	page := indexPage{Name: info.Name}
+	for i, f := range info.Files {
+		page.Files = append(page.Files, indexFile{
+			Path:     filepath.ToSlash(f.Path),
+			URL:      "./" + escapePath(filepath.ToSlash(f.Path)), // ./ so a colon isn't taken for a scheme
+			Length:   f.Length,
+			Priority: priorities[i],
+			Percent:  fileProgress(torrent.storage, f.Offset, f.Length),
+		})
+	}
+
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := indexTemplate.Execute(writer, page)
+	if err != nil {
+		log.Printf("failed to write index of [%s]: %v\n", info.Name, err)
+	}
+}
+
+// fileProgress returns the percentage of the pieces of a file we have
+func fileProgress(storage *Storage, offset int64, length int64) float64 {
+	if length == 0 {
+		return 100
+	}
+	pieceLength := storage.Torrent().PieceLength
+	first := int(offset / pieceLength)
+	last := int((offset + length - 1) / pieceLength)
+	have := 0
+	for index := first; index <= last; index++ {
+		if storage.HasPiece(index) {
+			have++
+		}
+	}
+	return float64(have) / float64(last-first+1) * 100
+}
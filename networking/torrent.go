@@ -1,10 +1,8 @@
 package networking
 
 import (
-	"GoTorrent/bencode"
 	clientImport "GoTorrent/client"
 	"GoTorrent/message"
-	"GoTorrent/peer_discovery"
 	"GoTorrent/work"
 	"bytes"
 	"crypto/sha1"
@@ -13,7 +11,6 @@ import (
 	"log"
 	"os"
 	"sync"
-	"sync/atomic"
 	"time"
 )
 
@@ -32,164 +29,158 @@ const maxBacklog = 5
 const clientCreationRetries = 1
 const clientCreationTimeout = 5
 const downloadTimeoutFactor = 30
-const workRetrievalTimeout = 100
+const writeRetries = 3
 
-func ConstructWorkQueue(torrent *bencode.TorrentType) (chan *Work, chan *WorkResults) {
-	workQueue := make(chan *Work, len(torrent.PieceHashes))
-	results := make(chan *WorkResults)
-
-	for index, hash := range torrent.PieceHashes {
-		length := torrent.CalcPieceSize(index)
-		workQueue <- &Work{Index: index, WorkHash: hash, Length: length}
-	}
-
-	return workQueue, results
+// DiskWriter writes the downloaded pieces of every torrent with a fixed number
+// of workers, so the number of writes in flight doesn't grow with the torrents
+type DiskWriter struct {
+	writes  chan diskWrite
+	workers sync.WaitGroup
 }
 
-func WritePieces(results chan *WorkResults, torrent *bencode.TorrentType, openFiles []*os.File, wg *sync.WaitGroup, writtenPieces *int64, totalPieces *int64) {
-	defer wg.Done()
-	log.Printf("NumFiles: %d", len(openFiles))
-	for {
-		select {
-		case res := <-results:
-			pieceStart := int64(res.PieceIndex) * torrent.PieceLength
-			pieceEnd := pieceStart + int64(len(res.Buf))
-
-			for i, f := range torrent.Files {
-				fileStart := f.Offset
-				fileEnd := f.Offset + f.Length
-				if pieceEnd <= fileStart || pieceStart >= fileEnd {
-					continue // Piece does not write to this file
-				}
-
-				// Find what part of the piece belongs to this file
-				writeStart := max(pieceStart, fileStart)
-				writeEnd := min(pieceEnd, fileEnd)
-
-				bufOffset := writeStart - pieceStart
-				fileOffset := writeStart - fileStart
-
-				_, err := openFiles[i].WriteAt(res.Buf[bufOffset:bufOffset+writeEnd-writeStart], fileOffset)
-				if err != nil {
-					results <- res
-					continue
-				}
-				piecesWritten := atomic.AddInt64(writtenPieces, 1)
-				percent := (float64(piecesWritten) / float64(torrent.NumPieces)) * 100
-				log.Printf("[%0.2f%%]: Wrote piece [%d]", percent, res.PieceIndex)
+type diskWrite struct {
+	result    *WorkResults
+	storage   *Storage
+	uploader  *Uploader
+	scheduler *Scheduler
+	pending   *sync.WaitGroup
+}
 
+func NewDiskWriter(workers int) *DiskWriter {
+	writer := DiskWriter{writes: make(chan diskWrite)}
+	for i := 0; i < workers; i++ {
+		writer.workers.Add(1)
+		go func() {
+			defer writer.workers.Done()
+			for write := range writer.writes {
+				writePiece(write.result, write.storage, write.uploader, write.scheduler)
+				write.pending.Done()
 			}
-		case <-time.After(workRetrievalTimeout * time.Second * 5):
-			log.Printf("write retrieval timeout")
-			return
+		}()
+	}
+	return &writer
+}
+
+// Add returns the channel the pieces of a torrent are sent to. Once it is
+// closed and every piece sent on it has been written, done is closed. Pieces
+// that can't be written go back to the scheduler.
+func (writer *DiskWriter) Add(storage *Storage, uploader *Uploader, scheduler *Scheduler) (chan *WorkResults, chan struct{}) {
+	results := make(chan *WorkResults)
+	done := make(chan struct{})
+	go func() {
+		var pending sync.WaitGroup
+		for res := range results {
+			pending.Add(1)
+			writer.writes <- diskWrite{result: res, storage: storage, uploader: uploader, scheduler: scheduler, pending: &pending}
 		}
+		pending.Wait()
+		close(done)
+	}()
+	return results, done
+}
 
-	}
+// Close stops the workers once every torrent's results channel is closed
+func (writer *DiskWriter) Close() {
+	close(writer.writes)
+	writer.workers.Wait()
 }
 
-func ConnectToPeer(peer peer_discovery.Peer, torrent *bencode.TorrentType, wg *sync.WaitGroup, workQueue chan *Work, results chan *WorkResults, completedPieces *int64, totalPieces *int64) {
-	defer wg.Done()
-	var client *clientImport.Client
+func writePiece(res *WorkResults, storage *Storage, uploader *Uploader, scheduler *Scheduler) {
 	var err error
-	for i := 0; i < clientCreationRetries; i++ {
-		client, err = clientImport.New(peer, torrent)
-		if err != nil {
-			log.Printf("retry create client [%v]\n", err)
-			time.Sleep(clientCreationTimeout * time.Second)
-			continue
+	for attempt := 0; attempt < writeRetries; attempt++ {
+		err = storage.WritePiece(res.PieceIndex, res.Buf)
+		if err == nil || errors.Is(err, errNotStored) {
+			break
 		}
-		break
 	}
-	if err != nil {
-		log.Printf("failed to create client [%v]\n", err)
+	if errors.Is(err, errNotStored) {
+		log.Printf("discarding piece [%d], its files are skipped\n", res.PieceIndex)
 		return
 	}
-
-	log.Printf("created client with peer [%v]\n", peer.GetTCPAddress())
-
-	//fmt.Printf("IP: %v | Port: %v | ID: %v\n", peer.IP, peer.Port, client.peerID)
-
-	err = client.SendUnchoke()
-	if err != nil {
-		log.Printf("failed to send unchoke [%v]\n", err)
-		return
-	}
-	err = message.SendInterested(client.Conn)
-
 	if err != nil {
-		log.Printf("failed to send interested [%v]\n", err)
+		log.Printf("failed to write piece [%d], downloading it again: %v\n", res.PieceIndex, err)
+		scheduler.redownload(res.PieceIndex)
 		return
 	}
 
-	for work := range workQueue {
-		if atomic.LoadInt64(completedPieces) == *totalPieces {
-			return
-		}
-
-		if !client.Bitfield.HasPiece(work.Index) {
-			workQueue <- work
-			continue
-		}
-
-		buf, err := attemptPieceDownload(client, work)
-		if err != nil {
-			log.Printf("failed to download piece [%d], %v\n", work.Index, err)
-			workQueue <- work
-			return
-		}
-
-		err = compareHash(work, buf)
-		if err != nil {
-			log.Printf("failed hash check [%d]\n", work.Index)
-			workQueue <- work
-			continue
-		}
-
-		client.SendHave(work.Index)
-		results <- &WorkResults{PieceIndex: work.Index, Buf: buf}
-		atomic.AddInt64(completedPieces, 1)
-	}
+	done, wanted := storage.Progress()
+	percent := (float64(done) / float64(max(wanted, 1))) * 100
+	log.Printf("%s [%0.2f%%]: Wrote piece [%d]", storage.torrent.Name, percent, res.PieceIndex)
+	uploader.BroadcastHave(res.PieceIndex)
 }
 
-func attemptPieceDownload(client *clientImport.Client, work *Work) ([]byte, error) {
+// attemptPieceDownload requests the piece's blocks from the peer until the
+// piece is complete. It returns the piece and true if this peer delivered the
+// last block, or nil and false if other peers in endgame mode finished it
+// first or the choking peer allowed us a different piece.
+func attemptPieceDownload(client *clientImport.Client, state *pieceState, uploader *Uploader, scheduler *Scheduler) ([]byte, bool, error) {
+	work := state.work
+	finished := false
 	workProgress := WorkProgress{
-		Index:      work.Index,
-		Client:     client,
-		Buf:        make([]byte, work.Length),
-		Downloaded: 0,
-		Requested:  0,
-		Backlog:    0,
+		Index:  work.Index,
+		Client: client,
+		OnBlock: func(index int, begin int, data []byte) error {
+			uploader.received(client, len(data))
+			if state.receive(client, index, begin, data) {
+				finished = true
+			}
+			return nil
+		},
+		OnReject: func(request message.BlockRequest) {
+			state.reject(client, request.Index, request.Begin)
+		},
 	}
 
 	// If we don't get it in 30 seconds assume we are not getting a response
-	client.Conn.SetDeadline(time.Now().Add(downloadTimeoutFactor * time.Second))
-	defer client.Conn.SetDeadline(time.Time{})
-	for workProgress.Downloaded < work.Length {
-		if !workProgress.Client.Choked {
-			for workProgress.Backlog < maxBacklog && workProgress.Requested < work.Length {
-				currentRequestSize := requestSize
-				if work.Length-workProgress.Requested < currentRequestSize {
-					currentRequestSize = work.Length - workProgress.Requested
-				}
-				err := client.SendRequest(work.Index, workProgress.Requested, currentRequestSize)
+	deadline := time.Now().Add(downloadTimeoutFactor * time.Second)
+	client.Conn.SetReadDeadline(deadline)
+	defer client.Conn.SetReadDeadline(time.Time{})
+	for {
+		if finished {
+			return state.buf, true, nil
+		}
+		if client.CanRequest(work.Index) {
+			for _, block := range state.nextRequests(client, maxBacklog) {
+				err := client.SendRequest(work.Index, block*requestSize, state.blockLength(block))
 				if err != nil {
-					return nil, errors.New(fmt.Sprintf("failed to send request [%d], [%v]\n", work.Index, err))
+					return nil, false, errors.New(fmt.Sprintf("failed to send request [%d], [%v]\n", work.Index, err))
 				}
-				workProgress.Requested += currentRequestSize
-				workProgress.Backlog += 1
 			}
 		}
-		err := workProgress.ReadMessage()
+
+		if !state.beginWait(client) {
+			return nil, false, nil
+		}
+		err := client.WaitForMessage()
+		state.endWait(client, deadline)
+		if errors.Is(err, os.ErrDeadlineExceeded) && time.Now().Before(deadline) {
+			continue // Woken because the piece changed, it's checked at the top of the loop
+		}
 		if err != nil {
-			return nil, errors.New(fmt.Sprintf("failed to read response [%d], [%v]\n", work.Index, err))
+			return nil, false, errors.New(fmt.Sprintf("failed to read response [%d], [%v]\n", work.Index, err))
 		}
-	}
 
-	if workProgress.Downloaded != work.Length {
-		return nil, fmt.Errorf("incomplete piece: %d/%d", workProgress.Downloaded, work.Length)
+		wasChoked := client.Choked
+		err = workProgress.ReadMessage()
+		if err != nil {
+			return nil, false, errors.New(fmt.Sprintf("failed to read response [%d], [%v]\n", work.Index, err))
+		}
+		if client.Choked && !client.Fast {
+			state.choked(client)
+		}
+		if wasChoked && !client.Choked {
+			state.unchoked(client)
+		}
+		if !client.CanRequest(work.Index) && !state.hasOutstanding(client) && scheduler.allowedFastPending(client) {
+			// Hand the piece back and take one the peer lets us download while choked
+			return nil, false, nil
+		}
+		scheduler.UpdatePeer(client)
+		err = uploader.Serve(client)
+		if err != nil {
+			return nil, false, errors.New(fmt.Sprintf("failed to serve requests [%d], [%v]\n", work.Index, err))
+		}
 	}
-	return workProgress.Buf, nil
-
 }
 
 func compareHash(work *Work, buf []byte) error {
@@ -0,0 +1,94 @@
+package networking
+
+import (
+	clientImport "GoTorrent/client"
+	"GoTorrent/mse"
+	"GoTorrent/utp"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Transport is a protocol peer connections run over
+type Transport int
+
+const (
+	TransportTCP Transport = iota
+	TransportUTP
+)
+
+func ParseTransport(name string) (Transport, error) {
+	switch name {
+	case "tcp":
+		return TransportTCP, nil
+	case "utp":
+		return TransportUTP, nil
+	}
+	return TransportTCP, fmt.Errorf("unknown transport %q, expected tcp or utp", name)
+}
+
+func (transport Transport) String() string {
+	if transport == TransportUTP {
+		return "utp"
+	}
+	return "tcp"
+}
+
+// Dialer connects to peers over the preferred transport and falls back to the
+// other one when that fails. Without a uTP socket every connection is TCP.
+// Connections made for a torrent are encrypted as the policy says.
+type Dialer struct {
+	Preferred  Transport
+	UTP        *utp.Socket
+	Encryption mse.Policy
+}
+
+func (dialer *Dialer) Dial(address string, timeout time.Duration) (net.Conn, error) {
+	transports := []Transport{TransportUTP, TransportTCP}
+	if dialer.Preferred == TransportTCP {
+		transports = []Transport{TransportTCP, TransportUTP}
+	}
+
+	var errs []error
+	for _, transport := range transports {
+		var conn net.Conn
+		var err error
+		switch transport {
+		case TransportUTP:
+			if dialer.UTP == nil {
+				continue
+			}
+			conn, err = dialer.UTP.Dial(address, timeout)
+		case TransportTCP:
+			conn, err = net.DialTimeout("tcp", address, timeout)
+		}
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// ForTorrent returns a DialFunc that runs the encryption handshake for
+// infoHash on the connections it makes. When encryption is only preferred, a
+// peer that fails the handshake is dialed again in plaintext, since peers
+// without encryption support usually just drop the connection.
+func (dialer *Dialer) ForTorrent(infoHash [20]byte) clientImport.DialFunc {
+	return func(address string, timeout time.Duration) (net.Conn, error) {
+		conn, err := dialer.Dial(address, timeout)
+		if err != nil || dialer.Encryption == mse.PolicyDisabled {
+			return conn, err
+		}
+		encrypted, err := mse.Initiate(conn, infoHash, dialer.Encryption)
+		if err == nil {
+			return encrypted, nil
+		}
+		conn.Close()
+		if dialer.Encryption == mse.PolicyRequire {
+			return nil, fmt.Errorf("encryption handshake with %v failed: %w", address, err)
+		}
+		return dialer.Dial(address, timeout)
+	}
+}
@@ -0,0 +1,359 @@
+package networking
+
+import (
+	clientImport "GoTorrent/client"
+	"GoTorrent/message"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const maxUploadSlots = 4      // unchoked peers, one of them the optimistic unchoke
+const maxBlockLength = 131072 // larger requests are dropped
+const seedIdleTimeout = 300   // seconds without a message before a seeding connection is dropped
+const rechokeInterval = 10    // seconds between ranking the interested peers
+const optimisticInterval = 30 // seconds between picking another optimistic unchoke
+
+/*
+See: https://www.bittorrent.org/beps/bep_0003.html#choking-and-optimistic-unchoking
+Every rechokeInterval the interested peers are ranked by the rate they sent us
+data at, or the rate we sent them data at once we are seeding, and the fastest
+get the upload slots. One slot goes to a peer picked at random every
+optimisticInterval, so peers that never had a slot get a chance to show their
+rate. In between, a slot freed by a peer that lost interest or disconnected goes
+to the fastest peer waiting for one.
+
+The slots are decided under the uploader's mutex, the choke and unchoke messages
+are sent after it is released, since a write to a rate limited peer can block.
+*/
+
+// Uploader decides which interested peers are unchoked and answers their
+// requests from storage.
+type Uploader struct {
+	storage    *Storage
+	Seed       bool // keep connections open after the download completes
+	mutex      sync.Mutex
+	clients    map[*clientImport.Client]*uploadPeer
+	optimistic *clientImport.Client // nil until an interested peer is choked
+	uploaded   int64
+}
+
+// uploadPeer is the uploader's view of a peer, guarded by the uploader's mutex
+type uploadPeer struct {
+	interested bool
+	unchoked   bool       // the peer holds an upload slot
+	uploaded   int64      // bytes sent to the peer since the last rechoke
+	downloaded int64      // bytes received from the peer since the last rechoke
+	rate       int64      // bytes per second in the last rechoke interval
+	sendMutex  sync.Mutex // orders choke messages, guards the client's AmChoking
+}
+
+func NewUploader(storage *Storage, seed bool) *Uploader {
+	return &Uploader{
+		storage: storage,
+		Seed:    seed,
+		clients: make(map[*clientImport.Client]*uploadPeer),
+	}
+}
+
+func (uploader *Uploader) Bitfield() clientImport.Bitfield {
+	return uploader.storage.Bitfield()
+}
+
+func (uploader *Uploader) Uploaded() int64 {
+	return atomic.LoadInt64(&uploader.uploaded)
+}
+
+func (uploader *Uploader) Add(client *clientImport.Client) {
+	uploader.mutex.Lock()
+	defer uploader.mutex.Unlock()
+	uploader.clients[client] = &uploadPeer{}
+}
+
+func (uploader *Uploader) Remove(client *clientImport.Client) {
+	uploader.mutex.Lock()
+	delete(uploader.clients, client)
+	if uploader.optimistic == client {
+		uploader.optimistic = nil
+	}
+	changed := uploader.fillSlotsLocked()
+	uploader.mutex.Unlock()
+	uploader.sendChokes(changed)
+}
+
+// BroadcastHave tells every connected peer about a piece we just wrote. It is
+// called by the disk writers, which must not wait for a slow peer, so the
+// messages are sent in the background.
+func (uploader *Uploader) BroadcastHave(index int) {
+	uploader.mutex.Lock()
+	clients := make([]*clientImport.Client, 0, len(uploader.clients))
+	for client := range uploader.clients {
+		clients = append(clients, client)
+	}
+	uploader.mutex.Unlock()
+
+	for _, client := range clients {
+		go client.SendHave(index)
+	}
+}
+
+// received counts the bytes of a block the peer sent us, for ranking it
+func (uploader *Uploader) received(client *clientImport.Client, n int) {
+	uploader.mutex.Lock()
+	defer uploader.mutex.Unlock()
+	peer, ok := uploader.clients[client]
+	if ok {
+		peer.downloaded += int64(n)
+	}
+}
+
+// Run rechokes the peers every rechokeInterval until stop is closed
+func (uploader *Uploader) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(rechokeInterval * time.Second)
+	defer ticker.Stop()
+	for rechokes := 0; ; rechokes++ {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		uploader.rechoke(rechokes%(optimisticInterval/rechokeInterval) == 0)
+	}
+}
+
+// rechoke gives the regular slots to the fastest interested peers and, when
+// rotate is set or the optimistic unchoke is gone, picks another optimistic
+// unchoke among the rest
+func (uploader *Uploader) rechoke(rotate bool) {
+	uploader.mutex.Lock()
+	seeding := uploader.storage.Complete()
+	for _, peer := range uploader.clients {
+		peer.rate = peer.downloaded / rechokeInterval
+		if seeding {
+			peer.rate = peer.uploaded / rechokeInterval
+		}
+		peer.uploaded = 0
+		peer.downloaded = 0
+	}
+
+	interested := uploader.rankedLocked(func(peer *uploadPeer) bool { return peer.interested })
+	unchoke := make(map[*clientImport.Client]bool)
+	for _, client := range interested[:min(len(interested), maxUploadSlots-1)] {
+		unchoke[client] = true
+	}
+	var candidates []*clientImport.Client
+	for _, client := range interested {
+		if !unchoke[client] {
+			candidates = append(candidates, client)
+		}
+	}
+	current := uploader.optimistic
+	if rotate || current == nil || unchoke[current] || !uploader.clients[current].interested {
+		uploader.optimistic = nil
+		if len(candidates) > 0 {
+			uploader.optimistic = candidates[rand.Intn(len(candidates))]
+		}
+	}
+	if uploader.optimistic != nil {
+		unchoke[uploader.optimistic] = true
+	}
+
+	var changed []*clientImport.Client
+	for client, peer := range uploader.clients {
+		if peer.unchoked != unchoke[client] {
+			peer.unchoked = unchoke[client]
+			changed = append(changed, client)
+		}
+	}
+	uploader.mutex.Unlock()
+	uploader.sendChokes(changed)
+}
+
+// rankedLocked returns the peers matching filter, fastest first
+func (uploader *Uploader) rankedLocked(filter func(peer *uploadPeer) bool) []*clientImport.Client {
+	var clients []*clientImport.Client
+	for client, peer := range uploader.clients {
+		if filter(peer) {
+			clients = append(clients, client)
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return uploader.clients[clients[i]].rate > uploader.clients[clients[j]].rate
+	})
+	return clients
+}
+
+// fillSlotsLocked takes the slots of peers that lost interest and hands the
+// free slots to the fastest interested peers waiting for one. It returns the
+// peers whose slot changed.
+func (uploader *Uploader) fillSlotsLocked() []*clientImport.Client {
+	var changed []*clientImport.Client
+	used := 0
+	for client, peer := range uploader.clients {
+		if peer.unchoked && !peer.interested {
+			peer.unchoked = false
+			changed = append(changed, client)
+		}
+		if peer.unchoked {
+			used++
+		}
+	}
+	waiting := uploader.rankedLocked(func(peer *uploadPeer) bool { return peer.interested && !peer.unchoked })
+	for _, client := range waiting[:min(len(waiting), max(maxUploadSlots-used, 0))] {
+		uploader.clients[client].unchoked = true
+		changed = append(changed, client)
+	}
+	return changed
+}
+
+// sendChokes tells the peers whose slot changed in the background. Their own
+// connection notices when a write fails.
+func (uploader *Uploader) sendChokes(clients []*clientImport.Client) {
+	for _, client := range clients {
+		go uploader.updateChoke(client)
+	}
+}
+
+// updateChoke sends a choke or unchoke when the peer's slot changed since the
+// last one and returns whether we are choking the peer.
+func (uploader *Uploader) updateChoke(client *clientImport.Client) (bool, error) {
+	uploader.mutex.Lock()
+	peer, ok := uploader.clients[client]
+	uploader.mutex.Unlock()
+	if !ok {
+		return true, nil
+	}
+	peer.sendMutex.Lock()
+	defer peer.sendMutex.Unlock()
+	uploader.mutex.Lock()
+	unchoked := peer.unchoked
+	uploader.mutex.Unlock()
+
+	if unchoked != client.AmChoking {
+		return client.AmChoking, nil
+	}
+	client.AmChoking = !unchoked
+	if unchoked {
+		return false, client.SendUnchoke()
+	}
+	return true, client.SendChoke()
+}
+
+// dropRequests forgets the peer's queued requests. Fast extension peers
+// expect a reject for every request we won't answer.
+func dropRequests(client *clientImport.Client) error {
+	requests := client.Requests
+	client.Requests = nil
+	if !client.Fast {
+		return nil
+	}
+	for _, request := range requests {
+		err := client.SendReject(request)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (uploader *Uploader) validRequest(request message.BlockRequest) bool {
+	if request.Length <= 0 || request.Length > maxBlockLength {
+		return false
+	}
+	if !uploader.storage.HasPiece(request.Index) {
+		return false
+	}
+	return request.Begin >= 0 && request.Begin+request.Length <= uploader.storage.torrent.CalcPieceSize(request.Index)
+}
+
+func rejectRequest(client *clientImport.Client, request message.BlockRequest) error {
+	if !client.Fast {
+		return nil
+	}
+	return client.SendReject(request)
+}
+
+// Serve updates the choke state of the peer and answers its queued requests.
+// Requests of a peer choked by a rechoke are dropped here, by the goroutine
+// that owns the connection.
+func (uploader *Uploader) Serve(client *clientImport.Client) error {
+	uploader.mutex.Lock()
+	peer, ok := uploader.clients[client]
+	var changed []*clientImport.Client
+	if ok && peer.interested != client.PeerInterested {
+		peer.interested = client.PeerInterested
+		changed = uploader.fillSlotsLocked()
+	}
+	uploader.mutex.Unlock()
+	uploader.sendChokes(changed)
+
+	choking, err := uploader.updateChoke(client)
+	if err != nil {
+		return err
+	}
+	if choking {
+		return dropRequests(client)
+	}
+
+	for len(client.Requests) > 0 {
+		request := client.Requests[0]
+		client.Requests = client.Requests[1:]
+		if !uploader.validRequest(request) {
+			err = rejectRequest(client, request)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		data, err := uploader.storage.ReadBlock(request.Index, request.Begin, request.Length)
+		if err != nil {
+			log.Printf("failed to read block [%d] at %d: %v\n", request.Index, request.Begin, err)
+			err = rejectRequest(client, request)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err = client.SendPiece(request.Index, request.Begin, data)
+		if err != nil {
+			return err
+		}
+		atomic.AddInt64(&uploader.uploaded, int64(len(data)))
+		uploader.mutex.Lock()
+		peer.uploaded += int64(len(data))
+		uploader.mutex.Unlock()
+	}
+	return nil
+}
+
+// seed keeps answering requests from the peer once we have every piece. It
+// returns when the connection fails or idles, or the peer is a seed as well.
+func seed(client *clientImport.Client, uploader *Uploader) {
+	workProgress := WorkProgress{
+		Index:  -1,
+		Client: client,
+	}
+	numPieces := uploader.storage.torrent.NumPieces
+	for {
+		if client.Bitfield.Count() >= numPieces {
+			log.Printf("peer [%v] is also a seed, disconnecting\n", client.Peer.GetTCPAddress())
+			return
+		}
+
+		client.Conn.SetReadDeadline(time.Now().Add(seedIdleTimeout * time.Second))
+		err := workProgress.ReadMessage()
+		if err != nil {
+			log.Printf("seeding to peer [%v] stopped: %v\n", client.Peer.GetTCPAddress(), err)
+			return
+		}
+		err = uploader.Serve(client)
+		if err != nil {
+			log.Printf("seeding to peer [%v] stopped: %v\n", client.Peer.GetTCPAddress(), err)
+			return
+		}
+	}
+}
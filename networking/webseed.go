@@ -0,0 +1,215 @@
+package networking
+
+import (
+	"GoTorrent/bencode"
+	"GoTorrent/ratelimit"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const webSeedWorkers = 2      // pieces fetched from one web seed at a time
+const webSeedRetries = 5      // failed fetches in a row before a worker gives up on the web seed
+const webSeedRetryWait = 10   // seconds
+const webSeedPollInterval = 5 // seconds a worker with nothing to fetch waits before checking again
+const webSeedTimeout = 60     // seconds to fetch one piece
+
+/*
+See: https://www.bittorrent.org/beps/bep_0019.html
+A web seed is an HTTP server with the torrent's files. For a single file
+torrent the url-list entry is the file's URL, or a directory it is in when it
+ends with a slash. For a multi file torrent it is always a directory, holding
+a directory called name with the files under their paths.
+
+Pieces are fetched whole with a Range request for each file they overlap, and
+hash checked before they go to the writers like pieces from peers. A server
+that ignores the range and answers with the whole file would send every file
+once for each of its pieces, so the web seed is given up after that response.
+*/
+
+type WebSeed struct {
+	url       string
+	fileURLs  []string
+	torrent   *bencode.TorrentType
+	scheduler *Scheduler
+	results   chan *WorkResults
+	client    *http.Client
+	rates     *ratelimit.PeerLimits // nil for unlimited
+	noRanges  atomic.Bool           // set once the server answered a range request with the whole file
+}
+
+// NewWebSeed creates a web seed whose downloads count against rates like a
+// peer's, nil rates are unlimited
+func NewWebSeed(seedURL string, torrent *bencode.TorrentType, scheduler *Scheduler, results chan *WorkResults, rates *ratelimit.TorrentLimits) *WebSeed {
+	lan := false
+	parsed, err := url.Parse(seedURL)
+	if err == nil {
+		lan = ratelimit.IsLAN(parsed.Hostname())
+	}
+	return &WebSeed{
+		url:       seedURL,
+		fileURLs:  fileURLs(seedURL, torrent),
+		torrent:   torrent,
+		scheduler: scheduler,
+		results:   results,
+		client:    &http.Client{Timeout: webSeedTimeout * time.Second},
+		rates:     rates.NewPeer(lan),
+	}
+}
+
+// fileURLs maps each file of the torrent to its URL on the web seed
+func fileURLs(seedURL string, torrent *bencode.TorrentType) []string {
+	urls := make([]string, len(torrent.Files))
+	if !torrent.MultiFile {
+		urls[0] = seedURL
+		if strings.HasSuffix(seedURL, "/") {
+			urls[0] += url.PathEscape(torrent.Name)
+		}
+		return urls
+	}
+
+	if !strings.HasSuffix(seedURL, "/") {
+		seedURL += "/"
+	}
+	for i, file := range torrent.Files {
+		segments := []string{url.PathEscape(torrent.Name)}
+		for _, segment := range strings.Split(filepath.ToSlash(file.Path), "/") {
+			segments = append(segments, url.PathEscape(segment))
+		}
+		urls[i] = seedURL + strings.Join(segments, "/")
+	}
+	return urls
+}
+
+// Run fetches pieces until the download is done, or every worker gave up
+// after the server failed too often in a row. Closing the scheduler cancels
+// the fetches in flight, so Run returns soon after.
+func (webSeed *WebSeed) Run() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-webSeed.scheduler.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var workers sync.WaitGroup
+	for i := 0; i < webSeedWorkers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			webSeed.work(ctx)
+		}()
+	}
+	workers.Wait()
+}
+
+// sleep waits for the given number of seconds or until the scheduler is closed
+func (webSeed *WebSeed) sleep(seconds time.Duration) {
+	timer := time.NewTimer(seconds * time.Second)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-webSeed.scheduler.Done():
+	}
+}
+
+func (webSeed *WebSeed) work(ctx context.Context) {
+	scheduler := webSeed.scheduler
+	failures := 0
+	for !scheduler.Closed() {
+		state := scheduler.nextWebSeed()
+		if state == nil {
+			webSeed.sleep(webSeedPollInterval)
+			continue
+		}
+		work := state.work
+
+		buf, err := webSeed.fetchPiece(ctx, work)
+		if err == nil {
+			err = compareHash(work, buf)
+		}
+		if err != nil {
+			scheduler.releaseWebSeed(state)
+			failures++
+			log.Printf("web seed [%v] failed piece [%d]: %v\n", webSeed.url, work.Index, err)
+			if failures >= webSeedRetries || webSeed.noRanges.Load() {
+				log.Printf("giving up on web seed [%v]\n", webSeed.url)
+				return
+			}
+			webSeed.sleep(webSeedRetryWait)
+			continue
+		}
+		failures = 0
+
+		if state.fill(buf) {
+			webSeed.results <- &WorkResults{PieceIndex: work.Index, Buf: buf}
+		}
+		scheduler.releaseWebSeed(state)
+		if webSeed.noRanges.Load() {
+			log.Printf("web seed [%v] doesn't support range requests, giving up on it\n", webSeed.url)
+			return
+		}
+	}
+}
+
+func (webSeed *WebSeed) fetchPiece(ctx context.Context, work *Work) ([]byte, error) {
+	buf := make([]byte, work.Length)
+	start := int64(work.Index) * webSeed.torrent.PieceLength
+	end := start + int64(work.Length)
+	for i, file := range webSeed.torrent.Files {
+		fileEnd := file.Offset + file.Length
+		if end <= file.Offset || start >= fileEnd {
+			continue // Piece does not touch this file
+		}
+
+		segmentStart := max(start, file.Offset)
+		segmentEnd := min(end, fileEnd)
+		err := webSeed.fetchRange(ctx, webSeed.fileURLs[i], segmentStart-file.Offset, buf[segmentStart-start:segmentEnd-start])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// fetchRange fills buf with the file's bytes from offset on
+func (webSeed *WebSeed) fetchRange(ctx context.Context, fileURL string, offset int64, buf []byte) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(len(buf))-1))
+	response, err := webSeed.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body := webSeed.rates.Reader(response.Body)
+	switch response.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignored the range and sends the whole file, which still
+		// counts against the rate limits up to the part we need
+		webSeed.noRanges.Store(true)
+		_, err = io.CopyN(io.Discard, body, offset)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%v: unexpected status %v", fileURL, response.Status)
+	}
+	_, err = io.ReadFull(body, buf)
+	return err
+}
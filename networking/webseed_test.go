@@ -0,0 +1,244 @@
+package networking
+
+import (
+	"GoTorrent/bencode"
+	"bytes"
+	"crypto/sha1"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testPieceLength = 16384
+
+type testFile struct {
+	path string
+	data []byte
+}
+
+// testTorrent builds a torrent of the files and returns it with the data of
+// all files one after the other
+func testTorrent(name string, files []testFile) (*bencode.TorrentType, []byte) {
+	torrent := bencode.TorrentType{Name: name, PieceLength: testPieceLength, MultiFile: len(files) > 1}
+	var data []byte
+	for _, file := range files {
+		torrent.Files = append(torrent.Files, bencode.TorrentFile{Path: file.path, Length: int64(len(file.data)), Offset: int64(len(data))})
+		data = append(data, file.data...)
+	}
+	torrent.Length = int64(len(data))
+	for start := 0; start < len(data); start += testPieceLength {
+		torrent.PieceHashes = append(torrent.PieceHashes, sha1.Sum(data[start:min(start+testPieceLength, len(data))]))
+	}
+	torrent.NumPieces = len(torrent.PieceHashes)
+	return &torrent, data
+}
+
+func randomData(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// testServer serves files by URL path. With ranges off it answers every
+// request with the whole file, and corrupt can change a response body.
+type testServer struct {
+	files    map[string][]byte
+	ranges   bool
+	corrupt  func(path string, rangeHeader string, body []byte) []byte
+	mutex    sync.Mutex
+	requests map[string][]string // Range headers of the requests for each path
+}
+
+func (server *testServer) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	data, ok := server.files[request.URL.Path]
+	if !ok {
+		http.NotFound(writer, request)
+		return
+	}
+	rangeHeader := request.Header.Get("Range")
+	server.mutex.Lock()
+	server.requests[request.URL.Path] = append(server.requests[request.URL.Path], rangeHeader)
+	server.mutex.Unlock()
+
+	if !server.ranges {
+		writer.Write(data)
+		return
+	}
+	if server.corrupt != nil {
+		data = server.corrupt(request.URL.Path, rangeHeader, data)
+	}
+	http.ServeContent(writer, request, "", time.Time{}, bytes.NewReader(data))
+}
+
+func (server *testServer) numRequests(path string) int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return len(server.requests[path])
+}
+
+func startTestServer(t *testing.T, files map[string][]byte, ranges bool) (*testServer, *httptest.Server) {
+	t.Helper()
+	server := &testServer{files: files, ranges: ranges, requests: make(map[string][]string)}
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	return server, httpServer
+}
+
+// runWebSeed downloads the torrent from the web seed until every piece
+// arrived, or until the web seed stops, and returns the pieces it got
+func runWebSeed(t *testing.T, seedURL string, torrent *bencode.TorrentType) map[int][]byte {
+	t.Helper()
+	scheduler := NewScheduler(torrent, make([]byte, (torrent.NumPieces+7)/8))
+	results := make(chan *WorkResults, torrent.NumPieces)
+	webSeed := NewWebSeed(seedURL, torrent, scheduler, results, nil)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		webSeed.Run()
+	}()
+	defer func() {
+		scheduler.Close()
+		<-stopped
+	}()
+
+	pieces := make(map[int][]byte)
+	timeout := time.After(20 * time.Second)
+	for len(pieces) < torrent.NumPieces {
+		select {
+		case result := <-results:
+			pieces[result.PieceIndex] = result.Buf
+		case <-stopped:
+			for len(results) > 0 {
+				result := <-results
+				pieces[result.PieceIndex] = result.Buf
+			}
+			return pieces
+		case <-timeout:
+			t.Fatalf("got %d of %d pieces before the timeout", len(pieces), torrent.NumPieces)
+		}
+	}
+	return pieces
+}
+
+func checkPieces(t *testing.T, pieces map[int][]byte, data []byte) {
+	t.Helper()
+	for index, piece := range pieces {
+		start := index * testPieceLength
+		if !bytes.Equal(piece, data[start:min(start+testPieceLength, len(data))]) {
+			t.Errorf("piece [%d] differs from the data served", index)
+		}
+	}
+}
+
+func TestFileURLs(t *testing.T) {
+	single, _ := testTorrent("movie file.mkv", []testFile{{path: "movie file.mkv", data: []byte("x")}})
+	multi, _ := testTorrent("album", []testFile{{path: "cd 1/01.flac", data: []byte("x")}, {path: "cover.jpg", data: []byte("y")}})
+	tests := []struct {
+		seedURL string
+		torrent *bencode.TorrentType
+		want    []string
+	}{
+		{"http://host/files/movie.mkv", single, []string{"http://host/files/movie.mkv"}},
+		{"http://host/files/", single, []string{"http://host/files/movie%20file.mkv"}},
+		{"http://host/files", multi, []string{"http://host/files/album/cd%201/01.flac", "http://host/files/album/cover.jpg"}},
+		{"http://host/files/", multi, []string{"http://host/files/album/cd%201/01.flac", "http://host/files/album/cover.jpg"}},
+	}
+	for _, test := range tests {
+		got := fileURLs(test.seedURL, test.torrent)
+		if strings.Join(got, " ") != strings.Join(test.want, " ") {
+			t.Errorf("fileURLs(%q) = %v, want %v", test.seedURL, got, test.want)
+		}
+	}
+}
+
+func TestWebSeedSingleFile(t *testing.T) {
+	torrent, data := testTorrent("file.bin", []testFile{{path: "file.bin", data: randomData(1, 5*testPieceLength+1000)}})
+	server, httpServer := startTestServer(t, map[string][]byte{"/seed/file.bin": data}, true)
+
+	pieces := runWebSeed(t, httpServer.URL+"/seed/", torrent)
+	if len(pieces) != torrent.NumPieces {
+		t.Fatalf("got %d of %d pieces", len(pieces), torrent.NumPieces)
+	}
+	checkPieces(t, pieces, data)
+	if n := server.numRequests("/seed/file.bin"); n != torrent.NumPieces {
+		t.Errorf("%d requests for %d pieces", n, torrent.NumPieces)
+	}
+}
+
+func TestWebSeedMultiFile(t *testing.T) {
+	// The first file ends inside the second piece, which spans both files
+	first := randomData(2, testPieceLength+500)
+	second := randomData(3, 3*testPieceLength)
+	torrent, data := testTorrent("dir", []testFile{{path: "sub dir/first.bin", data: first}, {path: "second.bin", data: second}})
+	server, httpServer := startTestServer(t, map[string][]byte{
+		"/seed/dir/sub dir/first.bin": first,
+		"/seed/dir/second.bin":        second,
+	}, true)
+
+	pieces := runWebSeed(t, httpServer.URL+"/seed", torrent)
+	if len(pieces) != torrent.NumPieces {
+		t.Fatalf("got %d of %d pieces", len(pieces), torrent.NumPieces)
+	}
+	checkPieces(t, pieces, data)
+	// Two pieces touch the first file and four the second
+	if n := server.numRequests("/seed/dir/sub dir/first.bin"); n != 2 {
+		t.Errorf("%d requests for the first file, want 2", n)
+	}
+	if n := server.numRequests("/seed/dir/second.bin"); n != 4 {
+		t.Errorf("%d requests for the second file, want 4", n)
+	}
+}
+
+func TestWebSeedWithoutRanges(t *testing.T) {
+	torrent, data := testTorrent("file.bin", []testFile{{path: "file.bin", data: randomData(4, 20*testPieceLength)}})
+	server, httpServer := startTestServer(t, map[string][]byte{"/file.bin": data}, false)
+
+	// The pieces of the first responses are still good, then the web seed gives up
+	pieces := runWebSeed(t, httpServer.URL+"/file.bin", torrent)
+	if len(pieces) == 0 || len(pieces) > webSeedWorkers {
+		t.Fatalf("got %d pieces, want at least one and one per worker at most", len(pieces))
+	}
+	checkPieces(t, pieces, data)
+	if n := server.numRequests("/file.bin"); n > webSeedWorkers {
+		t.Errorf("%d requests after the server ignored the range", n)
+	}
+}
+
+func TestWebSeedHashMismatch(t *testing.T) {
+	torrent, data := testTorrent("file.bin", []testFile{{path: "file.bin", data: randomData(5, 4*testPieceLength)}})
+	server, httpServer := startTestServer(t, map[string][]byte{"/file.bin": data}, true)
+	badRange := "bytes=16384-32767" // the second piece
+	corrupted := false
+	server.corrupt = func(path string, rangeHeader string, body []byte) []byte {
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+		if rangeHeader != badRange || corrupted {
+			return body
+		}
+		corrupted = true
+		body = append([]byte(nil), body...)
+		body[testPieceLength] ^= 0xff
+		return body
+	}
+
+	pieces := runWebSeed(t, httpServer.URL+"/file.bin", torrent)
+	if len(pieces) != torrent.NumPieces {
+		t.Fatalf("got %d of %d pieces", len(pieces), torrent.NumPieces)
+	}
+	checkPieces(t, pieces, data)
+	retries := 0
+	server.mutex.Lock()
+	for _, rangeHeader := range server.requests["/file.bin"] {
+		if rangeHeader == badRange {
+			retries++
+		}
+	}
+	server.mutex.Unlock()
+	if !corrupted || retries != 2 {
+		t.Fatalf("the corrupted piece was fetched %d times, want 2", retries)
+	}
+}
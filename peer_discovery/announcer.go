@@ -0,0 +1,254 @@
+package peer_discovery
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const defaultAnnounceInterval = 30 * time.Minute // used until the tracker sends its own
+const minRetryDelay = 1 * time.Minute
+const stopTimeout = 5 * time.Second // how long shutdown waits for the stopped announces
+
+// Stats reports the transfer counters sent with every announce
+type Stats func() (uploaded int64, downloaded int64, left int64)
+
+// TrackerStatus is the outcome of the last announce to one tracker
+type TrackerStatus struct {
+	URL          string
+	Tier         int
+	LastAnnounce time.Time
+	LastError    error // nil if the last announce succeeded
+	Peers        int   // peers returned by the last successful announce
+	Seeders      int
+	Leechers     int
+}
+
+type tracker struct {
+	status  TrackerStatus
+	started bool // the tracker accepted our started event and hasn't been stopped
+}
+
+// TrackerIDs holds the tracker ids trackers gave us, by URL, to be sent back
+// on every announce. It belongs to the torrent rather than an announcer, so
+// the ids outlive the announcer of a paused torrent. The zero value is empty
+// and ready to use.
+type TrackerIDs struct {
+	mutex sync.Mutex
+	ids   map[string]string
+}
+
+func (trackerIDs *TrackerIDs) get(url string) string {
+	trackerIDs.mutex.Lock()
+	defer trackerIDs.mutex.Unlock()
+	return trackerIDs.ids[url]
+}
+
+func (trackerIDs *TrackerIDs) set(url string, id string) {
+	trackerIDs.mutex.Lock()
+	defer trackerIDs.mutex.Unlock()
+	if trackerIDs.ids == nil {
+		trackerIDs.ids = make(map[string]string)
+	}
+	trackerIDs.ids[url] = id
+}
+
+/*
+Announcer keeps the torrent's trackers informed for the lifetime of a download:
+it sends started first, re-announces on the tracker's interval with up to date
+counters, sends completed once all pieces are written and stopped on shutdown.
+Failed announces are retried with a backoff that doubles up to the interval.
+
+See: https://www.bittorrent.org/beps/bep_0012.html
+Trackers are grouped in tiers. The trackers of each tier are shuffled once, then
+every announce tries them tier by tier until one answers, and that tracker is
+moved to the front of its tier so it is tried first next time.
+*/
+type Announcer struct {
+	request    AnnounceRequest
+	stats      Stats
+	onPeers    func([]Peer)
+	trackerIDs *TrackerIDs
+	mutex      sync.Mutex
+	tiers      [][]*tracker
+	completed  chan struct{}
+	stop       chan struct{}
+	done       chan struct{}
+	once       sync.Once
+}
+
+// NewAnnouncer creates an announcer for the tiers of trackers. onPeers is
+// called with the peers of every successful announce. Tracker ids are read
+// from and saved to trackerIDs.
+func NewAnnouncer(tiers [][]string, torrent *Torrent, stats Stats, onPeers func([]Peer), trackerIDs *TrackerIDs) *Announcer {
+	announcer := Announcer{
+		request: AnnounceRequest{
+			InfoHash: torrent.InfoHash,
+			PeerID:   torrent.PeerID,
+			Port:     torrent.Port,
+		},
+		stats:      stats,
+		onPeers:    onPeers,
+		trackerIDs: trackerIDs,
+		completed:  make(chan struct{}),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	for tierIndex, tier := range tiers {
+		trackers := make([]*tracker, 0, len(tier))
+		for _, url := range tier {
+			trackers = append(trackers, &tracker{status: TrackerStatus{URL: url, Tier: tierIndex}})
+		}
+		rand.Shuffle(len(trackers), func(i int, j int) {
+			trackers[i], trackers[j] = trackers[j], trackers[i]
+		})
+		announcer.tiers = append(announcer.tiers, trackers)
+	}
+	return &announcer
+}
+
+func (announcer *Announcer) Start() {
+	go announcer.run()
+}
+
+// Completed tells the tracker the download finished
+func (announcer *Announcer) Completed() {
+	announcer.once.Do(func() {
+		close(announcer.completed)
+	})
+}
+
+// Stop sends the stopped event and waits a short time for it to go out
+func (announcer *Announcer) Stop() {
+	close(announcer.stop)
+	select {
+	case <-announcer.done:
+	case <-time.After(stopTimeout):
+		log.Println("trackers did not answer the stopped announce in time")
+	}
+}
+
+// Status returns the state of every tracker, tier by tier in the order they are tried
+func (announcer *Announcer) Status() []TrackerStatus {
+	announcer.mutex.Lock()
+	defer announcer.mutex.Unlock()
+	var statuses []TrackerStatus
+	for _, tier := range announcer.tiers {
+		for _, tracker := range tier {
+			statuses = append(statuses, tracker.status)
+		}
+	}
+	return statuses
+}
+
+func (announcer *Announcer) announceTo(tracker *tracker, event Event) (*AnnounceResponse, error) {
+	request := announcer.request
+	request.Uploaded, request.Downloaded, request.Left = announcer.stats()
+	request.Event = event
+	request.TrackerID = announcer.trackerIDs.get(tracker.status.URL)
+	response, err := Announce(tracker.status.URL, request)
+
+	announcer.mutex.Lock()
+	defer announcer.mutex.Unlock()
+	tracker.status.LastAnnounce = time.Now()
+	tracker.status.LastError = err
+	if err != nil {
+		return nil, err
+	}
+	tracker.status.Peers = len(response.Peers)
+	tracker.status.Seeders = response.Seeders
+	tracker.status.Leechers = response.Leechers
+	tracker.started = event != EventStopped
+	if response.TrackerID != "" {
+		announcer.trackerIDs.set(tracker.status.URL, response.TrackerID)
+	}
+	return response, nil
+}
+
+// promote moves the tracker to the front of its tier
+func (announcer *Announcer) promote(tierIndex int, trackerIndex int) {
+	announcer.mutex.Lock()
+	defer announcer.mutex.Unlock()
+	tier := announcer.tiers[tierIndex]
+	tracker := tier[trackerIndex]
+	copy(tier[1:trackerIndex+1], tier[:trackerIndex])
+	tier[0] = tracker
+}
+
+// announce sends event to the first tracker that answers. A tracker that
+// hasn't accepted our started event yet is sent started instead.
+func (announcer *Announcer) announce(event Event) (*AnnounceResponse, error) {
+	err := errors.New("torrent has no trackers")
+	for tierIndex, tier := range announcer.tiers {
+		for trackerIndex, tracker := range tier {
+			trackerEvent := event
+			if !tracker.started {
+				trackerEvent = EventStarted
+			}
+
+			response, announceErr := announcer.announceTo(tracker, trackerEvent)
+			if announceErr != nil {
+				log.Printf("announce to tracker [%s] failed: %v\n", tracker.status.URL, announceErr)
+				err = announceErr
+				continue
+			}
+			log.Printf("tracker [%s] returned %d peers (%d seeders, %d leechers)\n", tracker.status.URL, len(response.Peers), response.Seeders, response.Leechers)
+			announcer.promote(tierIndex, trackerIndex)
+			return response, nil
+		}
+	}
+	return nil, err
+}
+
+// announceStopped tells every tracker that accepted our started event that we are leaving
+func (announcer *Announcer) announceStopped() {
+	for _, tier := range announcer.tiers {
+		for _, tracker := range tier {
+			if !tracker.started {
+				continue
+			}
+			_, err := announcer.announceTo(tracker, EventStopped)
+			if err != nil {
+				log.Printf("stopped announce to tracker [%s] failed: %v\n", tracker.status.URL, err)
+			}
+		}
+	}
+}
+
+func (announcer *Announcer) run() {
+	defer close(announcer.done)
+	event := EventNone
+	completed := announcer.completed
+	retryDelay := minRetryDelay
+	for {
+		var wait time.Duration
+		response, err := announcer.announce(event)
+		if err != nil {
+			wait = retryDelay
+			retryDelay = min(retryDelay*2, defaultAnnounceInterval)
+		} else {
+			event = EventNone
+			retryDelay = minRetryDelay
+			wait = max(response.Interval, response.MinInterval)
+			if wait == 0 {
+				wait = defaultAnnounceInterval
+			}
+			announcer.onPeers(response.Peers)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-completed:
+			timer.Stop()
+			completed = nil
+			event = EventCompleted
+		case <-announcer.stop:
+			timer.Stop()
+			announcer.announceStopped()
+			return
+		}
+	}
+}
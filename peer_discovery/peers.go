@@ -13,8 +13,6 @@ import (
 	"net/url"
 	"strconv"
 	"time"
-
-	jackpal "github.com/jackpal/bencode-go"
 )
 
 type Torrent = bencode.TorrentType
@@ -22,10 +20,20 @@ type SafeWriter = safeio.SafeWriter
 type SafeReader = safeio.SafeReader
 
 const protocolID uint64 = 0x41727101980 //Note magic constant for udp tracker
-const udpMaxRetries = 8
+
+// A UDP tracker is given 15*2^n seconds for n up to 2 before the next tracker
+// of its tier is tried
+const udpMaxRetries = 3
 const udpConnectAction = uint32(0)
 const udpAnnounceAction = uint32(1)
+const udpErrorAction = uint32(3)
 const udpWait = 15 * time.Second
+const compactPeerSize = 6   // 4 bytes IPv4, 2 bytes port
+const compactPeer6Size = 18 // 16 bytes IPv6, 2 bytes port
+
+// sessionKey is sent as the key of every announce. It lets trackers recognise
+// us when our IP address changes, so it stays the same for the whole session.
+var sessionKey = rand.Uint32()
 
 type udpResponse struct {
 	Interval uint64 `bencode:"interval"`
@@ -33,10 +41,58 @@ type udpResponse struct {
 }
 
 type httpResponse struct {
-	Complete   uint64      `bencode:"complete"`
-	Incomplete uint64      `bencode:"incomplete"`
-	Interval   uint64      `bencode:"interval"`
-	Peers      interface{} `bencode:"peers"`
+	FailureReason string        `bencode:"failure reason"`
+	Complete      uint64        `bencode:"complete"`
+	Incomplete    uint64        `bencode:"incomplete"`
+	Interval      uint64        `bencode:"interval"`
+	MinInterval   uint64        `bencode:"min interval"`
+	Peers         bencode.Value `bencode:"peers"`  // compact string or list of dictionaries
+	Peers6        string        `bencode:"peers6"` // compact IPv6 peers, see BEP 7
+	TrackerID     string        `bencode:"tracker id"`
+}
+
+// Event tells the tracker where in its lifecycle a download is. The values
+// are the ones the UDP protocol sends.
+type Event uint32
+
+const (
+	EventNone      Event = 0
+	EventCompleted Event = 1
+	EventStarted   Event = 2
+	EventStopped   Event = 3
+)
+
+func (event Event) String() string {
+	switch event {
+	case EventCompleted:
+		return "completed"
+	case EventStarted:
+		return "started"
+	case EventStopped:
+		return "stopped"
+	default:
+		return ""
+	}
+}
+
+type AnnounceRequest struct {
+	InfoHash   [20]byte
+	PeerID     [20]byte
+	Port       uint16
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      Event
+	TrackerID  string // the tracker id the tracker gave us in an earlier response, if any
+}
+
+type AnnounceResponse struct {
+	Interval    time.Duration
+	MinInterval time.Duration // zero if the tracker didn't send one
+	Seeders     int
+	Leechers    int
+	Peers       []Peer
+	TrackerID   string // to be sent back on later announces, empty if the tracker didn't set one
 }
 
 type Peer struct {
@@ -52,43 +108,60 @@ func (p *Peer) GetTCPAddress() string {
 	)
 }
 
+// GetPeers announces to the torrent's tracker without an event and returns the peers
 func GetPeers(t *Torrent, peerID [20]byte, port uint16) (*[]Peer, error) {
-	protocol, err := url.Parse(t.Announce)
+	response, err := Announce(t.Announce, AnnounceRequest{
+		InfoHash: t.InfoHash,
+		PeerID:   peerID,
+		Port:     port,
+		Left:     t.Length,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &response.Peers, nil
+}
+
+func Announce(tracker string, request AnnounceRequest) (*AnnounceResponse, error) {
+	protocol, err := url.Parse(tracker)
 	if err != nil {
 		log.Println(err)
 		return nil, err
 	}
 
-	fmt.Println(protocol.Scheme)
 	switch protocol.Scheme {
 	case "http", "https":
-		return buildHTTP(t, peerID, port)
+		return buildHTTP(protocol, request)
 	case "udp":
-		return buildUDP(t, peerID, port)
+		return buildUDP(protocol, request)
 	default:
 		return nil, fmt.Errorf("unsupported protocol scheme %s", protocol.Scheme)
 	}
 }
 
-func buildHTTP(t *bencode.TorrentType, peerID [20]byte, port uint16) (*[]Peer, error) {
-	base, err := url.Parse(t.Announce)
-	if err != nil {
-		return nil, err
-	}
-	params := url.Values{}
-	params.Add("info_hash", string(t.InfoHash[:]))
-	params.Add("peer_id", string(peerID[:]))
-	params.Add("port", strconv.Itoa(int(port)))
-	params.Add("uploaded", strconv.Itoa(0))
-	params.Add("downloaded", strconv.Itoa(0))
+func buildHTTP(base *url.URL, request AnnounceRequest) (*AnnounceResponse, error) {
+	params := base.Query()
+	params.Add("info_hash", string(request.InfoHash[:]))
+	params.Add("peer_id", string(request.PeerID[:]))
+	params.Add("port", strconv.Itoa(int(request.Port)))
+	params.Add("uploaded", strconv.FormatInt(request.Uploaded, 10))
+	params.Add("downloaded", strconv.FormatInt(request.Downloaded, 10))
 	params.Add("compact", strconv.Itoa(1))
-	params.Add("left", strconv.Itoa(int(t.Length)))
+	params.Add("left", strconv.FormatInt(request.Left, 10))
+	params.Add("key", fmt.Sprintf("%08x", sessionKey))
+	if request.Event != EventNone {
+		params.Add("event", request.Event.String())
+	}
+	if request.TrackerID != "" {
+		params.Add("trackerid", request.TrackerID)
+	}
 
-	base.RawQuery = params.Encode()
-	return httpQueryTracker(base.String())
+	query := *base
+	query.RawQuery = params.Encode()
+	return httpQueryTracker(query.String())
 }
 
-func httpQueryTracker(queryString string) (*[]Peer, error) {
+func httpQueryTracker(queryString string) (*AnnounceResponse, error) {
 	c := &http.Client{Timeout: 15 * time.Second}
 	resp, err := c.Get(queryString)
 	if err != nil {
@@ -99,38 +172,68 @@ func httpQueryTracker(queryString string) (*[]Peer, error) {
 
 	httpResponse := httpResponse{}
 
-	err = jackpal.Unmarshal(resp.Body, &httpResponse)
+	err = bencode.NewDecoder(resp.Body).Decode(&httpResponse)
 	if err != nil {
 		log.Println(err)
 		return nil, err
 	}
+	if httpResponse.FailureReason != "" {
+		return nil, fmt.Errorf("tracker failure: %s", httpResponse.FailureReason)
+	}
 
-	return httpExtractPeers(&httpResponse)
+	peers, err := httpExtractPeers(&httpResponse)
+	if err != nil {
+		return nil, err
+	}
+	return &AnnounceResponse{
+		Interval:    time.Duration(httpResponse.Interval) * time.Second,
+		MinInterval: time.Duration(httpResponse.MinInterval) * time.Second,
+		Seeders:     int(httpResponse.Complete),
+		Leechers:    int(httpResponse.Incomplete),
+		Peers:       *peers,
+		TrackerID:   httpResponse.TrackerID,
+	}, nil
 }
 
 func httpExtractPeers(hResp *httpResponse) (*[]Peer, error) {
-	switch peers := hResp.Peers.(type) {
-	case string:
-		return parseCompactPeers([]byte(peers))
-	case []interface{}:
-		return parseDictPeers(peers)
+	var peers *[]Peer
+	var err error
+	switch hResp.Peers.Kind {
+	case bencode.KindString:
+		peers, err = parseCompactPeers([]byte(hResp.Peers.Str), compactPeerSize)
+	case bencode.KindList:
+		peers, err = parseDictPeers(hResp.Peers.List)
+	case bencode.KindInvalid:
+		peers = &[]Peer{}
 	default:
 		return nil, fmt.Errorf("invalid peer format")
 	}
+	if err != nil {
+		return nil, err
+	}
+
+	if hResp.Peers6 != "" {
+		peers6, err := parseCompactPeers([]byte(hResp.Peers6), compactPeer6Size)
+		if err != nil {
+			return nil, err
+		}
+		*peers = append(*peers, *peers6...)
+	}
+	return peers, nil
 }
 
-func parseCompactPeers(data []byte) (*[]Peer, error) {
-	const peerSize = 6
+// parseCompactPeers reads peers packed as an address of peerSize-2 bytes
+// followed by a 2 byte port, 6 bytes per peer for IPv4 and 18 for IPv6.
+func parseCompactPeers(data []byte, peerSize int) (*[]Peer, error) {
 	if len(data)%peerSize != 0 {
 		return nil, fmt.Errorf("malformed peers")
 	}
-	numPeers := len(data) / peerSize
-	peers := make([]Peer, 0, numPeers)
+	ipSize := peerSize - 2
+	peers := make([]Peer, 0, len(data)/peerSize)
 
-	for i := 0; i < numPeers; i += peerSize {
-		offset := i * peerSize
-		ip := net.IP(data[offset : offset+4]).String()
-		port := binary.BigEndian.Uint16(data[offset+4 : offset+6])
+	for offset := 0; offset < len(data); offset += peerSize {
+		ip := net.IP(data[offset : offset+ipSize]).String()
+		port := binary.BigEndian.Uint16(data[offset+ipSize : offset+peerSize])
 		peers = append(peers, Peer{
 			IP:   ip,
 			Port: port,
@@ -139,15 +242,22 @@ func parseCompactPeers(data []byte) (*[]Peer, error) {
 	return &peers, nil
 }
 
-func parseDictPeers(list []interface{}) (*[]Peer, error) {
+func parseDictPeers(list []bencode.Value) (*[]Peer, error) {
 	peers := make([]Peer, 0, len(list))
 
 	for _, p := range list {
-		m := p.(map[string]interface{})
+		ip, ok := p.GetString("ip")
+		if !ok {
+			return nil, fmt.Errorf("peer has no ip")
+		}
+		port, ok := p.GetInt("port")
+		if !ok || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("peer %s has an invalid port", ip)
+		}
 
 		peers = append(peers, Peer{
-			IP:   m["ip"].(string),
-			Port: uint16(m["port"].(int64)),
+			IP:   ip,
+			Port: uint16(port),
 		})
 	}
 
@@ -158,17 +268,10 @@ func parseDictPeers(list []interface{}) (*[]Peer, error) {
 See: https://xbtt.sourceforge.net/udp_tracker_protocol.html
 for formats of inputs/outputs
 */
-func buildUDP(t *Torrent, peerID [20]byte, port uint16) (*[]Peer, error) {
+func buildUDP(u *url.URL, request AnnounceRequest) (*AnnounceResponse, error) {
 	// Dial tracker
-	u, err := url.Parse(t.Announce)
-	if err != nil {
-		log.Fatal(err)
-		return nil, err
-	}
-
 	raddr, err := net.ResolveUDPAddr("udp", u.Host)
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
 
@@ -183,7 +286,7 @@ func buildUDP(t *Torrent, peerID [20]byte, port uint16) (*[]Peer, error) {
 		return nil, err
 	}
 
-	return udpAnnounce(conn, raddr, connID, t, peerID, port)
+	return udpAnnounce(conn, raddr, connID, request)
 
 }
 
@@ -209,12 +312,16 @@ func udpConnect(conn *net.UDPConn, raddr *net.UDPAddr) (uint64, error) {
 		}
 
 		_ = conn.SetReadDeadline(time.Now().Add(timeout))
-		resp := make([]byte, 16)
+		resp := make([]byte, 1500)
 		n, _, err := conn.ReadFromUDP(resp)
 		if err != nil {
 			timeout *= 2
 			continue
 		}
+		err = udpTrackerError(resp[:n], transactionID)
+		if err != nil {
+			return 0, err
+		}
 		if n < 16 {
 			timeout *= 2
 			continue
@@ -244,7 +351,7 @@ func udpConnect(conn *net.UDPConn, raddr *net.UDPAddr) (uint64, error) {
 	return 0, fmt.Errorf("failed to connect to %s", raddr.String())
 }
 
-func udpAnnounce(conn *net.UDPConn, raddr *net.UDPAddr, respConnectionID uint64, t *Torrent, peerID [20]byte, port uint16) (*[]Peer, error) {
+func udpAnnounce(conn *net.UDPConn, raddr *net.UDPAddr, respConnectionID uint64, request AnnounceRequest) (*AnnounceResponse, error) {
 	timeout := udpWait
 	for attempt := 0; attempt < udpMaxRetries; attempt++ {
 		transactionID := rand.Uint32()
@@ -256,17 +363,17 @@ func udpAnnounce(conn *net.UDPConn, raddr *net.UDPAddr, respConnectionID uint64,
 		safeWriter.WriteBigEndian(uint32(1)) // action
 		safeWriter.WriteBigEndian(transactionID)
 
-		buf.Write(t.InfoHash[:])
-		buf.Write(peerID[:])
+		buf.Write(request.InfoHash[:])
+		buf.Write(request.PeerID[:])
 
-		safeWriter.WriteBigEndian(uint64(0))        // downloaded
-		safeWriter.WriteBigEndian(uint64(t.Length)) // left
-		safeWriter.WriteBigEndian(uint64(0))        // uploaded
-		safeWriter.WriteBigEndian(uint32(2))        // event
-		safeWriter.WriteBigEndian(uint32(0))        // IP address
-		safeWriter.WriteBigEndian(rand.Uint32())    // key
-		safeWriter.WriteBigEndian(int32(-1))        // num_want
-		safeWriter.WriteBigEndian(port)
+		safeWriter.WriteBigEndian(request.Downloaded)    // downloaded
+		safeWriter.WriteBigEndian(request.Left)          // left
+		safeWriter.WriteBigEndian(request.Uploaded)      // uploaded
+		safeWriter.WriteBigEndian(uint32(request.Event)) // event
+		safeWriter.WriteBigEndian(uint32(0))             // IP address
+		safeWriter.WriteBigEndian(sessionKey)            // key
+		safeWriter.WriteBigEndian(int32(-1))             // num_want
+		safeWriter.WriteBigEndian(request.Port)
 
 		if safeWriter.GetError() != nil {
 			return nil, safeWriter.GetError()
@@ -285,14 +392,16 @@ func udpAnnounce(conn *net.UDPConn, raddr *net.UDPAddr, respConnectionID uint64,
 			timeout *= 2
 			continue
 		}
+		announceResp := announceBuf[:n]
+		err = udpTrackerError(announceResp, transactionID)
+		if err != nil {
+			return nil, err
+		}
 		if n < 20 {
 			timeout *= 2
 			continue
 		}
 
-		announceResp := announceBuf[:n]
-
-		fmt.Printf("Size of resp: %v", n)
 		var announceAction = binary.BigEndian.Uint32(announceResp[0:4])
 		var announceTransactionID = binary.BigEndian.Uint32(announceResp[4:8])
 
@@ -305,38 +414,61 @@ func udpAnnounce(conn *net.UDPConn, raddr *net.UDPAddr, respConnectionID uint64,
 		var announceLeechers = binary.BigEndian.Uint32(announceResp[12:16])
 		var announceSeeders = binary.BigEndian.Uint32(announceResp[16:20])
 
-		fmt.Printf("\nLeechers : %v |\t", announceLeechers)
-		fmt.Printf("Seeders: %v\n", announceSeeders)
 		trackerResponse := udpResponse{}
 		trackerResponse.Interval = uint64(announceInterval)
 		trackerResponse.Peers = announceResp[20:]
-		return udpExtractPeers(&trackerResponse)
+		// Trackers reached over IPv6 answer with IPv6 peers, see BEP 15
+		peerSize := compactPeerSize
+		if raddr.IP.To4() == nil {
+			peerSize = compactPeer6Size
+		}
+		peers, err := udpExtractPeers(&trackerResponse, peerSize)
+		if err != nil {
+			return nil, err
+		}
+		return &AnnounceResponse{
+			Interval: time.Duration(announceInterval) * time.Second,
+			Seeders:  int(announceSeeders),
+			Leechers: int(announceLeechers),
+			Peers:    *peers,
+		}, nil
 	}
 	return nil, fmt.Errorf("failed announce to %s", raddr.String())
 }
 
-func udpExtractPeers(uResp *udpResponse) (*[]Peer, error) {
-	const peerSize = 6 // 4 bytes IP, 2 bytes Port
-	numPeers := len(uResp.Peers) / peerSize
-	fmt.Printf("Number of peers: %d\n", numPeers)
+// udpTrackerError returns the message of an error response to the
+// transaction, or nil if resp is not one
+func udpTrackerError(resp []byte, transactionID uint32) error {
+	if len(resp) < 8 {
+		return nil
+	}
+	if binary.BigEndian.Uint32(resp[0:4]) != udpErrorAction || binary.BigEndian.Uint32(resp[4:8]) != transactionID {
+		return nil
+	}
+	return fmt.Errorf("tracker failure: %s", resp[8:])
+}
 
+func udpExtractPeers(uResp *udpResponse, peerSize int) (*[]Peer, error) {
 	if len(uResp.Peers)%peerSize != 0 {
 		err := fmt.Errorf("malformed peers received from tracker")
 		return nil, err
 	}
+	return parseCompactPeers(uResp.Peers, peerSize)
+}
 
-	peers := make([]Peer, 0, numPeers)
-	for i := 0; i < len(uResp.Peers); i += peerSize {
-		ipBytes := uResp.Peers[i : i+4]
-		port := binary.BigEndian.Uint16(uResp.Peers[i+4 : i+6])
-
-		ipStr := fmt.Sprintf("%d.%d.%d.%d", ipBytes[0], ipBytes[1], ipBytes[2], ipBytes[3])
-
-		peers = append(peers, Peer{
-			IP:   ipStr,
-			Port: port,
-		})
+// MergePeers combines peer lists from several sources, dropping duplicate addresses
+func MergePeers(lists ...[]Peer) []Peer {
+	seen := make(map[string]bool)
+	var merged []Peer
+	for _, list := range lists {
+		for _, peer := range list {
+			address := peer.GetTCPAddress()
+			if seen[address] {
+				continue
+			}
+			seen[address] = true
+			merged = append(merged, peer)
+		}
 	}
-
-	return &peers, nil
+	return merged
 }
@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"io"
+	"net"
+)
+
+const chunkSize = 16 * 1024 // largest read that waits for tokens at once
+
+// Conn is a connection to a peer whose reads go through its limits. Reads wait
+// for tokens after the data arrived, so a read blocked on the peer can still
+// be interrupted with a deadline. Writes are not limited: only the piece data
+// we upload counts, and the sender waits for it with WaitUpload before it
+// writes the message, so control messages never queue behind the limit.
+type Conn struct {
+	net.Conn
+	peer *PeerLimits
+}
+
+// Conn limits the traffic of a connection to a peer of the torrent. Without
+// limits the connection is returned as it is.
+func (torrent *TorrentLimits) Conn(conn net.Conn) net.Conn {
+	if torrent == nil {
+		return conn
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		host = conn.RemoteAddr().String()
+	}
+	return &Conn{Conn: conn, peer: torrent.NewPeer(IsLAN(host))}
+}
+
+func (conn *Conn) Read(p []byte) (int, error) {
+	if len(p) > chunkSize {
+		p = p[:chunkSize]
+	}
+	n, err := conn.Conn.Read(p)
+	if n > 0 {
+		conn.peer.waitDownload(n)
+	}
+	return n, err
+}
+
+// WaitUpload waits until n bytes of piece data may be sent to the peer
+func (conn *Conn) WaitUpload(n int) {
+	conn.peer.waitUpload(n)
+}
+
+type reader struct {
+	reader io.Reader
+	peer   *PeerLimits
+}
+
+// Reader limits the data read from reader as downloaded from the peer, e.g.
+// the body of a web seed response
+func (peer *PeerLimits) Reader(r io.Reader) io.Reader {
+	if peer == nil {
+		return r
+	}
+	return &reader{reader: r, peer: peer}
+}
+
+func (limited *reader) Read(p []byte) (int, error) {
+	if len(p) > chunkSize {
+		p = p[:chunkSize]
+	}
+	n, err := limited.reader.Read(p)
+	if n > 0 {
+		limited.peer.waitDownload(n)
+	}
+	return n, err
+}
@@ -0,0 +1,180 @@
+package ratelimit
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Traffic is limited with token buckets. Tokens come in at the limiter's rate in
+bytes per second and the bucket holds at most a second's worth, so a limiter
+allows short bursts after being idle. Every byte takes a token; a transfer that
+takes more tokens than there are leaves the bucket in debt and waits until the
+debt is paid back.
+
+Peer traffic goes through three levels of limiters: the global ones shared by
+every torrent, the torrent's own and the peer's own. Every level can be changed
+at runtime with SetRate. Peers on the local network can be exempt from all of
+them.
+*/
+
+const minBurst = 16 * 1024 // a whole block goes through an idle limiter without waiting
+
+// Limiter is a token bucket. A rate of zero or less is unlimited.
+type Limiter struct {
+	rate   *atomic.Int64 // shared with the copies of the limiter
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time // when tokens were last added, zero for a full bucket
+}
+
+func NewLimiter(rate int64) *Limiter {
+	limiter := Limiter{rate: new(atomic.Int64)}
+	limiter.rate.Store(rate)
+	return &limiter
+}
+
+// Copy returns a limiter with a bucket of its own that follows the rate of
+// this one, so every peer can get one and a single SetRate changes them all
+func (limiter *Limiter) Copy() *Limiter {
+	return &Limiter{rate: limiter.rate}
+}
+
+// SetRate changes the rate of the limiter and its copies
+func (limiter *Limiter) SetRate(rate int64) {
+	limiter.rate.Store(rate)
+}
+
+func (limiter *Limiter) Rate() int64 {
+	return limiter.rate.Load()
+}
+
+// reserve takes n tokens and returns how long to wait before using them
+func (limiter *Limiter) reserve(n int) time.Duration {
+	rate := limiter.rate.Load()
+	if rate <= 0 {
+		return 0
+	}
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	burst := float64(max(rate, minBurst))
+	now := time.Now()
+	if limiter.last.IsZero() {
+		limiter.tokens = burst
+	} else {
+		limiter.tokens = min(limiter.tokens+now.Sub(limiter.last).Seconds()*float64(rate), burst)
+	}
+	limiter.last = now
+	limiter.tokens -= float64(n)
+	if limiter.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-limiter.tokens / float64(rate) * float64(time.Second))
+}
+
+// wait blocks until n bytes are allowed through every limiter, nil ones are skipped
+func wait(n int, limiters ...*Limiter) {
+	var delay time.Duration
+	for _, limiter := range limiters {
+		if limiter != nil {
+			delay = max(delay, limiter.reserve(n))
+		}
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// Limits are the global limits, shared by every torrent
+type Limits struct {
+	Download     *Limiter
+	Upload       *Limiter
+	PeerDownload *Limiter // the rate of every peer's own limiter
+	PeerUpload   *Limiter
+	exemptLAN    atomic.Bool
+}
+
+func NewLimits(download int64, upload int64, peerDownload int64, peerUpload int64, exemptLAN bool) *Limits {
+	limits := Limits{
+		Download:     NewLimiter(download),
+		Upload:       NewLimiter(upload),
+		PeerDownload: NewLimiter(peerDownload),
+		PeerUpload:   NewLimiter(peerUpload),
+	}
+	limits.exemptLAN.Store(exemptLAN)
+	return &limits
+}
+
+// SetExemptLAN decides whether peers on the local network are limited
+func (limits *Limits) SetExemptLAN(exemptLAN bool) {
+	limits.exemptLAN.Store(exemptLAN)
+}
+
+func (limits *Limits) ExemptLAN() bool {
+	return limits.exemptLAN.Load()
+}
+
+// TorrentLimits are the limits of one torrent, on top of the global ones
+type TorrentLimits struct {
+	limits   *Limits
+	Download *Limiter
+	Upload   *Limiter
+}
+
+func (limits *Limits) NewTorrent(download int64, upload int64) *TorrentLimits {
+	return &TorrentLimits{
+		limits:   limits,
+		Download: NewLimiter(download),
+		Upload:   NewLimiter(upload),
+	}
+}
+
+// PeerLimits limit the traffic of one peer or web seed
+type PeerLimits struct {
+	torrent  *TorrentLimits
+	download *Limiter
+	upload   *Limiter
+	lan      bool
+}
+
+// NewPeer creates the limiters of a peer, lan tells whether it is on the local
+// network. Without torrent limits there is nothing to limit and it returns nil.
+func (torrent *TorrentLimits) NewPeer(lan bool) *PeerLimits {
+	if torrent == nil {
+		return nil
+	}
+	return &PeerLimits{
+		torrent:  torrent,
+		download: torrent.limits.PeerDownload.Copy(),
+		upload:   torrent.limits.PeerUpload.Copy(),
+		lan:      lan,
+	}
+}
+
+func (peer *PeerLimits) exempt() bool {
+	return peer.lan && peer.torrent.limits.ExemptLAN()
+}
+
+func (peer *PeerLimits) waitDownload(n int) {
+	if !peer.exempt() {
+		wait(n, peer.torrent.limits.Download, peer.torrent.Download, peer.download)
+	}
+}
+
+func (peer *PeerLimits) waitUpload(n int) {
+	if !peer.exempt() {
+		wait(n, peer.torrent.limits.Upload, peer.torrent.Upload, peer.upload)
+	}
+}
+
+// IsLAN reports whether host, an IP address or a name, is on the local network
+func IsLAN(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast())
+}
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"GoTorrent/bencode"
+	"GoTorrent/dht"
+	"GoTorrent/magnet"
+	"GoTorrent/networking"
+	"GoTorrent/peer_discovery"
+	"GoTorrent/ratelimit"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+A session downloads any number of torrents at once. What can be shared is
+owned by the session: the listener, which routes every incoming handshake to
+the torrent with its infohash, the DHT node, the global rate limits, the
+connection limit and the disk writers. Everything else belongs to the torrent.
+
+A torrent keeps its storage for as long as it is in the session, and while it
+isn't paused it also runs a scheduler, a connection manager, its web seeds,
+announcer and DHT announces. Pausing stops all of them and waits for the
+pieces already downloaded to be written before the resume file is saved, so
+resuming starts over with a new scheduler from what is on disk.
+*/
+
+// SessionTorrent is a torrent of the session
+type SessionTorrent struct {
+	session    *Session
+	torrent    *bencode.TorrentType
+	storage    *networking.Storage
+	limits     *ratelimit.TorrentLimits
+	resumePath string
+	isMagnet   bool
+	peers      []peer_discovery.Peer // found while loading a magnet link, dialed on the first start
+	started    bool
+	mutex      sync.Mutex  // held while the torrent is paused, resumed or rechecked
+	run        *torrentRun // nil while paused
+	removed    bool        // the storage is closed
+	completion sync.Mutex  // keeps the run from finishing while file priorities change
+	completed  chan struct{}
+	once       sync.Once
+	trackerIDs peer_discovery.TrackerIDs // outlive the announcer of each run
+}
+
+// torrentRun is everything that runs while a torrent isn't paused
+type torrentRun struct {
+	scheduler *networking.Scheduler
+	manager   *networking.ConnectionManager
+	results   chan *networking.WorkResults
+	written   chan struct{} // closed once every result was written
+	announcer *peer_discovery.Announcer
+	stop      chan struct{}
+	workers   sync.WaitGroup // web seeds and the goroutines watching stop
+}
+
+func (sessionTorrent *SessionTorrent) InfoHash() [20]byte {
+	return sessionTorrent.torrent.InfoHash
+}
+
+func (sessionTorrent *SessionTorrent) Name() string {
+	return sessionTorrent.torrent.Name
+}
+
+// Limits returns the rate limits of the torrent, which can be changed while it runs
+func (sessionTorrent *SessionTorrent) Limits() *ratelimit.TorrentLimits {
+	return sessionTorrent.limits
+}
+
+// Completed returns a channel that is closed once every wanted piece is written
+func (sessionTorrent *SessionTorrent) Completed() <-chan struct{} {
+	return sessionTorrent.completed
+}
+
+// SetFilePriorities changes which files are downloaded and in which order. A
+// finished run closed its scheduler, so a complete torrent that wants pieces
+// again is restarted.
+func (sessionTorrent *SessionTorrent) SetFilePriorities(priorities []networking.Priority) error {
+	sessionTorrent.mutex.Lock()
+	defer sessionTorrent.mutex.Unlock()
+	if sessionTorrent.removed {
+		return errors.New("torrent was removed")
+	}
+	sessionTorrent.completion.Lock()
+	err := sessionTorrent.storage.SetFilePriorities(priorities)
+	if err != nil {
+		sessionTorrent.completion.Unlock()
+		return err
+	}
+	run := sessionTorrent.run
+	if run == nil {
+		// The next start reads them from the storage
+		sessionTorrent.completion.Unlock()
+		return nil
+	}
+	finished := run.scheduler.Closed()
+	if !finished {
+		err = run.scheduler.SetFilePriorities(priorities)
+	}
+	sessionTorrent.completion.Unlock()
+	if !finished || sessionTorrent.storage.Complete() {
+		return err
+	}
+
+	log.Printf("%s: files were added to the finished download, restarting it\n", sessionTorrent.torrent.Name)
+	sessionTorrent.session.stop(sessionTorrent)
+	return sessionTorrent.session.start(sessionTorrent)
+}
+
+// finishRun closes the scheduler once every wanted piece is written
+func (sessionTorrent *SessionTorrent) finishRun(scheduler *networking.Scheduler) bool {
+	sessionTorrent.completion.Lock()
+	defer sessionTorrent.completion.Unlock()
+	if !sessionTorrent.storage.Complete() {
+		return false
+	}
+	scheduler.Close()
+	return true
+}
+
+func (sessionTorrent *SessionTorrent) Paused() bool {
+	sessionTorrent.mutex.Lock()
+	defer sessionTorrent.mutex.Unlock()
+	return sessionTorrent.run == nil
+}
+
+// Session runs the torrents added to it with one listener, DHT node, set of
+// rate limits and disk writers
+type Session struct {
+	opts         downloadOptions
+	peerID       [20]byte
+	listener     *networking.Listener // nil if the port couldn't be opened
+	dhtServer    *dht.Server          // nil with the DHT disabled
+	limits       *ratelimit.Limits
+	connections  *networking.ConnectionLimiter
+	dialer       networking.Dialer
+	writer       *networking.DiskWriter
+	streamServer *networking.StreamServer // nil without -http
+	mutex        sync.Mutex
+	torrents     map[[20]byte]*SessionTorrent
+}
+
+// NewSession opens the listener and starts the DHT node and stream server
+// given by opts. Torrents are added with Add.
+func NewSession(opts downloadOptions) (*Session, error) {
+	peerID, err := GeneratePeerID(opts.PeerIDPrefix)
+	if err != nil {
+		return nil, err
+	}
+	rates := opts.RateLimits
+	session := Session{
+		opts:        opts,
+		peerID:      peerID,
+		limits:      ratelimit.NewLimits(rates.Download, rates.Upload, rates.PeerDownload, rates.PeerUpload, rates.ExemptLAN),
+		connections: networking.NewConnectionLimiter(opts.MaxPeers),
+		dialer:      networking.Dialer{Preferred: opts.Transport, Encryption: opts.Encryption},
+		torrents:    make(map[[20]byte]*SessionTorrent),
+	}
+
+	if opts.HTTPAddress != "" {
+		session.streamServer, err = networking.ListenStream(opts.HTTPAddress, opts.Readahead)
+		if err != nil {
+			return nil, err
+		}
+		go session.streamServer.Serve()
+		log.Printf("streaming at %s\n", session.streamServer.URL())
+	}
+
+	// Listen first so the DHT can share the uTP socket
+	session.listener, err = networking.Listen(fmt.Sprintf(":%d", opts.Port))
+	if err != nil {
+		log.Printf("not accepting incoming peers: %v\n", err)
+		session.listener = nil
+	} else {
+		session.listener.SetEncryption(opts.Encryption)
+		session.dialer.UTP = session.listener.UTP()
+		go session.listener.Serve()
+	}
+
+	if opts.DHT {
+		session.dhtServer, err = startDHT(opts, session.listener)
+		if err != nil {
+			log.Printf("DHT disabled: %v\n", err)
+			session.dhtServer = nil
+		}
+	}
+
+	session.writer = networking.NewDiskWriter(numWriters)
+	return &session, nil
+}
+
+// Limits returns the global rate limits, which can be changed while torrents run
+func (session *Session) Limits() *ratelimit.Limits {
+	return session.limits
+}
+
+// Add loads a torrent file or magnet link, checks the data already on disk
+// and starts downloading it
+func (session *Session) Add(source string) (*SessionTorrent, error) {
+	var torrent bencode.TorrentType
+	var peerList []peer_discovery.Peer
+	var err error
+	isMagnet := magnet.IsMagnet(source)
+	if isMagnet {
+		torrent, peerList, err = loadMagnet(source, session.peerID, uint16(session.opts.Port), session.dhtServer, &session.dialer)
+	} else {
+		torrent, err = loadTorrentFile(source, session.peerID, uint16(session.opts.Port))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if session.dhtServer != nil && !torrent.Private {
+		// Sent to peers in the PORT message, so they can add our node
+		torrent.DHTPort = uint16(session.dhtServer.Addr().Port)
+	}
+	if session.torrent(torrent.InfoHash) != nil {
+		return nil, fmt.Errorf("torrent %x is already in the session", torrent.InfoHash)
+	}
+
+	savePath := filepath.Join(session.opts.OutputDir, torrent.Name)
+	priorities, err := filePriorities(&torrent, session.opts)
+	if err != nil {
+		return nil, err
+	}
+	hasExistingData := bencode.HasExistingData(&torrent, savePath)
+	storage, err := networking.NewStorage(&torrent, savePath, priorities)
+	if err != nil {
+		return nil, err
+	}
+	sessionTorrent := &SessionTorrent{
+		session:   session,
+		torrent:   &torrent,
+		storage:   storage,
+		limits:    session.limits.NewTorrent(session.opts.RateLimits.TorrentDownload, session.opts.RateLimits.TorrentUpload),
+		isMagnet:  isMagnet,
+		peers:     peerList,
+		completed: make(chan struct{}),
+	}
+	if session.opts.ResumeDir != "" {
+		sessionTorrent.resumePath = filepath.Join(session.opts.ResumeDir, fmt.Sprintf("%x.resume", torrent.InfoHash))
+	}
+
+	session.mutex.Lock()
+	if _, ok := session.torrents[torrent.InfoHash]; ok {
+		session.mutex.Unlock()
+		storage.Close()
+		return nil, fmt.Errorf("torrent %x is already in the session", torrent.InfoHash)
+	}
+	session.torrents[torrent.InfoHash] = sessionTorrent
+	session.mutex.Unlock()
+
+	sessionTorrent.mutex.Lock()
+	defer sessionTorrent.mutex.Unlock()
+	if hasExistingData {
+		checkExistingData(storage, sessionTorrent.resumePath, session.opts.Recheck)
+	}
+	donePieces, wantedPieces := storage.Progress()
+	log.Printf("%s: Total Pieces: %d, wanted: %d, already have: %d\n", torrent.Name, torrent.NumPieces, wantedPieces, donePieces)
+	if session.streamServer != nil {
+		session.streamServer.Add(storage, sessionTorrent.SetFilePriorities)
+		for _, f := range torrent.Files {
+			log.Printf("stream [%s]: %s\n", f.Path, session.streamServer.FileURL(torrent.InfoHash, f.Path))
+		}
+	}
+	err = session.start(sessionTorrent)
+	if err != nil {
+		session.removeTorrent(torrent.InfoHash)
+		if session.streamServer != nil {
+			session.streamServer.Remove(torrent.InfoHash)
+		}
+		storage.Close()
+		return nil, err
+	}
+	return sessionTorrent, nil
+}
+
+func (session *Session) torrent(infoHash [20]byte) *SessionTorrent {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.torrents[infoHash]
+}
+
+func (session *Session) lookup(infoHash [20]byte) (*SessionTorrent, error) {
+	sessionTorrent := session.torrent(infoHash)
+	if sessionTorrent == nil {
+		return nil, fmt.Errorf("torrent %x is not in the session", infoHash)
+	}
+	return sessionTorrent, nil
+}
+
+func (session *Session) removeTorrent(infoHash [20]byte) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	delete(session.torrents, infoHash)
+}
+
+// Torrents returns the torrents of the session sorted by name
+func (session *Session) Torrents() []*SessionTorrent {
+	session.mutex.Lock()
+	torrents := make([]*SessionTorrent, 0, len(session.torrents))
+	for _, sessionTorrent := range session.torrents {
+		torrents = append(torrents, sessionTorrent)
+	}
+	session.mutex.Unlock()
+	sort.Slice(torrents, func(i, j int) bool {
+		return torrents[i].torrent.Name < torrents[j].torrent.Name
+	})
+	return torrents
+}
+
+// Pause disconnects the torrent's peers and stops its web seeds and
+// announces, keeping the data downloaded so far
+func (session *Session) Pause(infoHash [20]byte) error {
+	sessionTorrent, err := session.lookup(infoHash)
+	if err != nil {
+		return err
+	}
+	sessionTorrent.mutex.Lock()
+	defer sessionTorrent.mutex.Unlock()
+	if sessionTorrent.run == nil {
+		return errors.New("torrent is already paused")
+	}
+	session.stop(sessionTorrent)
+	return nil
+}
+
+// Resume starts a paused torrent again
+func (session *Session) Resume(infoHash [20]byte) error {
+	sessionTorrent, err := session.lookup(infoHash)
+	if err != nil {
+		return err
+	}
+	sessionTorrent.mutex.Lock()
+	defer sessionTorrent.mutex.Unlock()
+	if sessionTorrent.run != nil {
+		return errors.New("torrent is not paused")
+	}
+	return session.start(sessionTorrent)
+}
+
+// Recheck hashes the torrent's data on disk again. A running torrent is
+// paused for the check and resumed after it.
+func (session *Session) Recheck(infoHash [20]byte) error {
+	sessionTorrent, err := session.lookup(infoHash)
+	if err != nil {
+		return err
+	}
+	sessionTorrent.mutex.Lock()
+	defer sessionTorrent.mutex.Unlock()
+	running := sessionTorrent.run != nil
+	if running {
+		session.stop(sessionTorrent)
+	}
+
+	storage := sessionTorrent.storage
+	log.Printf("rechecking %s\n", sessionTorrent.torrent.Name)
+	verified := storage.Verify(runtime.NumCPU())
+	log.Printf("verified %d of %d pieces\n", verified, sessionTorrent.torrent.NumPieces)
+	saveResume(sessionTorrent)
+	if !running {
+		return nil
+	}
+	return session.start(sessionTorrent)
+}
+
+// Remove stops the torrent and takes it out of the session. Its data stays on disk.
+func (session *Session) Remove(infoHash [20]byte) error {
+	sessionTorrent, err := session.lookup(infoHash)
+	if err != nil {
+		return err
+	}
+	session.removeTorrent(infoHash)
+	sessionTorrent.mutex.Lock()
+	defer sessionTorrent.mutex.Unlock()
+	if sessionTorrent.run != nil {
+		session.stop(sessionTorrent)
+	}
+	if session.streamServer != nil {
+		session.streamServer.Remove(infoHash)
+	}
+	sessionTorrent.removed = true
+	sessionTorrent.storage.Close()
+	log.Printf("removed %s\n", sessionTorrent.torrent.Name)
+	return nil
+}
+
+// Close removes every torrent, then stops the disk writers, the DHT node and
+// the listener
+func (session *Session) Close() {
+	var wg sync.WaitGroup
+	for _, sessionTorrent := range session.Torrents() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session.Remove(sessionTorrent.InfoHash())
+		}()
+	}
+	wg.Wait()
+
+	session.writer.Close()
+	if session.streamServer != nil {
+		session.streamServer.Close()
+	}
+	// The DHT shares the listener's uTP socket, so it is closed first
+	if session.dhtServer != nil {
+		session.dhtServer.Close()
+	}
+	if session.listener != nil {
+		session.listener.Close()
+	}
+}
+
+// start runs the torrent, its mutex must be held
+func (session *Session) start(sessionTorrent *SessionTorrent) error {
+	torrent := sessionTorrent.torrent
+	storage := sessionTorrent.storage
+	scheduler := networking.NewScheduler(torrent, storage.Bitfield())
+	err := scheduler.SetFilePriorities(storage.FilePriorities())
+	if err != nil {
+		return err
+	}
+	scheduler.SetSequential(session.opts.Sequential)
+	uploader := networking.NewUploader(storage, session.opts.Seed)
+	results, written := session.writer.Add(storage, uploader, scheduler)
+	run := &torrentRun{
+		scheduler: scheduler,
+		manager:   networking.NewConnectionManager(torrent, scheduler, results, uploader, session.connections, &session.dialer, sessionTorrent.limits),
+		results:   results,
+		written:   written,
+		stop:      make(chan struct{}),
+	}
+	sessionTorrent.run = run
+	firstStart := !sessionTorrent.started
+	sessionTorrent.started = true
+	log.Printf("starting %s\n", torrent.Name)
+
+	if session.listener != nil {
+		session.listener.Register(run.manager)
+	}
+	for i, peer := range sessionTorrent.peers {
+		fmt.Printf("Peer [%v]: IP: %v, Port: %v\n", i, peer.IP, peer.Port)
+	}
+	run.manager.AddPeers(sessionTorrent.peers)
+	sessionTorrent.peers = nil
+	if session.streamServer != nil {
+		session.streamServer.SetScheduler(torrent.InfoHash, scheduler)
+	}
+	for _, seedURL := range torrent.WebSeeds {
+		log.Printf("using web seed [%v]\n", seedURL)
+		webSeed := networking.NewWebSeed(seedURL, torrent, scheduler, results, sessionTorrent.limits)
+		run.workers.Add(1)
+		go func() {
+			defer run.workers.Done()
+			webSeed.Run()
+		}()
+	}
+
+	if len(torrent.AnnounceList) > 0 {
+		stats := func() (int64, int64, int64) {
+			return uploader.Uploaded(), storage.Downloaded(), storage.Left()
+		}
+		run.announcer = peer_discovery.NewAnnouncer(torrent.AnnounceList, torrent, stats, run.manager.AddPeers, &sessionTorrent.trackerIDs)
+		run.announcer.Start()
+	}
+	if session.dhtServer != nil && torrent.Private {
+		log.Println("torrent is private, not announcing it on the DHT")
+	} else if session.dhtServer != nil {
+		// A magnet link's peers already came from a DHT announce
+		immediate := !(firstStart && sessionTorrent.isMagnet)
+		run.workers.Add(1)
+		go func() {
+			defer run.workers.Done()
+			announceDHT(session.dhtServer, torrent, run.manager, immediate, run.stop)
+		}()
+	}
+	run.workers.Add(1)
+	go func() {
+		defer run.workers.Done()
+		uploader.Run(run.stop)
+	}()
+	if sessionTorrent.resumePath != "" {
+		run.workers.Add(1)
+		go func() {
+			defer run.workers.Done()
+			saveResumePeriodically(storage, sessionTorrent.resumePath, run.stop)
+		}()
+	}
+
+	startedComplete := storage.Complete()
+	run.workers.Add(1)
+	go func() {
+		defer run.workers.Done()
+		ticker := time.NewTicker(completionPollInterval)
+		defer ticker.Stop()
+		for !sessionTorrent.finishRun(scheduler) {
+			select {
+			case <-ticker.C:
+			case <-run.stop:
+				return
+			}
+		}
+		log.Printf("%s: DOWNLOAD COMPLETE\n", torrent.Name)
+		if run.announcer != nil {
+			if !startedComplete {
+				run.announcer.Completed()
+			}
+			logTrackerStatus(run.announcer)
+		}
+		sessionTorrent.once.Do(func() {
+			close(sessionTorrent.completed)
+		})
+	}()
+	return nil
+}
+
+// stop shuts down everything start ran and saves the resume file once the
+// pieces already downloaded are written. The torrent's mutex must be held.
+func (session *Session) stop(sessionTorrent *SessionTorrent) {
+	run := sessionTorrent.run
+	infoHash := sessionTorrent.torrent.InfoHash
+	close(run.stop)
+	if session.listener != nil {
+		session.listener.Unregister(infoHash)
+	}
+	if session.streamServer != nil {
+		session.streamServer.SetScheduler(infoHash, nil)
+	}
+	run.scheduler.Close()
+	run.manager.Close()
+	run.manager.Wait()
+	if run.announcer != nil {
+		run.announcer.Stop()
+	}
+	run.workers.Wait()
+
+	// Nothing sends results anymore
+	close(run.results)
+	<-run.written
+	sessionTorrent.run = nil
+	saveResume(sessionTorrent)
+	log.Printf("stopped %s\n", sessionTorrent.torrent.Name)
+}
+
+func saveResume(sessionTorrent *SessionTorrent) {
+	if sessionTorrent.resumePath == "" {
+		return
+	}
+	err := sessionTorrent.storage.SaveResume(sessionTorrent.resumePath)
+	if err != nil {
+		log.Printf("failed to save resume file [%v]\n", err)
+	}
+}
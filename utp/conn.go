@@ -0,0 +1,534 @@
+package utp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const maxPacketSize = 1400 // stays below the MTU of most paths
+const maxPayload = maxPacketSize - headerSize
+const sendBufferSize = 1 << 20    // bytes Write queues before it blocks
+const receiveBufferSize = 1 << 20 // bytes received but not yet read
+const reorderLimit = 1024         // packets past a gap we keep while waiting for it
+const fastResendThreshold = 3     // packets acked past a missing one before it's resent
+const maxTimeouts = 6
+const closeLinger = 30 * time.Second
+const zeroWindowProbe = 1 * time.Second
+
+var errReset = errors.New("utp: connection reset by peer")
+var errTimedOut = errors.New("utp: connection timed out")
+
+type outgoingPacket struct {
+	header        header
+	payload       []byte
+	sentAt        time.Time
+	transmissions int
+	resend        bool // presumed lost, sent again once the window allows
+	fastResent    bool
+}
+
+func (packet *outgoingPacket) size() int {
+	return headerSize + len(packet.payload)
+}
+
+// Conn is a uTP connection. It implements net.Conn, so the peer wire protocol
+// runs over it exactly as over TCP.
+type Conn struct {
+	socket        *Socket
+	remote        net.Addr
+	recvID        uint16 // connection ID of packets sent to us
+	sendID        uint16 // connection ID of packets we send
+	mutex         sync.Mutex
+	cond          *sync.Cond
+	connected     bool
+	closed        bool  // Close was called
+	err           error // the connection is gone, returned once buffered data is read
+	initialSeq    uint16
+	seqNr         uint16            // next sequence number we send
+	ackNr         uint16            // last sequence number received in order
+	outgoing      []*outgoingPacket // sent and not yet acknowledged, oldest first
+	inFlight      int               // bytes of outgoing counted against the window
+	pending       []byte            // written but not yet sent
+	finSent       bool
+	finAcked      bool
+	peerWindow    uint32
+	control       *congestion
+	readBuf       []byte
+	reorder       map[uint16][]byte // packets received past a gap
+	reorderBytes  int
+	finReceived   bool
+	finSeq        uint16
+	eof           bool
+	replyDelay    uint32 // timestamp difference echoed back to the peer
+	timeoutAt     time.Time
+	timeouts      int
+	probedAt      time.Time
+	closedAt      time.Time
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readTimer     *time.Timer
+	writeTimer    *time.Timer
+}
+
+func newConn(socket *Socket, remote net.Addr, recvID uint16, sendID uint16) *Conn {
+	conn := Conn{
+		socket:     socket,
+		remote:     remote,
+		recvID:     recvID,
+		sendID:     sendID,
+		peerWindow: receiveBufferSize,
+		control:    newCongestion(),
+		reorder:    make(map[uint16][]byte),
+	}
+	conn.cond = sync.NewCond(&conn.mutex)
+	return &conn
+}
+
+func (conn *Conn) Read(b []byte) (int, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	for {
+		if conn.closed {
+			return 0, net.ErrClosed
+		}
+		if len(conn.readBuf) > 0 {
+			wasFull := conn.receiveWindowLocked() < maxPacketSize
+			n := copy(b, conn.readBuf)
+			conn.readBuf = conn.readBuf[n:]
+			if wasFull && conn.err == nil {
+				// The peer stopped sending when our window filled up
+				conn.sendStateLocked(time.Now())
+			}
+			return n, nil
+		}
+		if conn.eof {
+			return 0, io.EOF
+		}
+		if conn.err != nil {
+			return 0, conn.err
+		}
+		if deadlinePassed(conn.readDeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		conn.cond.Wait()
+	}
+}
+
+func (conn *Conn) Write(b []byte) (int, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	written := 0
+	for written < len(b) {
+		if conn.closed {
+			return written, net.ErrClosed
+		}
+		if conn.err != nil {
+			return written, conn.err
+		}
+		if deadlinePassed(conn.writeDeadline) {
+			return written, os.ErrDeadlineExceeded
+		}
+		space := sendBufferSize - len(conn.pending)
+		if space <= 0 {
+			conn.cond.Wait()
+			continue
+		}
+		n := min(space, len(b)-written)
+		conn.pending = append(conn.pending, b[written:written+n]...)
+		written += n
+		conn.flushLocked(time.Now())
+	}
+	return written, nil
+}
+
+// Close sends whatever was written followed by a FIN in the background, like
+// closing a TCP socket. Data that arrives afterwards is acknowledged and dropped.
+func (conn *Conn) Close() error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if conn.closed {
+		return net.ErrClosed
+	}
+	conn.closed = true
+	conn.closedAt = time.Now()
+	conn.readBuf = nil
+	conn.stopTimersLocked()
+	conn.cond.Broadcast()
+	if conn.err != nil {
+		return nil
+	}
+	conn.flushLocked(conn.closedAt)
+	conn.finishLocked()
+	return nil
+}
+
+func (conn *Conn) LocalAddr() net.Addr {
+	return conn.socket.Addr()
+}
+
+func (conn *Conn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+func (conn *Conn) SetDeadline(t time.Time) error {
+	conn.SetReadDeadline(t)
+	return conn.SetWriteDeadline(t)
+}
+
+// SetReadDeadline interrupts a blocked Read once t passes, even when t is set
+// while the Read is waiting
+func (conn *Conn) SetReadDeadline(t time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.readDeadline = t
+	conn.readTimer = conn.resetTimer(conn.readTimer, t)
+	conn.cond.Broadcast()
+	return nil
+}
+
+func (conn *Conn) SetWriteDeadline(t time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.writeDeadline = t
+	conn.writeTimer = conn.resetTimer(conn.writeTimer, t)
+	conn.cond.Broadcast()
+	return nil
+}
+
+func (conn *Conn) resetTimer(timer *time.Timer, t time.Time) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+	if t.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), conn.wake)
+}
+
+func (conn *Conn) stopTimersLocked() {
+	conn.readTimer = conn.resetTimer(conn.readTimer, time.Time{})
+	conn.writeTimer = conn.resetTimer(conn.writeTimer, time.Time{})
+}
+
+func (conn *Conn) wake() {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.cond.Broadcast()
+}
+
+func deadlinePassed(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+func (conn *Conn) receiveWindowLocked() int {
+	return max(receiveBufferSize-len(conn.readBuf)-conn.reorderBytes, 0)
+}
+
+// sendWindowLocked is how many bytes may be in flight, the smaller of the
+// congestion window and the peer's receive window
+func (conn *Conn) sendWindowLocked() int {
+	return min(int(conn.control.window), int(conn.peerWindow))
+}
+
+func (conn *Conn) sendPacketLocked(packet *outgoingPacket, now time.Time) error {
+	packet.header.timestamp = microseconds(now)
+	packet.header.timestampDiff = conn.replyDelay
+	packet.header.window = uint32(conn.receiveWindowLocked())
+	packet.header.ackNr = conn.ackNr
+	packet.sentAt = now
+	packet.transmissions++
+	if conn.timeoutAt.IsZero() {
+		conn.timeoutAt = now.Add(conn.control.timeout)
+	}
+	return conn.socket.writeTo(packet.header.marshal(packet.payload), conn.remote)
+}
+
+// queuePacketLocked sends a packet that takes the next sequence number and
+// keeps it until the peer acknowledges it
+func (conn *Conn) queuePacketLocked(kind packetType, payload []byte, now time.Time) error {
+	packet := outgoingPacket{
+		header:  header{kind: kind, connID: conn.sendID, seqNr: conn.seqNr},
+		payload: payload,
+	}
+	if kind == stSyn {
+		packet.header.connID = conn.recvID
+	}
+	conn.seqNr++
+	conn.outgoing = append(conn.outgoing, &packet)
+	conn.inFlight += packet.size()
+	return conn.sendPacketLocked(&packet, now)
+}
+
+func (conn *Conn) sendStateLocked(now time.Time) {
+	conn.sendStateSeqLocked(conn.seqNr, now)
+}
+
+// sendStateSeqLocked acknowledges what we received. State packets don't take
+// a sequence number, they carry the next one we'll use.
+func (conn *Conn) sendStateSeqLocked(seqNr uint16, now time.Time) {
+	h := header{
+		kind:          stState,
+		connID:        conn.sendID,
+		timestamp:     microseconds(now),
+		timestampDiff: conn.replyDelay,
+		window:        uint32(conn.receiveWindowLocked()),
+		seqNr:         seqNr,
+		ackNr:         conn.ackNr,
+		selectiveAck:  conn.selectiveAckLocked(),
+	}
+	conn.socket.writeTo(h.marshal(nil), conn.remote)
+}
+
+// resetLocked tells the peer we are giving up on the connection
+func (conn *Conn) resetLocked(now time.Time) {
+	h := header{kind: stReset, connID: conn.sendID, timestamp: microseconds(now), seqNr: conn.seqNr, ackNr: conn.ackNr}
+	conn.socket.writeTo(h.marshal(nil), conn.remote)
+}
+
+func (conn *Conn) selectiveAckLocked() []byte {
+	if len(conn.reorder) == 0 {
+		return nil
+	}
+	mask := make([]byte, selectiveAckBits/8)
+	for seq := range conn.reorder {
+		bit := int(seq - conn.ackNr - 2)
+		if bit < selectiveAckBits {
+			mask[bit/8] |= 1 << (bit % 8)
+		}
+	}
+	return mask
+}
+
+// flushLocked resends lost packets and sends written data while the window
+// allows, then a FIN once Close was called and everything else went out. One
+// packet may always be in flight, so a window smaller than a packet can't
+// stall the connection.
+func (conn *Conn) flushLocked(now time.Time) {
+	window := conn.sendWindowLocked()
+	for _, packet := range conn.outgoing {
+		if !packet.resend {
+			continue
+		}
+		if conn.inFlight > 0 && conn.inFlight+packet.size() > window {
+			return
+		}
+		packet.resend = false
+		conn.inFlight += packet.size()
+		conn.sendPacketLocked(packet, now)
+	}
+	if !conn.connected {
+		return
+	}
+
+	for len(conn.pending) > 0 {
+		n := min(len(conn.pending), maxPayload)
+		if conn.inFlight+headerSize+n > window && (conn.inFlight > 0 || conn.peerWindow == 0) {
+			return
+		}
+		conn.sendPendingLocked(n, now)
+	}
+	if conn.closed && !conn.finSent {
+		conn.finSent = true
+		conn.queuePacketLocked(stFin, nil, now)
+	}
+}
+
+func (conn *Conn) sendPendingLocked(n int, now time.Time) {
+	payload := append([]byte(nil), conn.pending[:n]...)
+	conn.pending = conn.pending[n:]
+	conn.queuePacketLocked(stData, payload, now)
+	conn.cond.Broadcast()
+}
+
+func (conn *Conn) handlePacket(h header, payload []byte, now time.Time) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if conn.err != nil {
+		return
+	}
+	if h.timestamp != 0 {
+		conn.replyDelay = microseconds(now) - h.timestamp
+	}
+	conn.peerWindow = h.window
+
+	switch h.kind {
+	case stReset:
+		conn.failLocked(errReset)
+		return
+	case stSyn:
+		// Our answer to the SYN was lost, the connection starts at initialSeq
+		conn.sendStateSeqLocked(conn.initialSeq, now)
+		return
+	}
+	if !conn.connected {
+		if h.kind != stState {
+			return
+		}
+		conn.connected = true
+		conn.ackNr = h.seqNr - 1
+		conn.cond.Broadcast()
+	}
+
+	conn.ackLocked(h, now)
+	if h.kind == stData || h.kind == stFin {
+		conn.receiveLocked(h, payload)
+		conn.sendStateLocked(now)
+	}
+	conn.flushLocked(now)
+	conn.finishLocked()
+}
+
+// ackLocked drops the packets the peer acknowledged, cumulatively up to
+// ack_nr and selectively past it, and resends the first missing packet once
+// enough later ones got through.
+func (conn *Conn) ackLocked(h header, now time.Time) {
+	acked := 0
+	remaining := conn.outgoing[:0]
+	for _, packet := range conn.outgoing {
+		seq := packet.header.seqNr
+		if seqLess(h.ackNr, seq) && !h.selectivelyAcked(seq) {
+			remaining = append(remaining, packet)
+			continue
+		}
+		if !packet.resend {
+			conn.inFlight -= packet.size()
+		}
+		acked += packet.size()
+		if packet.transmissions == 1 {
+			conn.control.onRTT(now.Sub(packet.sentAt))
+		}
+		if packet.header.kind == stFin {
+			conn.finAcked = true
+		}
+	}
+	clear(conn.outgoing[len(remaining):])
+	conn.outgoing = remaining
+
+	if acked > 0 {
+		conn.control.onAck(acked, h.timestampDiff, now)
+		conn.timeouts = 0
+		conn.timeoutAt = time.Time{}
+		if len(conn.outgoing) > 0 {
+			conn.timeoutAt = now.Add(conn.control.timeout)
+		}
+		conn.cond.Broadcast()
+	}
+
+	if len(conn.outgoing) == 0 || h.selectiveAck == nil {
+		return
+	}
+	first := conn.outgoing[0]
+	if first.fastResent || first.resend || first.header.seqNr != h.ackNr+1 {
+		return
+	}
+	received := 0
+	for _, b := range h.selectiveAck {
+		for ; b != 0; b &= b - 1 {
+			received++
+		}
+	}
+	if received >= fastResendThreshold {
+		first.fastResent = true
+		conn.control.onLoss()
+		conn.sendPacketLocked(first, now)
+	}
+}
+
+func (conn *Conn) receiveLocked(h header, payload []byte) {
+	if h.kind == stFin && !conn.finReceived {
+		conn.finReceived = true
+		conn.finSeq = h.seqNr
+	}
+	if !seqLess(conn.ackNr, h.seqNr) || h.seqNr-conn.ackNr > reorderLimit {
+		return
+	}
+	if h.seqNr != conn.ackNr+1 {
+		if _, ok := conn.reorder[h.seqNr]; !ok {
+			conn.reorder[h.seqNr] = append([]byte(nil), payload...)
+			conn.reorderBytes += len(payload)
+		}
+		return
+	}
+
+	conn.deliverLocked(payload)
+	for {
+		next, ok := conn.reorder[conn.ackNr+1]
+		if !ok {
+			break
+		}
+		delete(conn.reorder, conn.ackNr+1)
+		conn.reorderBytes -= len(next)
+		conn.deliverLocked(next)
+	}
+	conn.cond.Broadcast()
+}
+
+func (conn *Conn) deliverLocked(payload []byte) {
+	conn.ackNr++
+	if !conn.closed {
+		conn.readBuf = append(conn.readBuf, payload...)
+	}
+	if conn.finReceived && conn.ackNr == conn.finSeq {
+		conn.eof = true
+	}
+}
+
+// tick retransmits after a timeout, probes a peer whose receive window is
+// closed, and gives up on connections that stopped answering.
+func (conn *Conn) tick(now time.Time) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if conn.err != nil {
+		return
+	}
+	if conn.closed && conn.finAcked && now.Sub(conn.closedAt) > closeLinger {
+		// Everything we sent arrived but the peer never closed its side
+		conn.resetLocked(now)
+		conn.failLocked(net.ErrClosed)
+		return
+	}
+
+	if len(conn.outgoing) > 0 && !conn.timeoutAt.IsZero() && now.After(conn.timeoutAt) {
+		conn.timeouts++
+		if conn.timeouts > maxTimeouts {
+			conn.resetLocked(now)
+			conn.failLocked(errTimedOut)
+			return
+		}
+		conn.control.onTimeout()
+		for _, packet := range conn.outgoing {
+			packet.resend = true
+		}
+		conn.inFlight = 0
+		conn.timeoutAt = now.Add(conn.control.timeout)
+		conn.flushLocked(now)
+	}
+
+	if conn.connected && conn.peerWindow == 0 && conn.inFlight == 0 && len(conn.pending) > 0 && now.Sub(conn.probedAt) >= zeroWindowProbe {
+		// The update opening the window may have been lost, one packet asks again
+		conn.probedAt = now
+		conn.sendPendingLocked(min(len(conn.pending), maxPayload), now)
+	}
+}
+
+// finishLocked removes a closed connection once both sides sent everything
+func (conn *Conn) finishLocked() {
+	if conn.closed && conn.finAcked && conn.eof {
+		conn.failLocked(net.ErrClosed)
+	}
+}
+
+func (conn *Conn) failLocked(err error) {
+	if conn.err == nil {
+		conn.err = err
+	}
+	conn.outgoing = nil
+	conn.pending = nil
+	conn.inFlight = 0
+	conn.socket.remove(conn)
+	conn.cond.Broadcast()
+}
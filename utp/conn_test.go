@@ -0,0 +1,271 @@
+package utp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyConn drops and delays packets written through it. Delayed packets go
+// out after later ones, so the peer sees them reordered.
+type lossyConn struct {
+	net.PacketConn
+	mutex   sync.Mutex
+	random  *rand.Rand
+	loss    float64             // fraction of packets dropped
+	reorder float64             // fraction of packets delayed
+	drop    func(h header) bool // drops chosen packets on top of loss, nil for none
+	delayed sync.WaitGroup
+}
+
+func (conn *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	conn.mutex.Lock()
+	lost := conn.random.Float64() < conn.loss
+	delay := conn.random.Float64() < conn.reorder
+	wait := time.Duration(conn.random.Intn(20)+1) * time.Millisecond
+	if conn.drop != nil {
+		h, _, err := parsePacket(b)
+		if err == nil && conn.drop(h) {
+			lost = true
+		}
+	}
+	conn.mutex.Unlock()
+	if lost {
+		return len(b), nil
+	}
+	if delay {
+		data := append([]byte(nil), b...)
+		conn.delayed.Add(1)
+		time.AfterFunc(wait, func() {
+			defer conn.delayed.Done()
+			conn.PacketConn.WriteTo(data, addr)
+		})
+		return len(b), nil
+	}
+	return conn.PacketConn.WriteTo(b, addr)
+}
+
+func (conn *lossyConn) Close() error {
+	err := conn.PacketConn.Close()
+	conn.delayed.Wait()
+	return err
+}
+
+func newLossySocket(t *testing.T, seed int64, loss float64, reorder float64) (*Socket, *lossyConn) {
+	t.Helper()
+	packetConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lossy := &lossyConn{PacketConn: packetConn, random: rand.New(rand.NewSource(seed)), loss: loss, reorder: reorder}
+	socket := NewSocket(lossy)
+	t.Cleanup(func() { socket.Close() })
+	return socket, lossy
+}
+
+// connect dials from client to server and returns both ends
+func connect(t *testing.T, client *Socket, server *Socket) (net.Conn, net.Conn) {
+	t.Helper()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+	dialed, err := client.Dial(server.Addr().String(), 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dialed, <-accepted
+}
+
+func randomBytes(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func TestTransferWithLossAndReordering(t *testing.T) {
+	client, _ := newLossySocket(t, 1, 0.03, 0.1)
+	server, _ := newLossySocket(t, 2, 0.03, 0.1)
+	dialed, accepted := connect(t, client, server)
+	defer dialed.Close()
+	defer accepted.Close()
+
+	const size = 3 << 20
+	upload := randomBytes(3, size)
+	download := randomBytes(4, size)
+	var wg sync.WaitGroup
+	transfer := func(from net.Conn, to net.Conn, data []byte) {
+		defer wg.Done()
+		errs := make(chan error, 1)
+		go func() {
+			_, err := from.Write(data)
+			errs <- err
+		}()
+		received := make([]byte, len(data))
+		_, err := io.ReadFull(to, received)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+		if !bytes.Equal(received, data) {
+			t.Error("received bytes differ from the ones sent")
+		}
+	}
+	wg.Add(2)
+	go transfer(dialed, accepted, upload)
+	go transfer(accepted, dialed, download)
+	wg.Wait()
+}
+
+func TestLostSyn(t *testing.T) {
+	client, lossy := newLossySocket(t, 5, 0, 0)
+	server, _ := newLossySocket(t, 6, 0, 0)
+	syns := 0
+	lossy.drop = func(h header) bool {
+		if h.kind != stSyn {
+			return false
+		}
+		syns++
+		return syns == 1
+	}
+
+	dialed, accepted := connect(t, client, server)
+	defer dialed.Close()
+	defer accepted.Close()
+	if syns < 2 {
+		t.Fatalf("connected after %d SYNs, the first was dropped", syns)
+	}
+	_, err := dialed.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(accepted, buf)
+	if err != nil || string(buf) != "hello" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+}
+
+func TestCloseSendsFin(t *testing.T) {
+	client, _ := newLossySocket(t, 7, 0.05, 0.1)
+	server, _ := newLossySocket(t, 8, 0.05, 0.1)
+	dialed, accepted := connect(t, client, server)
+	defer accepted.Close()
+
+	data := randomBytes(9, 200000)
+	_, err := dialed.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dialed.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Everything written before Close arrives, followed by EOF
+	accepted.SetReadDeadline(time.Now().Add(20 * time.Second))
+	received, err := io.ReadAll(accepted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatalf("received %d bytes, want the %d written", len(received), len(data))
+	}
+
+	_, err = dialed.Read(make([]byte, 1))
+	if !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("read after close: %v, want net.ErrClosed", err)
+	}
+	_, err = dialed.Write([]byte("x"))
+	if !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("write after close: %v, want net.ErrClosed", err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	client, _ := newLossySocket(t, 10, 0, 0)
+	server, _ := newLossySocket(t, 11, 0, 0)
+	dialed, _ := connect(t, client, server)
+	defer dialed.Close()
+
+	// Closing the socket drops its connections without a FIN. A new socket on
+	// the same port doesn't know the connection and answers with a reset.
+	address := server.Addr().String()
+	server.Close()
+	packetConn, err := net.ListenPacket("udp4", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted := NewSocket(packetConn)
+	defer restarted.Close()
+
+	dialed.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, err = dialed.Write([]byte("anyone there?"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dialed.Read(make([]byte, 1))
+	if !errors.Is(err, errReset) {
+		t.Fatalf("read: %v, want a reset", err)
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	client, _ := newLossySocket(t, 12, 0, 0)
+	server, _ := newLossySocket(t, 13, 0, 0)
+	dialed, accepted := connect(t, client, server)
+	defer dialed.Close()
+	defer accepted.Close()
+
+	start := time.Now()
+	accepted.SetReadDeadline(start.Add(100 * time.Millisecond))
+	_, err := accepted.Read(make([]byte, 1))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read: %v, want a deadline error", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("read returned after %v", elapsed)
+	}
+
+	// A deadline set while a read waits interrupts it
+	accepted.SetReadDeadline(time.Time{})
+	errs := make(chan error, 1)
+	go func() {
+		_, err := accepted.Read(make([]byte, 1))
+		errs <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	accepted.SetReadDeadline(time.Now())
+	select {
+	case err = <-errs:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("read: %v, want a deadline error", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("moving the deadline didn't interrupt the read")
+	}
+
+	// The connection still works after a deadline passed
+	accepted.SetReadDeadline(time.Time{})
+	_, err = dialed.Write([]byte("ok"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(accepted, buf)
+	if err != nil || string(buf) != "ok" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+}
@@ -0,0 +1,128 @@
+package utp
+
+import (
+	"time"
+)
+
+/*
+See: https://www.bittorrent.org/beps/bep_0029.html#congestion-control
+LEDBAT grows the window while the one way delay our packets see stays below
+the target and shrinks it once it goes above, so uTP yields to TCP and other
+traffic on the same link instead of filling the router's queues.
+
+The delay is the timestamp difference the peer echoes back, minus the lowest
+difference seen over the last two minutes. That base delay cancels out the
+offset between the two clocks and leaves the queuing delay.
+*/
+
+const targetDelay = 100 * time.Millisecond
+const maxWindowIncrease = 3000 // bytes per round trip when there is no queuing delay
+const minWindow = maxPacketSize
+const initialWindow = 4 * maxPacketSize
+const maxWindow = 1 << 20
+const baseDelayMinutes = 2
+const minTimeout = 500 * time.Millisecond
+const initialTimeout = 1 * time.Second
+const maxTimeout = 16 * time.Second
+
+type congestion struct {
+	window     float64 // bytes we may have in flight
+	rtt        time.Duration
+	rttVar     time.Duration
+	timeout    time.Duration
+	baseDelays [baseDelayMinutes]uint32 // lowest delay seen in each of the last minutes
+	current    int
+	rotated    time.Time
+	measured   bool
+}
+
+func newCongestion() *congestion {
+	return &congestion{
+		window:  initialWindow,
+		timeout: initialTimeout,
+	}
+}
+
+// onAck adjusts the window for bytesAcked newly acknowledged bytes, given the
+// delay the peer measured on our packets, which is 0 when it hasn't yet.
+func (control *congestion) onAck(bytesAcked int, delay uint32, now time.Time) {
+	var ourDelay time.Duration
+	if delay != 0 {
+		control.addDelay(delay, now)
+		ourDelay = time.Duration(delay-control.baseDelay()) * time.Microsecond
+	}
+
+	offTarget := float64(targetDelay-ourDelay) / float64(targetDelay)
+	windowFactor := float64(bytesAcked) / max(control.window, float64(bytesAcked))
+	control.window += maxWindowIncrease * offTarget * windowFactor
+	control.window = min(max(control.window, minWindow), maxWindow)
+
+	// The peer is answering again, so the backed off timeout no longer applies
+	if control.rtt != 0 {
+		control.timeout = max(control.rtt+4*control.rttVar, minTimeout)
+	}
+}
+
+// onRTT updates the retransmission timeout with a round trip sample, the same
+// way TCP does
+func (control *congestion) onRTT(sample time.Duration) {
+	if control.rtt == 0 {
+		control.rtt = sample
+		control.rttVar = sample / 2
+	} else {
+		delta := control.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		control.rttVar += (delta - control.rttVar) / 4
+		control.rtt += (sample - control.rtt) / 8
+	}
+	control.timeout = max(control.rtt+4*control.rttVar, minTimeout)
+}
+
+// onLoss halves the window when a packet was lost but later ones arrived
+func (control *congestion) onLoss() {
+	control.window = max(control.window/2, minWindow)
+}
+
+// onTimeout drops the window to a single packet and backs off the timeout
+func (control *congestion) onTimeout() {
+	control.window = minWindow
+	control.timeout = min(control.timeout*2, maxTimeout)
+}
+
+func (control *congestion) addDelay(delay uint32, now time.Time) {
+	if !control.measured {
+		for i := range control.baseDelays {
+			control.baseDelays[i] = delay
+		}
+		control.rotated = now
+		control.measured = true
+		return
+	}
+	if now.Sub(control.rotated) >= time.Minute {
+		control.current = (control.current + 1) % baseDelayMinutes
+		control.baseDelays[control.current] = delay
+		control.rotated = now
+		return
+	}
+	if delayLess(delay, control.baseDelays[control.current]) {
+		control.baseDelays[control.current] = delay
+	}
+}
+
+func (control *congestion) baseDelay() uint32 {
+	base := control.baseDelays[0]
+	for _, delay := range control.baseDelays[1:] {
+		if delayLess(delay, base) {
+			base = delay
+		}
+	}
+	return base
+}
+
+// delayLess compares timestamp differences, which wrap around like the
+// microsecond clocks they come from
+func delayLess(a uint32, b uint32) bool {
+	return int32(a-b) < 0
+}
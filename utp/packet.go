@@ -0,0 +1,129 @@
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+/*
+See: https://www.bittorrent.org/beps/bep_0029.html
+Every packet starts with a 20 byte header, followed by a chain of extensions
+and then the payload:
+
+	type (4 bits) | version (4 bits) | extension
+	connection_id
+	timestamp_microseconds
+	timestamp_difference_microseconds
+	wnd_size
+	seq_nr | ack_nr
+
+The only extension we read or send is the selective ack, a bitmask of the
+packets received past ack_nr + 1. Unknown extensions are skipped.
+*/
+
+type packetType uint8
+
+const (
+	stData  packetType = 0
+	stFin   packetType = 1
+	stState packetType = 2
+	stReset packetType = 3
+	stSyn   packetType = 4
+)
+
+const version = 1
+const headerSize = 20
+const extensionSelectiveAck = 1
+const selectiveAckBits = 32
+
+type header struct {
+	kind          packetType
+	connID        uint16
+	timestamp     uint32 // microseconds, when the packet was sent
+	timestampDiff uint32 // microseconds, the delay the sender measured on our last packet
+	window        uint32 // bytes the sender can still buffer
+	seqNr         uint16
+	ackNr         uint16
+	selectiveAck  []byte // nil without the extension
+}
+
+func (h *header) marshal(payload []byte) []byte {
+	size := headerSize + len(payload)
+	if h.selectiveAck != nil {
+		size += 2 + len(h.selectiveAck)
+	}
+	buf := make([]byte, headerSize, size)
+	buf[0] = byte(h.kind)<<4 | version
+	if h.selectiveAck != nil {
+		buf[1] = extensionSelectiveAck
+	}
+	binary.BigEndian.PutUint16(buf[2:4], h.connID)
+	binary.BigEndian.PutUint32(buf[4:8], h.timestamp)
+	binary.BigEndian.PutUint32(buf[8:12], h.timestampDiff)
+	binary.BigEndian.PutUint32(buf[12:16], h.window)
+	binary.BigEndian.PutUint16(buf[16:18], h.seqNr)
+	binary.BigEndian.PutUint16(buf[18:20], h.ackNr)
+	if h.selectiveAck != nil {
+		buf = append(buf, 0, byte(len(h.selectiveAck)))
+		buf = append(buf, h.selectiveAck...)
+	}
+	return append(buf, payload...)
+}
+
+// isPacket tells uTP packets apart from other datagrams sharing the socket,
+// such as DHT messages which are bencoded dictionaries starting with 'd'.
+func isPacket(buf []byte) bool {
+	return len(buf) >= headerSize && buf[0]&0x0f == version && packetType(buf[0]>>4) <= stSyn
+}
+
+// parsePacket splits a datagram into its header and payload. Both still refer
+// to buf.
+func parsePacket(buf []byte) (header, []byte, error) {
+	if !isPacket(buf) {
+		return header{}, nil, errors.New("utp: not a uTP packet")
+	}
+
+	h := header{
+		kind:          packetType(buf[0] >> 4),
+		connID:        binary.BigEndian.Uint16(buf[2:4]),
+		timestamp:     binary.BigEndian.Uint32(buf[4:8]),
+		timestampDiff: binary.BigEndian.Uint32(buf[8:12]),
+		window:        binary.BigEndian.Uint32(buf[12:16]),
+		seqNr:         binary.BigEndian.Uint16(buf[16:18]),
+		ackNr:         binary.BigEndian.Uint16(buf[18:20]),
+	}
+	extension := buf[1]
+	rest := buf[headerSize:]
+	for extension != 0 {
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return header{}, nil, errors.New("utp: truncated extension")
+		}
+		next, length := rest[0], int(rest[1])
+		if extension == extensionSelectiveAck {
+			h.selectiveAck = rest[2 : 2+length]
+		}
+		extension = next
+		rest = rest[2+length:]
+	}
+	return h, rest, nil
+}
+
+// selectivelyAcked reports whether the bitmask acknowledges seq. The first bit
+// stands for ack_nr + 2, as ack_nr + 1 is by definition missing.
+func (h *header) selectivelyAcked(seq uint16) bool {
+	bit := int(seq - h.ackNr - 2)
+	if bit >= len(h.selectiveAck)*8 {
+		return false
+	}
+	return h.selectiveAck[bit/8]&(1<<(bit%8)) != 0
+}
+
+// seqLess compares sequence numbers, which wrap around at 65535
+func seqLess(a uint16, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+func microseconds(now time.Time) uint32 {
+	return uint32(now.UnixMicro())
+}
@@ -0,0 +1,391 @@
+package utp
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const maxDatagramSize = 65536
+const acceptBacklog = 32
+const passthroughBacklog = 256
+const tickInterval = 50 * time.Millisecond
+
+type connKey struct {
+	addr   string
+	connID uint16
+}
+
+type datagram struct {
+	data []byte
+	addr net.Addr
+}
+
+// Socket runs uTP connections over one packet connection, dialing out and
+// accepting them. It implements net.Listener. Datagrams that are not uTP are
+// handed to PacketConn, so a DHT node can share the port.
+type Socket struct {
+	conn        net.PacketConn
+	mutex       sync.Mutex
+	conns       map[connKey]*Conn
+	incoming    chan *Conn
+	passthrough *packetConn
+	closeOnce   sync.Once
+	closed      chan struct{}
+	wg          sync.WaitGroup
+}
+
+// Listen opens a UDP socket for uTP, network is one of "udp", "udp4" or "udp6"
+func Listen(network string, address string) (*Socket, error) {
+	conn, err := net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewSocket(conn), nil
+}
+
+// NewSocket runs uTP over conn, which the socket owns from then on. Tests
+// pass a connection that drops or reorders packets.
+func NewSocket(conn net.PacketConn) *Socket {
+	socket := Socket{
+		conn:     conn,
+		conns:    make(map[connKey]*Conn),
+		incoming: make(chan *Conn, acceptBacklog),
+		closed:   make(chan struct{}),
+	}
+	socket.passthrough = &packetConn{
+		socket:  &socket,
+		packets: make(chan datagram, passthroughBacklog),
+		closed:  make(chan struct{}),
+	}
+
+	socket.wg.Add(2)
+	go socket.readLoop()
+	go socket.tickLoop()
+	return &socket
+}
+
+func (socket *Socket) Addr() net.Addr {
+	return socket.conn.LocalAddr()
+}
+
+// PacketConn returns a packet connection that reads the datagrams on the
+// socket that are not uTP packets and writes through the socket
+func (socket *Socket) PacketConn() net.PacketConn {
+	return socket.passthrough
+}
+
+// Accept waits for the next connection a peer opened to us
+func (socket *Socket) Accept() (net.Conn, error) {
+	select {
+	case conn := <-socket.incoming:
+		return conn, nil
+	case <-socket.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Dial opens a uTP connection to address, sending the SYN again until the peer
+// answers or the timeout passes
+func (socket *Socket) Dial(address string, timeout time.Duration) (net.Conn, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := socket.newOutgoing(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	// The SYN alone carries our receive ID, every later packet the send ID
+	err = conn.queuePacketLocked(stSyn, nil, time.Now())
+	if err != nil {
+		conn.failLocked(err)
+		return nil, fmt.Errorf("utp: dial %s: %w", address, err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	timer := time.AfterFunc(timeout, conn.wake)
+	defer timer.Stop()
+	for !conn.connected && conn.err == nil && time.Now().Before(deadline) {
+		conn.cond.Wait()
+	}
+	if conn.connected && conn.err == nil {
+		return conn, nil
+	}
+	conn.failLocked(errTimedOut)
+	return nil, fmt.Errorf("utp: dial %s: %w", address, conn.err)
+}
+
+// newOutgoing registers a connection under a receive ID no other connection to
+// the same address uses. The initiator sends with the ID one above it.
+func (socket *Socket) newOutgoing(addr net.Addr) (*Conn, error) {
+	socket.mutex.Lock()
+	defer socket.mutex.Unlock()
+	select {
+	case <-socket.closed:
+		return nil, net.ErrClosed
+	default:
+	}
+
+	for {
+		recvID := uint16(rand.Uint32())
+		key := connKey{addr.String(), recvID}
+		if _, ok := socket.conns[key]; ok {
+			continue
+		}
+		conn := newConn(socket, addr, recvID, recvID+1)
+		conn.seqNr = 1
+		socket.conns[key] = conn
+		return conn, nil
+	}
+}
+
+func (socket *Socket) remove(conn *Conn) {
+	socket.mutex.Lock()
+	defer socket.mutex.Unlock()
+	key := connKey{conn.remote.String(), conn.recvID}
+	if socket.conns[key] == conn {
+		delete(socket.conns, key)
+	}
+}
+
+func (socket *Socket) writeTo(data []byte, addr net.Addr) error {
+	_, err := socket.conn.WriteTo(data, addr)
+	return err
+}
+
+// Close closes the socket and every connection on it
+func (socket *Socket) Close() error {
+	err := errors.New("utp socket already closed")
+	socket.closeOnce.Do(func() {
+		close(socket.closed)
+		err = socket.conn.Close()
+
+		socket.mutex.Lock()
+		conns := make([]*Conn, 0, len(socket.conns))
+		for _, conn := range socket.conns {
+			conns = append(conns, conn)
+		}
+		socket.mutex.Unlock()
+		for _, conn := range conns {
+			conn.mutex.Lock()
+			conn.failLocked(net.ErrClosed)
+			conn.mutex.Unlock()
+		}
+		socket.wg.Wait()
+	})
+	return err
+}
+
+func (socket *Socket) readLoop() {
+	defer socket.wg.Done()
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := socket.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-socket.closed:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		if !isPacket(buf[:n]) {
+			socket.passthrough.deliver(buf[:n], addr)
+			continue
+		}
+		h, payload, err := parsePacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		socket.dispatch(h, payload, addr)
+	}
+}
+
+func (socket *Socket) dispatch(h header, payload []byte, addr net.Addr) {
+	now := time.Now()
+	socket.mutex.Lock()
+	conn, ok := socket.conns[connKey{addr.String(), h.connID}]
+	if !ok && h.kind == stReset {
+		conn, ok = socket.resetTarget(addr, h.connID)
+	}
+	socket.mutex.Unlock()
+	if ok {
+		conn.handlePacket(h, payload, now)
+		return
+	}
+
+	switch h.kind {
+	case stSyn:
+		socket.accept(h, addr, now)
+	case stReset:
+	default:
+		reset := header{kind: stReset, connID: h.connID, timestamp: microseconds(now), seqNr: uint16(rand.Uint32()), ackNr: h.seqNr}
+		socket.writeTo(reset.marshal(nil), addr)
+	}
+}
+
+// resetTarget finds the connection a reset is for when the peer used the ID
+// of the packets it received from us
+func (socket *Socket) resetTarget(addr net.Addr, connID uint16) (*Conn, bool) {
+	for _, recvID := range []uint16{connID - 1, connID + 1} {
+		conn, ok := socket.conns[connKey{addr.String(), recvID}]
+		if ok && conn.sendID == connID {
+			return conn, true
+		}
+	}
+	return nil, false
+}
+
+// accept answers a SYN with a state packet and queues the new connection for
+// Accept. Its receive ID is one above the ID in the SYN.
+func (socket *Socket) accept(h header, addr net.Addr, now time.Time) {
+	socket.mutex.Lock()
+	select {
+	case <-socket.closed:
+		socket.mutex.Unlock()
+		return
+	default:
+	}
+	key := connKey{addr.String(), h.connID + 1}
+	if existing, ok := socket.conns[key]; ok {
+		socket.mutex.Unlock()
+		if existing.sendID == h.connID {
+			existing.handlePacket(h, nil, now)
+		}
+		return
+	}
+	conn := newConn(socket, addr, h.connID+1, h.connID)
+	conn.connected = true
+	conn.seqNr = uint16(rand.Uint32())
+	conn.initialSeq = conn.seqNr
+	conn.ackNr = h.seqNr
+	conn.peerWindow = h.window
+	if h.timestamp != 0 {
+		conn.replyDelay = microseconds(now) - h.timestamp
+	}
+	socket.conns[key] = conn
+	socket.mutex.Unlock()
+
+	conn.mutex.Lock()
+	select {
+	case socket.incoming <- conn:
+		conn.sendStateLocked(now)
+	default:
+		reset := header{kind: stReset, connID: h.connID, timestamp: microseconds(now), seqNr: conn.seqNr, ackNr: h.seqNr}
+		socket.writeTo(reset.marshal(nil), addr)
+		conn.failLocked(errReset)
+	}
+	conn.mutex.Unlock()
+}
+
+func (socket *Socket) tickLoop() {
+	defer socket.wg.Done()
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			socket.mutex.Lock()
+			conns := make([]*Conn, 0, len(socket.conns))
+			for _, conn := range socket.conns {
+				conns = append(conns, conn)
+			}
+			socket.mutex.Unlock()
+			for _, conn := range conns {
+				conn.tick(now)
+			}
+		case <-socket.closed:
+			return
+		}
+	}
+}
+
+// packetConn is the view of the socket PacketConn returns. A read deadline
+// only applies to reads started after it is set.
+type packetConn struct {
+	socket    *Socket
+	packets   chan datagram
+	mutex     sync.Mutex
+	deadline  time.Time
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// deliver queues a copy of the datagram, dropping it when nobody reads them
+func (conn *packetConn) deliver(data []byte, addr net.Addr) {
+	select {
+	case conn.packets <- datagram{data: append([]byte(nil), data...), addr: addr}:
+	default:
+	}
+}
+
+func (conn *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	conn.mutex.Lock()
+	deadline := conn.deadline
+	conn.mutex.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case packet := <-conn.packets:
+		return copy(b, packet.data), packet.addr, nil
+	case <-conn.closed:
+		return 0, nil, net.ErrClosed
+	case <-conn.socket.closed:
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (conn *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-conn.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	return conn.socket.conn.WriteTo(b, addr)
+}
+
+// Close stops reads on this view, the socket itself stays open
+func (conn *packetConn) Close() error {
+	conn.closeOnce.Do(func() {
+		close(conn.closed)
+	})
+	return nil
+}
+
+func (conn *packetConn) LocalAddr() net.Addr {
+	return conn.socket.Addr()
+}
+
+func (conn *packetConn) SetDeadline(t time.Time) error {
+	return conn.SetReadDeadline(t)
+}
+
+func (conn *packetConn) SetReadDeadline(t time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.deadline = t
+	return nil
+}
+
+func (conn *packetConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -3,6 +3,7 @@ package work
 import (
 	"GoTorrent/client"
 	"GoTorrent/message"
+	"errors"
 )
 
 const bytesPerChunk = 20
@@ -20,12 +21,10 @@ type Results struct {
 }
 
 type Progress struct {
-	Index      int
-	Client     *client.Client
-	Buf        []byte
-	Downloaded int
-	Requested  int
-	Backlog    int
+	Index    int
+	Client   *client.Client
+	OnBlock  func(index int, begin int, data []byte) error // receives piece messages, nil to drop them
+	OnReject func(request message.BlockRequest)            // receives rejected requests, nil to drop them
 }
 
 func (workProgress *Progress) ReadMessage() error {
@@ -48,18 +47,69 @@ func (workProgress *Progress) ReadMessage() error {
 			return err
 		}
 		workProgress.Client.Bitfield.SetPiece(index)
+	case message.MsgInterested:
+		workProgress.Client.PeerInterested = true
+	case message.MsgNotInterested:
+		workProgress.Client.PeerInterested = false
+	case message.MsgRequest:
+		request, err := message.ParseRequest(msg)
+		if err != nil {
+			return err
+		}
+		if len(workProgress.Client.Requests) < client.MaxRequestQueue {
+			workProgress.Client.Requests = append(workProgress.Client.Requests, request)
+		} else if workProgress.Client.Fast {
+			return workProgress.Client.SendReject(request)
+		}
+	case message.MsgCancel:
+		request, err := message.ParseRequest(msg)
+		if err != nil {
+			return err
+		}
+		for i, pending := range workProgress.Client.Requests {
+			if pending == request {
+				workProgress.Client.Requests = append(workProgress.Client.Requests[:i], workProgress.Client.Requests[i+1:]...)
+				break
+			}
+		}
 	case message.MsgPiece:
-		dataAmount, err := message.ParsePiece(workProgress.Index, workProgress.Buf, msg)
+		// Not downloading anything, e.g. while seeding
+		if workProgress.OnBlock == nil {
+			return nil
+		}
+		index, begin, data, err := message.ParseBlock(msg)
+		if err != nil {
+			return err
+		}
+		return workProgress.OnBlock(index, begin, data)
+	case message.MsgHaveAll, message.MsgHaveNone, message.MsgSuggest, message.MsgAllowedFast:
+		return workProgress.Client.HandleFast(msg)
+	case message.MsgReject:
+		if !workProgress.Client.Fast {
+			return errors.New("reject received without the fast extension")
+		}
+		request, err := message.ParseRequest(msg)
+		if err != nil {
+			return err
+		}
+		if workProgress.OnReject != nil {
+			workProgress.OnReject(request)
+		}
+	case message.MsgExtended:
+		err = workProgress.Client.HandleExtended(msg)
 		if err != nil {
 			return err
 		}
-		workProgress.Downloaded += dataAmount
-		workProgress.Backlog -= 1
 	case message.MsgBitfield:
 		workProgress.Client.Bitfield, err = message.ParseBitfield(msg)
 		if err != nil {
 			return err
 		}
+	case message.MsgPort:
+		workProgress.Client.DHTPort, err = message.ParsePort(msg)
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }